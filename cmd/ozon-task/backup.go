@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/config"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/database"
+)
+
+func backup(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	output := flags.String("o", "", "archive to write, standard output if empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	// a backup never changes what it copies
+	db, err := connectSQL(cfg, database.MigrateNone)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	manifest, err := db.Backup(context.Background(), w)
+	if err != nil {
+		if *output != "" {
+			os.Remove(*output)
+		}
+		return err
+	}
+	log.Printf("backed up %s at schema version %d", manifest.Dialect, manifest.Schema)
+	return nil
+}
+
+func restore(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	input := flags.String("i", "", "archive to read, standard input if empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	var r io.Reader = os.Stdin
+	if *input != "" {
+		file, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+	// the schema comes with a SQLite backup, Postgres should be migrated to the one of the backup
+	db, err := connectSQL(cfg, database.MigrateNone)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	manifest, err := db.Restore(context.Background(), r)
+	if err != nil {
+		return err
+	}
+	log.Printf("restored the backup of %s taken at %s", manifest.Dialect, manifest.CreatedAt.Format(time.RFC3339))
+	return nil
+}
@@ -1,40 +1,66 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
 	"log"
-	"net/http"
 	"os"
 
-	"github.com/99designs/gqlgen/graphql/handler"
-	"github.com/99designs/gqlgen/graphql/playground"
-	"github.com/go-chi/chi/v5"
-	"github.com/idkwhyureadthis/ozon-task/graph"
-	"github.com/idkwhyureadthis/ozon-task/internal/pkg/database"
-	"github.com/idkwhyureadthis/ozon-task/internal/pkg/mw"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/config"
 )
 
-const defaultPort = "8080"
-
-func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = defaultPort
-	}
-
-	storage := os.Getenv("STORAGE")
-	_ = os.Getenv("MIGRATIONS")
-	database.Connect(storage, "RESET")
-	graph.Init()
-	defer database.GetConnection().Client.Close()
+// command is a subcommand of the binary, run gets the arguments following its name.
+type command struct {
+	name  string
+	usage string
+	run   func(cfg *config.Config, args []string) error
+}
 
-	srv := handler.NewDefaultServer(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
-	router := chi.NewRouter()
-	router.Handle("/", playground.Handler("GraphQL playground", "/query"))
+var commands = []command{
+	{"serve", "serve the GraphQL API, what runs without a command", serve},
+	{"migrate", "migrate up|down|status|reset|to <version>", migrate},
+	{"seed", "seed [flags]: fill the storage with generated users, posts and comments", seed},
+	{"export", "export [-o file]: write users, posts and comments as JSON Lines", export},
+	{"import", "import [-i file]: load what export wrote into empty tables, keeping ids", importData},
+	{"backup", "backup [-o file]: archive the SQL storage while it is in use", backup},
+	{"restore", "restore [-i file]: check an archive made by backup and replace the SQL storage with it", restore},
+	{"user", "user create [flags] | user promote -role role <id>", user},
+}
 
-	authGroup := router.Group(nil)
-	authGroup.Use(mw.AuthMiddleware)
-	authGroup.Handle("/query", srv)
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: ozon-task [flags] [command] [arguments]\n\ncommands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", c.name, c.usage)
+	}
+	fmt.Fprintln(os.Stderr, "\nflags, every command reads them and the variables in parentheses, which .env may set:")
+	config.Usage(os.Stderr)
+}
 
-	log.Printf("connect to http://localhost:%s/ for GraphQL playground", port)
-	log.Fatal(http.ListenAndServe(":"+port, router))
+func main() {
+	cfg, args, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		usage()
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	name := "serve"
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	for _, c := range commands {
+		if c.name != name {
+			continue
+		}
+		if err := c.run(cfg, args); err != nil && !errors.Is(err, flag.ErrHelp) {
+			log.Fatal(err)
+		}
+		return
+	}
+	usage()
+	if name != "help" {
+		os.Exit(2)
+	}
 }
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/config"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/database"
+)
+
+// migrate runs the migrations the way MIGRATIONS would, "to <version>" is spelled with a space.
+func migrate(cfg *config.Config, args []string) error {
+	var mode string
+	switch {
+	case len(args) == 1 && args[0] != "to":
+		mode = args[0]
+	case len(args) == 2 && args[0] == "to":
+		mode = "to:" + args[1]
+	default:
+		return errors.New("usage: migrate up|down|status|reset|to <version>")
+	}
+	db, err := connectSQL(cfg, database.MigrateNone)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Migrate(context.Background(), mode)
+}
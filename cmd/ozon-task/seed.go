@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+
+	"github.com/idkwhyureadthis/ozon-task/graph/model"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/auth"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/config"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/database"
+)
+
+var (
+	seedNames = []string{"anna", "boris", "vera", "gleb", "dasha", "egor", "zhenya", "ivan", "katya", "lev",
+		"masha", "nikita", "olga", "pavel", "rita", "sergey", "tanya", "fedor", "yulia", "yaroslav"}
+	seedAbouts = []string{"backend developer", "reads everything, writes rarely", "coffee first", "moderating since forever",
+		"here for the comments", "go, postgres and long walks", "", "student", "just looking around"}
+	seedWords = strings.Fields(`the a this that post comment thread reply idea question answer go graphql query
+		schema database index migration transaction server client cache test bug fix release feature review
+		works breaks again really probably never always today yesterday tomorrow quickly slowly simple hard
+		think know guess agree disagree like love hate need want try use write read deploy run build`)
+)
+
+// generator makes up text for seed, the same seed gives the same data.
+type generator struct {
+	*rand.Rand
+}
+
+func (g generator) pick(words []string) string {
+	return words[g.Intn(len(words))]
+}
+
+// sentence has between from and to words, a capital letter and a full stop.
+func (g generator) sentence(from, to int) string {
+	words := make([]string, from+g.Intn(to-from+1))
+	for i := range words {
+		words[i] = g.pick(seedWords)
+	}
+	text := strings.Join(words, " ")
+	return strings.ToUpper(text[:1]) + text[1:] + g.pick([]string{".", ".", ".", "?", "!"})
+}
+
+func (g generator) text(sentences int) string {
+	parts := make([]string, 1+g.Intn(sentences))
+	for i := range parts {
+		parts[i] = g.sentence(4, 14)
+	}
+	return strings.Join(parts, " ")
+}
+
+func seed(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("seed", flag.ContinueOnError)
+	users := flags.Int("users", 20, "users to create")
+	posts := flags.Int("posts", 50, "posts to create")
+	comments := flags.Int("comments", 500, "comments to create, replies included")
+	replies := flags.Float64("replies", 0.7, "share of comments answering another comment")
+	source := flags.Int64("seed", 1, "seed of the generated data")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *users < 1 || (*comments > 0 && *posts < 1) {
+		return errors.New("seed needs at least one user, and a post to comment")
+	}
+	db := connect(cfg, database.MigrateUp)
+	defer db.Close()
+	g := generator{rand.New(rand.NewSource(*source))}
+	as := func(user *model.User) context.Context {
+		return auth.WithPrincipal(context.Background(), auth.Principal{UserID: user.ID})
+	}
+
+	created := make([]*model.User, *users)
+	for i := range created {
+		var err error
+		created[i], err = db.CreateUser(context.Background(), &model.CreateUserInput{
+			Name:  fmt.Sprintf("%s_%d", g.pick(seedNames), g.Intn(10000)),
+			About: g.pick(seedAbouts),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	commentable := []*model.Post{}
+	for i := 0; i < *posts; i++ {
+		post, err := db.CreatePost(as(created[g.Intn(len(created))]), &model.CreatePostInput{
+			Data:        g.text(6),
+			Commentable: g.Intn(10) > 0,
+		})
+		if err != nil {
+			return err
+		}
+		if post.Commentable {
+			commentable = append(commentable, post)
+		}
+	}
+	if len(commentable) == 0 && *comments > 0 {
+		return errors.New("none of the posts is commentable, try another -seed")
+	}
+	// threads grow by answering comments picked at random among those of the post
+	threads := map[string][]string{}
+	for i := 0; i < *comments; i++ {
+		post := commentable[g.Intn(len(commentable))]
+		answerTo := "-1"
+		if thread := threads[post.ID]; len(thread) > 0 && g.Float64() < *replies {
+			answerTo = thread[g.Intn(len(thread))]
+		}
+		comment, err := db.CreateComment(as(created[g.Intn(len(created))]), &model.CreateCommentInput{
+			Post:     post.ID,
+			Text:     g.text(3),
+			AnswerTo: answerTo,
+		})
+		if err != nil {
+			return err
+		}
+		threads[post.ID] = append(threads[post.ID], comment.ID)
+	}
+	log.Printf("seeded %d users, %d posts and %d comments", *users, *posts, *comments)
+	if _, ok := db.(*database.Memory); ok {
+		log.Println("STORAGE is memory, the seeded data is gone with the process")
+	}
+	return nil
+}
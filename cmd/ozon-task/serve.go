@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql/handler"
+	"github.com/99designs/gqlgen/graphql/handler/extension"
+	"github.com/99designs/gqlgen/graphql/handler/lru"
+	"github.com/99designs/gqlgen/graphql/handler/transport"
+	"github.com/99designs/gqlgen/graphql/playground"
+	"github.com/go-chi/chi/v5"
+	"github.com/idkwhyureadthis/ozon-task/graph"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/auth"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/config"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/database"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/loaders"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/mailer"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/mw"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/sso"
+)
+
+const (
+	purgeInterval = time.Hour
+	// shutdownTimeout is how long requests in flight are waited for on shutdown.
+	shutdownTimeout = 10 * time.Second
+)
+
+// purgeDeleted removes deleted rows whose restore window has passed, once in purgeInterval,
+// until ctx is done.
+func purgeDeleted(ctx context.Context, db database.Storage) {
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := db.Purge(ctx, time.Now().UTC().Add(-database.RestoreWindow)); err != nil {
+				log.Println("failed to purge deleted rows:", err)
+			}
+		}
+	}
+}
+
+func serve(cfg *config.Config, args []string) error {
+	if err := flag.NewFlagSet("serve", flag.ContinueOnError).Parse(args); err != nil {
+		return err
+	}
+	secret := []byte(cfg.AuthSecret)
+	if len(secret) == 0 {
+		log.Println("AUTH_SECRET is not set, tokens will stop working after restart")
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Fatal("failed to generate token secret:", err)
+		}
+	}
+	tokens := auth.NewTokens(secret)
+
+	var mail mailer.Mailer = mailer.Log{Logger: log.Default(), Bodies: cfg.Dev}
+	if cfg.SMTP.Addr != "" {
+		mail = &mailer.SMTP{
+			Addr:     cfg.SMTP.Addr,
+			From:     cfg.SMTP.From,
+			Username: cfg.SMTP.Username,
+			Password: cfg.SMTP.Password,
+		}
+	} else {
+		log.Println("SMTP_ADDR is not set, e-mails will only be logged, with their tokens if DEV is set")
+	}
+
+	db := connect(cfg, cfg.Migrations)
+	defer db.Close()
+	// ctx is done on SIGINT or SIGTERM, or when serve returns: whatever runs in the
+	// background stops before the storage is closed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	purged := make(chan struct{})
+	go func() {
+		defer close(purged)
+		purgeDeleted(ctx, db)
+	}()
+	defer func() { <-purged }()
+	defer stop()
+
+	resolver := &graph.Resolver{
+		Storage:  db,
+		Tokens:   tokens,
+		Mailer:   mail,
+		Logger:   log.Default(),
+		Clock:    time.Now,
+		Settings: cfg,
+	}
+
+	srv := handler.New(graph.NewExecutableSchema(graph.NewConfig(resolver)))
+	srv.AddTransport(transport.Websocket{
+		KeepAlivePingInterval: 10 * time.Second,
+		InitFunc:              mw.WebsocketInit(tokens, db),
+	})
+	srv.AddTransport(transport.Options{})
+	srv.AddTransport(transport.GET{})
+	srv.AddTransport(transport.POST{})
+	srv.AddTransport(transport.MultipartForm{})
+	srv.SetQueryCache(lru.New(1000))
+	srv.SetErrorPresenter(graph.ErrorPresenter)
+	srv.Use(extension.Introspection{})
+	srv.Use(extension.AutomaticPersistedQuery{
+		Cache: lru.New(100),
+	})
+
+	router := chi.NewRouter()
+	router.Use(mw.RealIP(cfg.TrustedPrefixes()))
+	router.Handle("/", playground.Handler("GraphQL playground", "/query"))
+
+	authGroup := router.Group(nil)
+	authGroup.Use(mw.AuthMiddleware(tokens, db))
+	authGroup.Use(loaders.Middleware(db))
+	authGroup.Handle("/query", srv)
+
+	if cfg.OIDC.Issuer != "" {
+		provider, err := sso.New(context.Background(), sso.Config{
+			Issuer:       cfg.OIDC.Issuer,
+			ClientID:     cfg.OIDC.ClientID,
+			ClientSecret: cfg.OIDC.ClientSecret,
+			RedirectURL:  cfg.OIDC.RedirectURL,
+		}, db, tokens)
+		if err != nil {
+			log.Fatal("failed to discover OIDC_ISSUER:", err)
+		}
+		authGroup.Get("/auth/oidc/login", provider.Login)
+		authGroup.Get("/auth/oidc/callback", provider.Callback)
+	}
+
+	server := &http.Server{Addr: fmt.Sprintf(":%d", cfg.Port), Handler: router}
+	shutDown := make(chan struct{})
+	go func() {
+		defer close(shutDown)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Println("failed to shut down:", err)
+		}
+	}()
+	log.Printf("connect to http://localhost:%d/ for GraphQL playground", cfg.Port)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	// ListenAndServe returns as soon as Shutdown starts, requests in flight still use the storage
+	<-shutDown
+	log.Println("shut down")
+	return nil
+}
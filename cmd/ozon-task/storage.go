@@ -0,0 +1,28 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/config"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/database"
+)
+
+// connect opens the storage and migrates it in the migrations mode. Only serve runs the
+// configured one: the server's MIGRATIONS=reset must not wipe the data whenever a
+// maintenance command runs next to it, so those pass up or none.
+func connect(cfg *config.Config, migrations string) database.Storage {
+	connectCfg := *cfg
+	connectCfg.Migrations = migrations
+	return database.Connect(&connectCfg)
+}
+
+// connectSQL is connect for commands that only work with Postgres and SQLite.
+func connectSQL(cfg *config.Config, migrations string) (*database.DB, error) {
+	storage := connect(cfg, migrations)
+	db, ok := storage.(*database.DB)
+	if !ok {
+		storage.Close()
+		return nil, errors.New("STORAGE should be a Postgres URL or a SQLite file name")
+	}
+	return db, nil
+}
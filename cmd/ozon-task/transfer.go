@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"os"
+
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/config"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/database"
+)
+
+func export(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	output := flags.String("o", "", "file to write, standard output if empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	db, err := connectSQL(cfg, database.MigrateNone)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	return db.Export(context.Background(), w)
+}
+
+func importData(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	input := flags.String("i", "", "file to read, standard input if empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	var r io.Reader = os.Stdin
+	if *input != "" {
+		file, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+	db, err := connectSQL(cfg, database.MigrateUp)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Import(context.Background(), r)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/idkwhyureadthis/ozon-task/graph/model"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/auth"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/config"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/database"
+)
+
+// user runs the admin tasks with users that the API can't do for nobody.
+func user(cfg *config.Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: user create [flags] | user promote -role role <id>")
+	}
+	switch args[0] {
+	case "create":
+		return createUser(cfg, args[1:])
+	case "promote":
+		return promoteUser(cfg, args[1:])
+	}
+	return fmt.Errorf("unknown user command %q, expected create or promote", args[0])
+}
+
+func createUser(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("user create", flag.ContinueOnError)
+	name := flags.String("name", "", "name to log in with")
+	password := flags.String("password", "", "password to log in with")
+	email := flags.String("email", "", "e-mail, optional")
+	about := flags.String("about", "", "about, optional")
+	role := flags.String("role", "", "role to grant: moderator or admin, optional")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *name == "" || *password == "" {
+		return errors.New("-name and -password are required")
+	}
+	hash, err := auth.HashPassword(*password)
+	if err != nil {
+		return err
+	}
+	input := &model.RegisterInput{Name: *name, About: *about, Password: *password}
+	if *email != "" {
+		input.Email = email
+	}
+	db := connect(cfg, database.MigrateUp)
+	defer db.Close()
+	ctx := context.Background()
+	created, err := db.Register(ctx, input, hash)
+	if err != nil {
+		return err
+	}
+	if *role != "" {
+		if created, err = db.GrantRole(ctx, created.ID, model.Role(strings.ToUpper(*role))); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("created user %s with id %s and role %s\n", created.Name, created.ID, strings.ToLower(string(created.Role)))
+	return nil
+}
+
+func promoteUser(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("user promote", flag.ContinueOnError)
+	role := flags.String("role", "admin", "role to grant: user, moderator or admin")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: user promote -role role <id>")
+	}
+	db := connect(cfg, database.MigrateNone)
+	defer db.Close()
+	promoted, err := db.GrantRole(context.Background(), flags.Arg(0), model.Role(strings.ToUpper(*role)))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("user %s with id %s is %s now\n", promoted.Name, promoted.ID, strings.ToLower(string(promoted.Role)))
+	return nil
+}
@@ -0,0 +1,193 @@
+package graph
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/idkwhyureadthis/ozon-task/graph/model"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/apperr"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/auth"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/policy"
+)
+
+// NewConfig wires resolver and the directives declared in the schema together.
+func NewConfig(resolver *Resolver) Config {
+	return Config{
+		Resolvers: resolver,
+		Directives: DirectiveRoot{
+			Auth:    resolver.auth,
+			HasRole: resolver.hasRole,
+			Owner:   resolver.owner,
+			Length:  resolver.length,
+			Pattern: pattern,
+		},
+	}
+}
+
+// errDeletedActor is returned to requests made on behalf of a deleted user.
+var errDeletedActor = apperr.Unauthenticated("user with such id does not exist")
+
+// actor returns the user the request is made by along with ctx keeping them, so the
+// directives of a field and its resolver look the user up once. gqlgen runs the
+// directives of a field from the last to the first, so @auth is listed last in the
+// schema: @owner and @hasRole would tell a stranger whether the id exists otherwise.
+func (r *Resolver) actor(ctx context.Context) (context.Context, *model.User, error) {
+	if actor, ok := policy.ActorFrom(ctx); ok {
+		return ctx, actor, nil
+	}
+	principal, ok := auth.PrincipalFrom(ctx)
+	if !ok {
+		return ctx, nil, auth.ErrNotAuthorized
+	}
+	users, errs := r.Storage.GetUsersByIds(ctx, []string{principal.UserID})
+	if appErr, ok := apperr.As(errs[0]); ok && appErr.Code == apperr.CodeNotFound {
+		return ctx, nil, errDeletedActor
+	}
+	if errs[0] != nil {
+		return ctx, nil, errs[0]
+	}
+	return policy.WithActor(ctx, users[0]), users[0], nil
+}
+
+func (r *Resolver) auth(ctx context.Context, obj interface{}, next graphql.Resolver, scope *string, allowDeleted *bool) (interface{}, error) {
+	var required auth.Scope
+	if scope != nil {
+		required = auth.Scope(*scope)
+	}
+	if _, err := auth.Authorize(ctx, required); err != nil {
+		return nil, err
+	}
+	ctx, actor, err := r.actor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if actor.Deleted && (allowDeleted == nil || !*allowDeleted) {
+		return nil, errDeletedActor
+	}
+	return next(ctx)
+}
+
+func (r *Resolver) hasRole(ctx context.Context, obj interface{}, next graphql.Resolver, role model.Role) (interface{}, error) {
+	ctx, actor, err := r.actor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := policy.RequireRole(actor, role); err != nil {
+		return nil, err
+	}
+	return next(ctx)
+}
+
+func (r *Resolver) owner(ctx context.Context, obj interface{}, next graphql.Resolver, action string, arg *string) (interface{}, error) {
+	ctx, actor, err := r.actor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	field := graphql.GetFieldContext(ctx)
+	name := "id"
+	if arg != nil {
+		name = *arg
+	}
+	id, _ := field.Args[name].(string)
+	owner, err := r.ownerOf(ctx, field.Field.Definition.Type.Name(), id)
+	if err != nil {
+		return nil, err
+	}
+	// deleted users are let in by @auth to act on their own account only
+	if actor.Deleted && owner != actor.ID {
+		return nil, errDeletedActor
+	}
+	if err := policy.Check(actor, policy.Action(action), owner); err != nil {
+		return nil, err
+	}
+	return next(ctx)
+}
+
+// ownerOf returns the id of the user owning the user, post or comment with id.
+// Loaders aren't used, the mutation would leave what they cached stale.
+func (r *Resolver) ownerOf(ctx context.Context, typeName string, id string) (string, error) {
+	switch typeName {
+	case "User":
+		users, errs := r.Storage.GetUsersByIds(ctx, []string{id})
+		if errs[0] != nil {
+			return "", errs[0]
+		}
+		return users[0].ID, nil
+	case "Post":
+		posts, errs := r.Storage.GetPostsByIds(ctx, []string{id})
+		if errs[0] != nil {
+			return "", errs[0]
+		}
+		return posts[0].AuthorID, nil
+	case "Comment":
+		comments, errs := r.Storage.GetCommentsByIds(ctx, []string{id})
+		if errs[0] != nil {
+			return "", errs[0]
+		}
+		return comments[0].CreatorID, nil
+	}
+	return "", fmt.Errorf("%s has no owner", typeName)
+}
+
+// invalid returns the error for a value of an input field or argument that breaks rule,
+// extensions name the field so that clients can show it next to the right input.
+func invalid(ctx context.Context, rule string, message string, extensions map[string]interface{}) error {
+	field := graphql.GetPathContext(ctx).Field
+	extensions["field"] = *field
+	extensions["rule"] = rule
+	return &apperr.Error{
+		Code:       apperr.CodeValidation,
+		Message:    *field + " " + message,
+		Extensions: extensions,
+	}
+}
+
+func (r *Resolver) length(ctx context.Context, obj interface{}, next graphql.Resolver, min *int, max int, limit *string) (interface{}, error) {
+	value, err := next(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if limit != nil {
+		if configured, ok := r.settings().Limits.Length(*limit); ok {
+			max = configured
+		}
+	}
+	least := 0
+	if min != nil {
+		least = *min
+	}
+	length := utf8.RuneCountInString(value.(string))
+	if length < least || length > max {
+		return nil, invalid(ctx, "length", fmt.Sprintf("must be from %d to %d characters long", least, max), map[string]interface{}{
+			"min": least,
+			"max": max,
+		})
+	}
+	return value, nil
+}
+
+// patterns keeps the compiled regexps of @pattern directives.
+var patterns sync.Map
+
+func pattern(ctx context.Context, obj interface{}, next graphql.Resolver, expr string, message string) (interface{}, error) {
+	value, err := next(ctx)
+	if err != nil {
+		return nil, err
+	}
+	compiled, ok := patterns.Load(expr)
+	if !ok {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("wrong pattern %q: %w", expr, err)
+		}
+		compiled, _ = patterns.LoadOrStore(expr, re)
+	}
+	if !compiled.(*regexp.Regexp).MatchString(value.(string)) {
+		return nil, invalid(ctx, "pattern", message, map[string]interface{}{})
+	}
+	return value, nil
+}
@@ -0,0 +1,37 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/apperr"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+// ErrorPresenter puts the code of apperr errors into extensions.code along with the
+// extensions they carry. Errors gqlgen makes itself, e.g. of parsing queries, are presented
+// as it does. Any other error is a failure of the server: it is logged and clients get
+// apperr.ErrInternal instead, it may tell what they shouldn't know.
+func ErrorPresenter(ctx context.Context, err error) *gqlerror.Error {
+	presented := graphql.DefaultErrorPresenter(ctx, err)
+	appErr, ok := apperr.As(err)
+	if !ok {
+		var gqlErr *gqlerror.Error
+		if errors.As(err, &gqlErr) && gqlErr.Unwrap() == nil {
+			return presented
+		}
+		log.Println("unexpected error:", err)
+		appErr, _ = apperr.As(apperr.ErrInternal)
+		presented.Message = appErr.Message
+	}
+	if presented.Extensions == nil {
+		presented.Extensions = map[string]interface{}{}
+	}
+	for key, value := range appErr.Extensions {
+		presented.Extensions[key] = value
+	}
+	presented.Extensions["code"] = appErr.Code
+	return presented
+}
@@ -2,14 +2,53 @@
 
 package model
 
+import (
+	"fmt"
+	"io"
+	"strconv"
+)
+
+type APIKey struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	CreatedAt  string   `json:"createdAt"`
+	LastUsedAt *string  `json:"lastUsedAt,omitempty"`
+}
+
+type AuthPayload struct {
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+	User         *User  `json:"user"`
+}
+
 type Comment struct {
 	ID             string `json:"id"`
 	Text           string `json:"text"`
-	Post           *Post  `json:"post"`
 	AnswerTo       string `json:"answer_to"`
 	InitialComment string `json:"initial_comment"`
-	Creator        *User  `json:"creator"`
 	HasReplies     bool   `json:"hasReplies"`
+	Deleted        bool   `json:"deleted"`
+	Hidden         bool   `json:"hidden"`
+	CreatorID      string `json:"-"`
+	PostID         string `json:"-"`
+}
+
+type CommentConnection struct {
+	Edges      []*CommentEdge `json:"edges"`
+	PageInfo   *PageInfo      `json:"pageInfo"`
+	TotalCount int            `json:"totalCount"`
+}
+
+type CommentEdge struct {
+	Cursor string   `json:"cursor"`
+	Node   *Comment `json:"node"`
+}
+
+type CommentThread struct {
+	Comment     *Comment         `json:"comment"`
+	Replies     []*CommentThread `json:"replies"`
+	MoreReplies bool             `json:"moreReplies"`
 }
 
 type CreateCommentInput struct {
@@ -24,23 +63,68 @@ type CreatePostInput struct {
 }
 
 type CreateUserInput struct {
-	Name  string `json:"name"`
-	About string `json:"about"`
+	Name  string  `json:"name"`
+	About string  `json:"about"`
+	Email *string `json:"email,omitempty"`
+}
+
+type CreatedAPIKey struct {
+	Key    string  `json:"key"`
+	APIKey *APIKey `json:"apiKey"`
 }
 
 type Mutation struct {
 }
 
+type PageInfo struct {
+	HasNextPage     bool    `json:"hasNextPage"`
+	HasPreviousPage bool    `json:"hasPreviousPage"`
+	StartCursor     *string `json:"startCursor,omitempty"`
+	EndCursor       *string `json:"endCursor,omitempty"`
+}
+
 type Post struct {
 	ID          string `json:"id"`
 	Data        string `json:"data"`
 	Commentable bool   `json:"commentable"`
-	Author      *User  `json:"author"`
+	Deleted     bool   `json:"deleted"`
+	AuthorID    string `json:"-"`
+}
+
+type PostConnection struct {
+	Edges      []*PostEdge `json:"edges"`
+	PageInfo   *PageInfo   `json:"pageInfo"`
+	TotalCount int         `json:"totalCount"`
+}
+
+type PostEdge struct {
+	Cursor string `json:"cursor"`
+	Node   *Post  `json:"node"`
 }
 
 type Query struct {
 }
 
+type RegisterInput struct {
+	Name     string  `json:"name"`
+	About    string  `json:"about"`
+	Password string  `json:"password"`
+	Email    *string `json:"email,omitempty"`
+}
+
+type Session struct {
+	ID         string `json:"id"`
+	CreatedAt  string `json:"createdAt"`
+	LastSeenAt string `json:"lastSeenAt"`
+	ExpiresAt  string `json:"expiresAt"`
+	IP         string `json:"ip"`
+	UserAgent  string `json:"userAgent"`
+	Current    bool   `json:"current"`
+}
+
+type Subscription struct {
+}
+
 type UpdateCommentInput struct {
 	Data string `json:"data"`
 }
@@ -55,7 +139,52 @@ type UpdateUserInput struct {
 }
 
 type User struct {
-	ID    string `json:"id"`
-	Name  string `json:"name"`
-	About string `json:"about"`
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	About   string `json:"about"`
+	Deleted bool   `json:"deleted"`
+	Role    Role   `json:"role"`
+}
+
+type Role string
+
+const (
+	RoleUser      Role = "USER"
+	RoleModerator Role = "MODERATOR"
+	RoleAdmin     Role = "ADMIN"
+)
+
+var AllRole = []Role{
+	RoleUser,
+	RoleModerator,
+	RoleAdmin,
+}
+
+func (e Role) IsValid() bool {
+	switch e {
+	case RoleUser, RoleModerator, RoleAdmin:
+		return true
+	}
+	return false
+}
+
+func (e Role) String() string {
+	return string(e)
+}
+
+func (e *Role) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = Role(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid Role", str)
+	}
+	return nil
+}
+
+func (e Role) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
 }
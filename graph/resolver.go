@@ -1,9 +1,138 @@
 package graph
 
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/idkwhyureadthis/ozon-task/graph/model"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/apperr"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/auth"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/config"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/database"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/loaders"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/mailer"
+)
+
 //go:generate go run github.com/99designs/gqlgen generate
 
 // This file will not be regenerated automatically.
 //
 // It serves as dependency injection for your app, add any dependencies you require here.
 
-type Resolver struct{}
+type Resolver struct {
+	Storage database.Storage
+	Tokens  *auth.Tokens
+	Mailer  mailer.Mailer
+	Logger  *log.Logger
+	Clock   func() time.Time
+	// Settings give the subscription timeout and the limits of @length directives,
+	// the defaults stand in for nil and for limits left unset.
+	Settings *config.Config
+}
+
+// settings returns Settings with the limits left unset taken from config.Default,
+// which stands in for all of them when Settings is nil.
+func (r *Resolver) settings() *config.Config {
+	if r.Settings == nil {
+		return config.Default()
+	}
+	settings := *r.Settings
+	settings.Limits = settings.Limits.WithDefaults()
+	return &settings
+}
+
+// subscriptionContext applies SubscriptionTimeout to ctx and logs when the subscription ends.
+func (r *Resolver) subscriptionContext(ctx context.Context, topic string) context.Context {
+	cancel := context.CancelFunc(func() {})
+	if timeout := r.settings().SubscriptionTimeout; timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	started := r.Clock()
+	r.Logger.Println("subscribed to", topic)
+	go func() {
+		<-ctx.Done()
+		cancel()
+		r.Logger.Println("unsubscribed from", topic, "after", r.Clock().Sub(started))
+	}()
+	return ctx
+}
+
+// loaders returns the request's loaders, requests without them (subscriptions) get fresh ones.
+func (r *Resolver) loaders(ctx context.Context) *loaders.Loaders {
+	if l := loaders.For(ctx); l != nil {
+		return l
+	}
+	return loaders.New(r.Storage)
+}
+
+// errInvalidRefreshToken doesn't tell whether the token is malformed, expired or revoked.
+var errInvalidRefreshToken = apperr.Unauthenticated("invalid refresh token")
+
+// openSession answers register and login: it opens a session for user and issues tokens bound to it.
+func (r *Resolver) openSession(ctx context.Context, user *model.User) (*model.AuthPayload, error) {
+	session, err := r.Storage.CreateSession(ctx, user.ID, auth.ClientFrom(ctx), r.Clock().Add(r.Tokens.RefreshTTL))
+	if err != nil {
+		return nil, err
+	}
+	return r.issueTokens(auth.Principal{UserID: user.ID, SessionID: session.ID}, user)
+}
+
+// issueTokens returns a new pair of tokens for principal, refreshToken reuses the session it had.
+func (r *Resolver) issueTokens(principal auth.Principal, user *model.User) (*model.AuthPayload, error) {
+	pair, err := r.Tokens.Issue(principal)
+	if err != nil {
+		r.Logger.Println("failed to issue tokens:", err)
+		return nil, apperr.ErrInternal
+	}
+	return &model.AuthPayload{
+		AccessToken:  pair.AccessToken,
+		RefreshToken: pair.RefreshToken,
+		User:         user,
+	}, nil
+}
+
+// emailTokenMails are the letters tokens of each purpose are sent in.
+var emailTokenMails = map[auth.TokenPurpose]struct {
+	subject string
+	body    string
+	ttl     time.Duration
+}{
+	auth.PurposeVerifyEmail: {
+		subject: "Confirm your e-mail",
+		body:    "Use this token to confirm your e-mail, it is valid for a day:\n\n%s\n",
+		ttl:     auth.VerifyEmailTTL,
+	},
+	auth.PurposePasswordReset: {
+		subject: "Reset your password",
+		body:    "Use this token to set a new password, it is valid for an hour:\n\n%s\n\nIf you didn't ask for it, ignore this letter.\n",
+		ttl:     auth.PasswordResetTTL,
+	},
+}
+
+// sendEmailToken mails a new token for purpose to email if it belongs to a user. Failures are
+// only logged, so that the answer doesn't tell whether there is such a user.
+func (r *Resolver) sendEmailToken(ctx context.Context, email string, purpose auth.TokenPurpose) {
+	letter := emailTokenMails[purpose]
+	email, err := auth.NormalizeEmail(email)
+	if err != nil {
+		return
+	}
+	token, hash, err := auth.NewEmailToken()
+	if err != nil {
+		r.Logger.Println("failed to generate email token:", err)
+		return
+	}
+	if found, err := r.Storage.CreateEmailToken(ctx, email, purpose, hash, r.Clock().Add(letter.ttl)); err != nil || !found {
+		return
+	}
+	err = r.Mailer.Send(ctx, mailer.Message{
+		To:      email,
+		Subject: letter.subject,
+		Body:    fmt.Sprintf(letter.body, token),
+	})
+	if err != nil {
+		r.Logger.Println("failed to send email:", err)
+	}
+}
@@ -6,89 +6,315 @@ package graph
 
 import (
 	"context"
+	"errors"
+	"fmt"
 
 	"github.com/idkwhyureadthis/ozon-task/graph/model"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/apperr"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/auth"
 	"github.com/idkwhyureadthis/ozon-task/internal/pkg/database"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/loaders"
 )
 
-var db *database.DB
+// Post is the resolver for the post field.
+func (r *commentResolver) Post(ctx context.Context, obj *model.Comment) (*model.Post, error) {
+	if obj.PostID == "" {
+		return nil, fmt.Errorf("comment %s has no post id", obj.ID)
+	}
+	return r.loaders(ctx).PostById.Load(ctx, obj.PostID)()
+}
+
+// Creator is the resolver for the creator field.
+func (r *commentResolver) Creator(ctx context.Context, obj *model.Comment) (*model.User, error) {
+	if obj.CreatorID == "" {
+		return nil, fmt.Errorf("comment %s has no creator id", obj.ID)
+	}
+	return r.loaders(ctx).UserById.Load(ctx, obj.CreatorID)()
+}
+
+// Parent is the resolver for the parent field.
+func (r *commentResolver) Parent(ctx context.Context, obj *model.Comment) (*model.Comment, error) {
+	if obj.AnswerTo == "" || obj.AnswerTo == "-1" {
+		return nil, nil
+	}
+	return r.loaders(ctx).CommentById.Load(ctx, obj.AnswerTo)()
+}
+
+// Replies is the resolver for the replies field.
+func (r *commentResolver) Replies(ctx context.Context, obj *model.Comment, first *int, after *string) (*model.CommentConnection, error) {
+	if obj.ID == "" {
+		return nil, errors.New("comment has no id")
+	}
+	return r.loaders(ctx).RepliesByKey.Load(ctx, loaders.NewRepliesKey(obj.ID, first, after))()
+}
+
+// Register is the resolver for the register field.
+func (r *mutationResolver) Register(ctx context.Context, input model.RegisterInput) (*model.AuthPayload, error) {
+	hash, err := auth.HashPassword(input.Password)
+	if err != nil {
+		return nil, err
+	}
+	user, err := r.Storage.Register(ctx, &input, hash)
+	if err != nil {
+		return nil, err
+	}
+	if input.Email != nil {
+		r.sendEmailToken(ctx, *input.Email, auth.PurposeVerifyEmail)
+	}
+	return r.openSession(ctx, user)
+}
+
+// Login is the resolver for the login field.
+func (r *mutationResolver) Login(ctx context.Context, name string, password string) (*model.AuthPayload, error) {
+	user, hash, err := r.Storage.GetCredentials(ctx, name)
+	if err == auth.ErrWrongPassword {
+		return nil, auth.CheckMissingPassword(password)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if auth.CheckPassword(hash, password) != nil {
+		return nil, auth.ErrWrongPassword
+	}
+	return r.openSession(ctx, user)
+}
+
+// RefreshToken is the resolver for the refreshToken field.
+func (r *mutationResolver) RefreshToken(ctx context.Context, refreshToken string) (*model.AuthPayload, error) {
+	principal, err := r.Tokens.VerifyRefresh(refreshToken)
+	if err != nil {
+		return nil, errInvalidRefreshToken
+	}
+	if err := r.Storage.TouchSession(ctx, principal, auth.ClientFrom(ctx)); err != nil {
+		if err != auth.ErrSessionExpired {
+			r.Logger.Println("failed to check session:", err)
+		}
+		return nil, errInvalidRefreshToken
+	}
+	user, err := r.Storage.GetUser(ctx, principal.UserID)
+	if err != nil || user.Deleted {
+		return nil, errInvalidRefreshToken
+	}
+	return r.issueTokens(principal, user)
+}
+
+// RequestPasswordReset is the resolver for the requestPasswordReset field.
+func (r *mutationResolver) RequestPasswordReset(ctx context.Context, email string) (bool, error) {
+	r.sendEmailToken(ctx, email, auth.PurposePasswordReset)
+	return true, nil
+}
 
-func Init() {
-	db = database.GetConnection()
+// ResetPassword is the resolver for the resetPassword field.
+func (r *mutationResolver) ResetPassword(ctx context.Context, token string, password string) (*model.User, error) {
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	return r.Storage.ResetPassword(ctx, auth.HashEmailToken(token), hash)
+}
+
+// VerifyEmail is the resolver for the verifyEmail field.
+func (r *mutationResolver) VerifyEmail(ctx context.Context, token string) (*model.User, error) {
+	return r.Storage.VerifyEmail(ctx, auth.HashEmailToken(token))
 }
 
 // CreateUser is the resolver for the createUser field.
 func (r *mutationResolver) CreateUser(ctx context.Context, input *model.CreateUserInput) (*model.User, error) {
-	return db.CreateUser(ctx, input), nil
+	user, err := r.Storage.CreateUser(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	if input.Email != nil {
+		r.sendEmailToken(ctx, *input.Email, auth.PurposeVerifyEmail)
+	}
+	return user, nil
 }
 
 // UpdateUser is the resolver for the updateUser field.
 func (r *mutationResolver) UpdateUser(ctx context.Context, input *model.UpdateUserInput) (*model.User, error) {
-	return db.UpdateUser(ctx, input), nil
+	return r.Storage.UpdateUser(ctx, input)
 }
 
 // CreatePost is the resolver for the createPost field.
 func (r *mutationResolver) CreatePost(ctx context.Context, input *model.CreatePostInput) (*model.Post, error) {
-	return db.CreatePost(ctx, input), nil
+	return r.Storage.CreatePost(ctx, input)
 }
 
 // UpdatePost is the resolver for the updatePost field.
 func (r *mutationResolver) UpdatePost(ctx context.Context, id string, input *model.UpdatePostInput) (*model.Post, error) {
-	return db.UpdatePost(ctx, id, input), nil
+	return r.Storage.UpdatePost(ctx, id, input)
 }
 
 // CreateComment is the resolver for the createComment field.
 func (r *mutationResolver) CreateComment(ctx context.Context, input *model.CreateCommentInput) (*model.Comment, error) {
-	return db.CreateComment(ctx, input), nil
+	return r.Storage.CreateComment(ctx, input)
 }
 
 // UpdateComment is the resolver for the updateComment field.
 func (r *mutationResolver) UpdateComment(ctx context.Context, commID string, input *model.UpdateCommentInput) (*model.Comment, error) {
-	return db.UpdateComment(ctx, commID, input), nil
+	return r.Storage.UpdateComment(ctx, commID, input)
+}
+
+// DeleteUser is the resolver for the deleteUser field.
+func (r *mutationResolver) DeleteUser(ctx context.Context, id string) (*model.User, error) {
+	return r.Storage.DeleteUser(ctx, id)
+}
+
+// RestoreUser is the resolver for the restoreUser field.
+func (r *mutationResolver) RestoreUser(ctx context.Context, id string) (*model.User, error) {
+	return r.Storage.RestoreUser(ctx, id)
+}
+
+// DeletePost is the resolver for the deletePost field.
+func (r *mutationResolver) DeletePost(ctx context.Context, id string) (*model.Post, error) {
+	return r.Storage.DeletePost(ctx, id)
+}
+
+// RestorePost is the resolver for the restorePost field.
+func (r *mutationResolver) RestorePost(ctx context.Context, id string) (*model.Post, error) {
+	return r.Storage.RestorePost(ctx, id)
+}
+
+// DeleteComment is the resolver for the deleteComment field.
+func (r *mutationResolver) DeleteComment(ctx context.Context, commID string) (*model.Comment, error) {
+	return r.Storage.DeleteComment(ctx, commID)
+}
+
+// RestoreComment is the resolver for the restoreComment field.
+func (r *mutationResolver) RestoreComment(ctx context.Context, commID string) (*model.Comment, error) {
+	return r.Storage.RestoreComment(ctx, commID)
+}
+
+// HideComment is the resolver for the hideComment field.
+func (r *mutationResolver) HideComment(ctx context.Context, commID string) (*model.Comment, error) {
+	return r.Storage.HideComment(ctx, commID, true)
+}
+
+// UnhideComment is the resolver for the unhideComment field.
+func (r *mutationResolver) UnhideComment(ctx context.Context, commID string) (*model.Comment, error) {
+	return r.Storage.HideComment(ctx, commID, false)
+}
+
+// SetUserRole is the resolver for the setUserRole field.
+func (r *mutationResolver) SetUserRole(ctx context.Context, id string, role model.Role) (*model.User, error) {
+	return r.Storage.SetUserRole(ctx, id, role)
+}
+
+// RevokeSession is the resolver for the revokeSession field.
+func (r *mutationResolver) RevokeSession(ctx context.Context, id string) (*model.Session, error) {
+	return r.Storage.RevokeSession(ctx, id)
+}
+
+// RevokeAllSessions is the resolver for the revokeAllSessions field.
+func (r *mutationResolver) RevokeAllSessions(ctx context.Context, exceptCurrent *bool) (int, error) {
+	return r.Storage.RevokeAllSessions(ctx, exceptCurrent != nil && *exceptCurrent)
+}
+
+// CreateAPIKey is the resolver for the createApiKey field.
+func (r *mutationResolver) CreateAPIKey(ctx context.Context, name string, scopes []string) (*model.CreatedAPIKey, error) {
+	parsed, err := auth.ParseScopes(scopes)
+	if err != nil {
+		return nil, err
+	}
+	key, hash, err := auth.NewAPIKey()
+	if err != nil {
+		r.Logger.Println("failed to generate api key:", err)
+		return nil, apperr.ErrInternal
+	}
+	apiKey, err := r.Storage.CreateAPIKey(ctx, name, parsed, hash)
+	if err != nil {
+		return nil, err
+	}
+	return &model.CreatedAPIKey{Key: key, APIKey: apiKey}, nil
+}
+
+// RevokeAPIKey is the resolver for the revokeApiKey field.
+func (r *mutationResolver) RevokeAPIKey(ctx context.Context, id string) (*model.APIKey, error) {
+	return r.Storage.RevokeAPIKey(ctx, id)
+}
+
+// Author is the resolver for the author field.
+func (r *postResolver) Author(ctx context.Context, obj *model.Post) (*model.User, error) {
+	if obj.AuthorID == "" {
+		return nil, fmt.Errorf("post %s has no author id", obj.ID)
+	}
+	return r.loaders(ctx).UserById.Load(ctx, obj.AuthorID)()
 }
 
 // Comments is the resolver for the comments field.
-func (r *queryResolver) Comments(ctx context.Context, postID string, page int) ([]*model.Comment, error) {
-	return db.GetComments(ctx, postID, page), nil
+func (r *queryResolver) Comments(ctx context.Context, postID string, first *int, after *string, last *int, before *string) (*model.CommentConnection, error) {
+	return r.Storage.GetComments(ctx, postID, database.Page{First: first, After: after, Last: last, Before: before})
 }
 
 // GetUser is the resolver for the getUser field.
 func (r *queryResolver) GetUser(ctx context.Context, id string) (*model.User, error) {
-	return db.GetUser(ctx, id), nil
+	return r.Storage.GetUser(ctx, id)
 }
 
 // Posts is the resolver for the post field
-func (r *queryResolver) Posts(ctx context.Context, page int) ([]*model.Post, error) {
-	return db.GetPosts(ctx, page), nil
+func (r *queryResolver) Posts(ctx context.Context, first *int, after *string, last *int, before *string) (*model.PostConnection, error) {
+	return r.Storage.GetPosts(ctx, database.Page{First: first, After: after, Last: last, Before: before})
 }
 
 // GetPost is the resolver for the getPost field.
 func (r *queryResolver) GetPost(ctx context.Context, postID string) (*model.Post, error) {
-	return db.GetPost(ctx, postID), nil
+	return r.Storage.GetPost(ctx, postID)
 }
 
 // GetReplies is the resolver for the getReplies field.
-func (r *queryResolver) GetReplies(ctx context.Context, commentID string, page int) ([]*model.Comment, error) {
-	return db.GetReplies(ctx, commentID, page), nil
+func (r *queryResolver) GetReplies(ctx context.Context, commentID string, first *int, after *string, last *int, before *string) (*model.CommentConnection, error) {
+	return r.Storage.GetReplies(ctx, commentID, database.Page{First: first, After: after, Last: last, Before: before})
 }
 
 // GetComment is the resolver for the getComment field.
 func (r *queryResolver) GetComment(ctx context.Context, commentID string) (*model.Comment, error) {
-	return db.GetComment(ctx, commentID), nil
+	return r.Storage.GetComment(ctx, commentID)
 }
 
+// CommentThread is the resolver for the commentThread field.
+func (r *queryResolver) CommentThread(ctx context.Context, rootID string, maxDepth *int, limit *int) (*model.CommentThread, error) {
+	return r.Storage.GetThread(ctx, rootID, maxDepth, limit)
+}
+
+// MySessions is the resolver for the mySessions field.
+func (r *queryResolver) MySessions(ctx context.Context) ([]*model.Session, error) {
+	return r.Storage.GetSessions(ctx)
+}
+
+// MyAPIKeys is the resolver for the myApiKeys field.
+func (r *queryResolver) MyAPIKeys(ctx context.Context) ([]*model.APIKey, error) {
+	return r.Storage.GetAPIKeys(ctx)
+}
+
+// CommentAdded is the resolver for the commentAdded field.
+func (r *subscriptionResolver) CommentAdded(ctx context.Context, postID string) (<-chan *model.Comment, error) {
+	ctx = r.subscriptionContext(ctx, "comments of post "+postID)
+	return r.Storage.CommentAdded(ctx, postID), nil
+}
+
+// ReplyAdded is the resolver for the replyAdded field.
+func (r *subscriptionResolver) ReplyAdded(ctx context.Context, commentID string) (<-chan *model.Comment, error) {
+	ctx = r.subscriptionContext(ctx, "replies to comment "+commentID)
+	return r.Storage.ReplyAdded(ctx, commentID), nil
+}
+
+// Comment returns CommentResolver implementation.
+func (r *Resolver) Comment() CommentResolver { return &commentResolver{r} }
+
 // Mutation returns MutationResolver implementation.
 func (r *Resolver) Mutation() MutationResolver { return &mutationResolver{r} }
 
+// Post returns PostResolver implementation.
+func (r *Resolver) Post() PostResolver { return &postResolver{r} }
+
 // Query returns QueryResolver implementation.
 func (r *Resolver) Query() QueryResolver { return &queryResolver{r} }
 
+// Subscription returns SubscriptionResolver implementation.
+func (r *Resolver) Subscription() SubscriptionResolver { return &subscriptionResolver{r} }
+
+type commentResolver struct{ *Resolver }
 type mutationResolver struct{ *Resolver }
+type postResolver struct{ *Resolver }
 type queryResolver struct{ *Resolver }
-
-// !!! WARNING !!!
-// The code below was going to be deleted when updating resolvers. It has been copied here so you have
-// one last chance to move it out of harms way if you want. There are two reasons this happens:
-//   - When renaming or deleting a resolver the old code will be put in here. You can safely delete
-//     it when you're done.
-//   - You have helper methods in this file. Move them out to keep these resolver files clean.
+type subscriptionResolver struct{ *Resolver }
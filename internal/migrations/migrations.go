@@ -0,0 +1,7 @@
+// Package migrations holds the schema migrations of every dialect in the directory named after it.
+package migrations
+
+import "embed"
+
+//go:embed postgres/*.sql sqlite3/*.sql
+var FS embed.FS
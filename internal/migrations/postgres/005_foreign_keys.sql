@@ -0,0 +1,58 @@
+-- +goose Up
+-- posts of users and comments of posts or users that no longer exist can't satisfy
+-- the constraints. They are moved as they are to orphaned_posts and orphaned_comments
+-- for the operator to look into or drop, the down migration puts them back.
+CREATE TABLE orphaned_posts AS
+SELECT * FROM posts
+WHERE (author->>'id')::INTEGER IS NULL OR (author->>'id')::INTEGER NOT IN (SELECT id FROM users);
+DELETE FROM posts WHERE id IN (SELECT id FROM orphaned_posts);
+CREATE TABLE orphaned_comments AS
+SELECT * FROM comments
+WHERE (post->>'id')::INTEGER IS NULL OR (post->>'id')::INTEGER NOT IN (SELECT id FROM posts)
+   OR (author->>'id')::INTEGER IS NULL OR (author->>'id')::INTEGER NOT IN (SELECT id FROM users);
+DELETE FROM comments WHERE id IN (SELECT id FROM orphaned_comments);
+
+ALTER TABLE posts ADD COLUMN author_id INTEGER;
+UPDATE posts SET author_id = (author->>'id')::INTEGER;
+ALTER TABLE posts ALTER COLUMN author_id SET NOT NULL;
+ALTER TABLE posts ADD CONSTRAINT posts_author_id_fkey FOREIGN KEY (author_id) REFERENCES users (id);
+ALTER TABLE posts DROP COLUMN author;
+
+ALTER TABLE comments ADD COLUMN post_id INTEGER;
+ALTER TABLE comments ADD COLUMN author_id INTEGER;
+UPDATE comments SET post_id = (post->>'id')::INTEGER, author_id = (author->>'id')::INTEGER;
+ALTER TABLE comments ALTER COLUMN post_id SET NOT NULL;
+ALTER TABLE comments ALTER COLUMN author_id SET NOT NULL;
+ALTER TABLE comments ADD CONSTRAINT comments_post_id_fkey FOREIGN KEY (post_id) REFERENCES posts (id);
+ALTER TABLE comments ADD CONSTRAINT comments_author_id_fkey FOREIGN KEY (author_id) REFERENCES users (id);
+ALTER TABLE comments DROP COLUMN post;
+ALTER TABLE comments DROP COLUMN author;
+
+-- +goose Down
+ALTER TABLE comments ADD COLUMN post JSON;
+ALTER TABLE comments ADD COLUMN author JSON;
+UPDATE comments SET
+    author = (SELECT json_build_object('id', users.id::TEXT, 'name', users.name, 'about', users.about) FROM users WHERE users.id = comments.author_id),
+    post = (
+        SELECT json_build_object(
+            'id', posts.id::TEXT,
+            'data', posts.data,
+            'commentable', posts.is_commentable = 1,
+            'author', json_build_object('id', users.id::TEXT, 'name', users.name, 'about', users.about)
+        )
+        FROM posts JOIN users ON users.id = posts.author_id
+        WHERE posts.id = comments.post_id
+    );
+ALTER TABLE comments DROP COLUMN post_id;
+ALTER TABLE comments DROP COLUMN author_id;
+
+ALTER TABLE posts ADD COLUMN author JSON;
+UPDATE posts SET author = (SELECT json_build_object('id', users.id::TEXT, 'name', users.name, 'about', users.about) FROM users WHERE users.id = posts.author_id);
+ALTER TABLE posts DROP COLUMN author_id;
+
+INSERT INTO posts (id, data, author, is_commentable)
+SELECT id, data, author, is_commentable FROM orphaned_posts;
+INSERT INTO comments (id, post, author, initial_comment, answer_to, data, has_replies)
+SELECT id, post, author, initial_comment, answer_to, data, has_replies FROM orphaned_comments;
+DROP TABLE orphaned_comments;
+DROP TABLE orphaned_posts;
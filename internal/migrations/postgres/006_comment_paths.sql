@@ -0,0 +1,63 @@
+-- +goose Up
+-- path is the chain of zero padded ids from the thread root down to the comment, e.g.
+-- 0000000001/0000000005/, so ordering by it walks a thread depth-first and a subtree
+-- is a range of paths starting with the path of its root
+ALTER TABLE comments ADD COLUMN parent_id INTEGER REFERENCES comments (id);
+ALTER TABLE comments ADD COLUMN path TEXT COLLATE "C";
+ALTER TABLE comments ADD COLUMN depth INTEGER;
+
+UPDATE comments SET parent_id = answer_to WHERE answer_to IN (SELECT id FROM comments);
+WITH RECURSIVE tree (id, path, depth) AS (
+    SELECT id, lpad(id::TEXT, 10, '0') || '/', 0 FROM comments WHERE parent_id IS NULL
+    UNION ALL
+    SELECT comments.id, tree.path || lpad(comments.id::TEXT, 10, '0') || '/', tree.depth + 1
+    FROM comments JOIN tree ON comments.parent_id = tree.id
+)
+UPDATE comments SET path = tree.path, depth = tree.depth FROM tree WHERE tree.id = comments.id;
+
+ALTER TABLE comments ALTER COLUMN path SET NOT NULL;
+ALTER TABLE comments ALTER COLUMN depth SET NOT NULL;
+ALTER TABLE comments DROP COLUMN answer_to;
+ALTER TABLE comments DROP COLUMN initial_comment;
+ALTER TABLE comments DROP COLUMN has_replies;
+
+CREATE UNIQUE INDEX comments_path_idx ON comments (path);
+CREATE INDEX comments_post_id_parent_id_idx ON comments (post_id, parent_id, id);
+CREATE INDEX comments_post_id_path_idx ON comments (post_id, path);
+CREATE INDEX comments_parent_id_idx ON comments (parent_id, id);
+
+-- +goose StatementBegin
+CREATE FUNCTION comments_set_path() RETURNS TRIGGER AS $$
+BEGIN
+    IF NEW.parent_id IS NULL THEN
+        NEW.path := lpad(NEW.id::TEXT, 10, '0') || '/';
+        NEW.depth := 0;
+    ELSE
+        SELECT path || lpad(NEW.id::TEXT, 10, '0') || '/', depth + 1 INTO NEW.path, NEW.depth
+        FROM comments WHERE id = NEW.parent_id;
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+CREATE TRIGGER comments_set_path BEFORE INSERT ON comments FOR EACH ROW EXECUTE FUNCTION comments_set_path();
+
+-- +goose Down
+DROP TRIGGER comments_set_path ON comments;
+DROP FUNCTION comments_set_path();
+DROP INDEX comments_path_idx;
+DROP INDEX comments_post_id_parent_id_idx;
+DROP INDEX comments_post_id_path_idx;
+DROP INDEX comments_parent_id_idx;
+
+ALTER TABLE comments ADD COLUMN initial_comment INTEGER;
+ALTER TABLE comments ADD COLUMN answer_to INTEGER;
+ALTER TABLE comments ADD COLUMN has_replies SMALLINT;
+UPDATE comments SET
+    answer_to = COALESCE(parent_id, -1),
+    initial_comment = COALESCE((SELECT parents.parent_id FROM comments parents WHERE parents.id = comments.parent_id), -1),
+    has_replies = CASE WHEN EXISTS (SELECT 1 FROM comments replies WHERE replies.parent_id = comments.id) THEN 1 ELSE 0 END;
+ALTER TABLE comments DROP COLUMN parent_id;
+ALTER TABLE comments DROP COLUMN path;
+ALTER TABLE comments DROP COLUMN depth;
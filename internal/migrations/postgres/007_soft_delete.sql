@@ -0,0 +1,22 @@
+-- +goose Up
+-- deleted rows are kept for the restore window and removed by Purge after it
+ALTER TABLE users ADD COLUMN deleted_at TIMESTAMPTZ;
+ALTER TABLE posts ADD COLUMN deleted_at TIMESTAMPTZ;
+ALTER TABLE comments ADD COLUMN deleted_at TIMESTAMPTZ;
+
+CREATE INDEX users_deleted_at_idx ON users (deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX posts_deleted_at_idx ON posts (deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX comments_deleted_at_idx ON comments (deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX posts_author_id_idx ON posts (author_id);
+CREATE INDEX comments_author_id_idx ON comments (author_id);
+
+-- +goose Down
+DROP INDEX users_deleted_at_idx;
+DROP INDEX posts_deleted_at_idx;
+DROP INDEX comments_deleted_at_idx;
+DROP INDEX posts_author_id_idx;
+DROP INDEX comments_author_id_idx;
+
+ALTER TABLE users DROP COLUMN deleted_at;
+ALTER TABLE posts DROP COLUMN deleted_at;
+ALTER TABLE comments DROP COLUMN deleted_at;
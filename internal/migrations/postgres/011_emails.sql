@@ -0,0 +1,22 @@
+-- +goose Up
+-- emails are stored lower-cased, tokens sent to them are single-use and only their hashes are kept
+ALTER TABLE users ADD COLUMN email TEXT;
+ALTER TABLE users ADD COLUMN email_verified_at TIMESTAMPTZ;
+CREATE UNIQUE INDEX users_email_idx ON users (email);
+
+CREATE TABLE email_tokens(
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    purpose TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ
+);
+
+CREATE INDEX email_tokens_user_id_idx ON email_tokens (user_id);
+
+-- +goose Down
+DROP TABLE email_tokens;
+DROP INDEX users_email_idx;
+ALTER TABLE users DROP COLUMN email_verified_at;
+ALTER TABLE users DROP COLUMN email;
@@ -0,0 +1,15 @@
+-- +goose Up
+-- identities link users to accounts of external OpenID Connect providers
+CREATE TABLE identities(
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    issuer TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    UNIQUE (issuer, subject)
+);
+
+CREATE INDEX identities_user_id_idx ON identities (user_id);
+
+-- +goose Down
+DROP TABLE identities;
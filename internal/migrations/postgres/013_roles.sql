@@ -0,0 +1,8 @@
+-- +goose Up
+-- roles are user, moderator and admin; hidden comments are hidden by moderators
+ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user' CHECK (role IN ('user', 'moderator', 'admin'));
+ALTER TABLE comments ADD COLUMN hidden_at TIMESTAMPTZ;
+
+-- +goose Down
+ALTER TABLE comments DROP COLUMN hidden_at;
+ALTER TABLE users DROP COLUMN role;
@@ -0,0 +1,5 @@
+-- +goose Up
+ALTER TABLE comments RENAME COLUMN asnwer_to TO answer_to;
+
+-- +goose Down
+ALTER TABLE comments RENAME COLUMN answer_to TO asnwer_to;
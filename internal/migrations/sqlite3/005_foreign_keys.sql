@@ -0,0 +1,80 @@
+-- +goose Up
+CREATE TABLE posts_new (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	data TEXT NOT NULL,
+	author_id INTEGER NOT NULL REFERENCES users (id),
+	is_commentable INTEGER
+);
+-- posts of users and comments of posts or users that no longer exist can't satisfy
+-- the constraints. They are moved as they are to orphaned_posts and orphaned_comments
+-- for the operator to look into or drop, the down migration puts them back.
+INSERT INTO posts_new (id, data, author_id, is_commentable)
+SELECT id, data, CAST(json_extract(author, '$.id') AS INTEGER), is_commentable FROM posts
+WHERE CAST(json_extract(author, '$.id') AS INTEGER) IN (SELECT id FROM users);
+CREATE TABLE orphaned_posts AS SELECT * FROM posts WHERE id NOT IN (SELECT id FROM posts_new);
+DROP TABLE posts;
+ALTER TABLE posts_new RENAME TO posts;
+
+CREATE TABLE comments_new (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	post_id INTEGER NOT NULL REFERENCES posts (id),
+	author_id INTEGER NOT NULL REFERENCES users (id),
+	initial_comment INTEGER,
+	answer_to INTEGER,
+	data TEXT NOT NULL,
+	has_replies INTEGER
+);
+INSERT INTO comments_new (id, post_id, author_id, initial_comment, answer_to, data, has_replies)
+SELECT id, CAST(json_extract(post, '$.id') AS INTEGER), CAST(json_extract(author, '$.id') AS INTEGER),
+	initial_comment, answer_to, data, has_replies FROM comments
+WHERE CAST(json_extract(post, '$.id') AS INTEGER) IN (SELECT id FROM posts)
+	AND CAST(json_extract(author, '$.id') AS INTEGER) IN (SELECT id FROM users);
+CREATE TABLE orphaned_comments AS SELECT * FROM comments WHERE id NOT IN (SELECT id FROM comments_new);
+DROP TABLE comments;
+ALTER TABLE comments_new RENAME TO comments;
+
+-- +goose Down
+CREATE TABLE comments_old (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	post TEXT,
+	author TEXT,
+	initial_comment INTEGER,
+	answer_to INTEGER,
+	data TEXT NOT NULL,
+	has_replies INTEGER
+);
+INSERT INTO comments_old (id, post, author, initial_comment, answer_to, data, has_replies)
+SELECT comments.id,
+	json_object(
+		'id', CAST(posts.id AS TEXT),
+		'data', posts.data,
+		'commentable', json(CASE WHEN posts.is_commentable = 1 THEN 'true' ELSE 'false' END),
+		'author', json_object('id', CAST(post_authors.id AS TEXT), 'name', post_authors.name, 'about', post_authors.about)
+	),
+	json_object('id', CAST(users.id AS TEXT), 'name', users.name, 'about', users.about),
+	comments.initial_comment, comments.answer_to, comments.data, comments.has_replies
+FROM comments
+JOIN posts ON posts.id = comments.post_id
+JOIN users post_authors ON post_authors.id = posts.author_id
+JOIN users ON users.id = comments.author_id;
+DROP TABLE comments;
+ALTER TABLE comments_old RENAME TO comments;
+
+CREATE TABLE posts_old (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	data TEXT NOT NULL,
+	author TEXT,
+	is_commentable INTEGER
+);
+INSERT INTO posts_old (id, data, author, is_commentable)
+SELECT posts.id, posts.data, json_object('id', CAST(users.id AS TEXT), 'name', users.name, 'about', users.about), posts.is_commentable
+FROM posts JOIN users ON users.id = posts.author_id;
+DROP TABLE posts;
+ALTER TABLE posts_old RENAME TO posts;
+
+INSERT INTO posts (id, data, author, is_commentable)
+SELECT id, data, author, is_commentable FROM orphaned_posts;
+INSERT INTO comments (id, post, author, initial_comment, answer_to, data, has_replies)
+SELECT id, post, author, initial_comment, answer_to, data, has_replies FROM orphaned_comments;
+DROP TABLE orphaned_comments;
+DROP TABLE orphaned_posts;
@@ -0,0 +1,54 @@
+-- +goose Up
+-- path is the chain of zero padded ids from the thread root down to the comment, e.g.
+-- 0000000001/0000000005/, so ordering by it walks a thread depth-first and a subtree
+-- is a range of paths starting with the path of its root
+ALTER TABLE comments ADD COLUMN parent_id INTEGER REFERENCES comments (id);
+ALTER TABLE comments ADD COLUMN path TEXT NOT NULL DEFAULT '';
+ALTER TABLE comments ADD COLUMN depth INTEGER NOT NULL DEFAULT 0;
+
+UPDATE comments SET parent_id = answer_to WHERE answer_to IN (SELECT id FROM comments);
+WITH RECURSIVE tree (id, path, depth) AS (
+	SELECT id, printf('%010d/', id), 0 FROM comments WHERE parent_id IS NULL
+	UNION ALL
+	SELECT comments.id, tree.path || printf('%010d/', comments.id), tree.depth + 1
+	FROM comments JOIN tree ON comments.parent_id = tree.id
+)
+UPDATE comments SET path = tree.path, depth = tree.depth FROM tree WHERE tree.id = comments.id;
+
+ALTER TABLE comments DROP COLUMN answer_to;
+ALTER TABLE comments DROP COLUMN initial_comment;
+ALTER TABLE comments DROP COLUMN has_replies;
+
+CREATE UNIQUE INDEX comments_path_idx ON comments (path);
+CREATE INDEX comments_post_id_parent_id_idx ON comments (post_id, parent_id, id);
+CREATE INDEX comments_post_id_path_idx ON comments (post_id, path);
+CREATE INDEX comments_parent_id_idx ON comments (parent_id, id);
+
+-- ids of AUTOINCREMENT rows are only known after the insert, so the path is set right after it
+-- +goose StatementBegin
+CREATE TRIGGER comments_set_path AFTER INSERT ON comments
+BEGIN
+	UPDATE comments SET
+		path = COALESCE((SELECT parents.path FROM comments parents WHERE parents.id = NEW.parent_id), '') || printf('%010d/', NEW.id),
+		depth = COALESCE((SELECT parents.depth + 1 FROM comments parents WHERE parents.id = NEW.parent_id), 0)
+	WHERE id = NEW.id;
+END;
+-- +goose StatementEnd
+
+-- +goose Down
+DROP TRIGGER comments_set_path;
+DROP INDEX comments_path_idx;
+DROP INDEX comments_post_id_parent_id_idx;
+DROP INDEX comments_post_id_path_idx;
+DROP INDEX comments_parent_id_idx;
+
+ALTER TABLE comments ADD COLUMN initial_comment INTEGER;
+ALTER TABLE comments ADD COLUMN answer_to INTEGER;
+ALTER TABLE comments ADD COLUMN has_replies INTEGER;
+UPDATE comments SET
+	answer_to = COALESCE(parent_id, -1),
+	initial_comment = COALESCE((SELECT parents.parent_id FROM comments parents WHERE parents.id = comments.parent_id), -1),
+	has_replies = EXISTS (SELECT 1 FROM comments replies WHERE replies.parent_id = comments.id);
+ALTER TABLE comments DROP COLUMN path;
+ALTER TABLE comments DROP COLUMN depth;
+ALTER TABLE comments DROP COLUMN parent_id;
@@ -0,0 +1,8 @@
+-- +goose Up
+-- users created before registration existed have no password and can't log in
+ALTER TABLE users ADD COLUMN password_hash TEXT;
+CREATE UNIQUE INDEX users_name_idx ON users (name) WHERE password_hash IS NOT NULL;
+
+-- +goose Down
+DROP INDEX users_name_idx;
+ALTER TABLE users DROP COLUMN password_hash;
@@ -0,0 +1,22 @@
+-- +goose Up
+-- emails are stored lower-cased, tokens sent to them are single-use and only their hashes are kept
+ALTER TABLE users ADD COLUMN email TEXT;
+ALTER TABLE users ADD COLUMN email_verified_at TIMESTAMP;
+CREATE UNIQUE INDEX users_email_idx ON users (email);
+
+CREATE TABLE email_tokens (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	purpose TEXT NOT NULL,
+	token_hash TEXT NOT NULL UNIQUE,
+	expires_at TIMESTAMP NOT NULL,
+	used_at TIMESTAMP
+);
+
+CREATE INDEX email_tokens_user_id_idx ON email_tokens (user_id);
+
+-- +goose Down
+DROP TABLE email_tokens;
+DROP INDEX users_email_idx;
+ALTER TABLE users DROP COLUMN email_verified_at;
+ALTER TABLE users DROP COLUMN email;
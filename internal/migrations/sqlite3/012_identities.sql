@@ -0,0 +1,15 @@
+-- +goose Up
+-- identities link users to accounts of external OpenID Connect providers
+CREATE TABLE identities (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	issuer TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	UNIQUE (issuer, subject)
+);
+
+CREATE INDEX identities_user_id_idx ON identities (user_id);
+
+-- +goose Down
+DROP TABLE identities;
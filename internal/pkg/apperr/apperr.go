@@ -0,0 +1,68 @@
+// Package apperr holds the errors meant for clients. The code of an error goes to
+// extensions.code of the GraphQL error, so that clients don't have to match messages.
+package apperr
+
+import (
+	"errors"
+	"fmt"
+)
+
+type Code string
+
+const (
+	CodeNotFound        Code = "NOT_FOUND"
+	CodeUnauthenticated Code = "UNAUTHENTICATED"
+	CodeForbidden       Code = "FORBIDDEN"
+	CodeValidation      Code = "VALIDATION"
+	CodeInternal        Code = "INTERNAL"
+)
+
+type Error struct {
+	Code    Code
+	Message string
+	// Extensions are sent along with the code, e.g. the field that failed validation.
+	Extensions map[string]interface{}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func newf(code Code, format string, args ...any) error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// NotFound is for ids of rows that don't exist or are deleted.
+func NotFound(format string, args ...any) error {
+	return newf(CodeNotFound, format, args...)
+}
+
+// Unauthenticated is for requests made without credentials or with ones of nobody.
+func Unauthenticated(format string, args ...any) error {
+	return newf(CodeUnauthenticated, format, args...)
+}
+
+// Forbidden is for users who may not do what they ask for.
+func Forbidden(format string, args ...any) error {
+	return newf(CodeForbidden, format, args...)
+}
+
+// Invalid is for input that can't be accepted as it is.
+func Invalid(format string, args ...any) error {
+	return newf(CodeValidation, format, args...)
+}
+
+// Internal is for failures of the server, their causes are logged and not shown.
+func Internal(format string, args ...any) error {
+	return newf(CodeInternal, format, args...)
+}
+
+// ErrInternal is what clients get when the server fails.
+var ErrInternal = Internal("server error occurred")
+
+// As returns the Error err is or wraps.
+func As(err error) (*Error, bool) {
+	var e *Error
+	ok := errors.As(err, &e)
+	return e, ok
+}
@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"slices"
+	"strings"
+
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/apperr"
+)
+
+// Scope is what a request may do on behalf of its user. Requests made with user tokens
+// have every scope, requests made with API keys only the ones given to the key.
+type Scope string
+
+const (
+	ScopePostsWrite    Scope = "posts:write"
+	ScopeCommentsWrite Scope = "comments:write"
+	// ScopeAccount is never given to API keys, it guards changing the user
+	// and managing, or listing, their sessions and keys.
+	ScopeAccount Scope = "account"
+)
+
+// APIKeyScopes are the scopes an API key can be created with.
+var APIKeyScopes = []Scope{ScopePostsWrite, ScopeCommentsWrite}
+
+// APIKeyPrefix starts every API key, it tells them apart from access tokens
+// sent in the same Authorization header.
+const APIKeyPrefix = "ozk_"
+
+// ParseScopes checks that every scope can be given to an API key.
+func ParseScopes(scopes []string) ([]Scope, error) {
+	if len(scopes) == 0 {
+		return nil, apperr.Invalid("api key should have at least one scope")
+	}
+	parsed := make([]Scope, 0, len(scopes))
+	for _, scope := range scopes {
+		if !slices.Contains(APIKeyScopes, Scope(scope)) {
+			return nil, apperr.Invalid("unknown scope %q", scope)
+		}
+		if !slices.Contains(parsed, Scope(scope)) {
+			parsed = append(parsed, Scope(scope))
+		}
+	}
+	return parsed, nil
+}
+
+// randomSecret returns 32 random bytes encoded to be put into headers and links.
+func randomSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// hashSecret returns the hash random secrets are stored and looked up by. They are random
+// enough for a plain SHA-256 to be safe, unlike passwords.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewAPIKey returns a new random key and its hash, only the hash is stored.
+func NewAPIKey() (key string, hash string, err error) {
+	secret, err := randomSecret()
+	if err != nil {
+		return "", "", err
+	}
+	key = APIKeyPrefix + secret
+	return key, HashAPIKey(key), nil
+}
+
+func HashAPIKey(key string) string {
+	return hashSecret(key)
+}
+
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
@@ -2,21 +2,90 @@ package auth
 
 import (
 	"context"
-	"errors"
+	"slices"
 
-	"github.com/99designs/gqlgen/graphql"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/apperr"
 	"github.com/idkwhyureadthis/ozon-task/internal/pkg/isnumber"
 )
 
-func IsAuthorized(ctx context.Context) (string, error) {
-	userId := ctx.Value("user")
-	if userId == nil {
-		graphql.AddErrorf(ctx, "not authorized")
-		return " ", errors.New("user not authorized")
+// Principal is who a request is made by, put into the context by mw.AuthMiddleware
+// once the access token is verified.
+type Principal struct {
+	UserID    string
+	SessionID string
+	// APIKeyID and Scopes are set for requests made with an API key instead of a user token.
+	APIKeyID string
+	Scopes   []Scope
+}
+
+// Allows reports whether the principal has scope.
+func (p Principal) Allows(scope Scope) bool {
+	if p.APIKeyID == "" {
+		return true
 	}
-	if !isnumber.IsNumber(userId.(string)) {
-		graphql.AddErrorf(ctx, "wrong user id")
-		return " ", errors.New("wrong user id provided in context")
+	return slices.Contains(p.Scopes, scope)
+}
+
+// Client describes where a request came from, it is recorded as the last seen
+// address and user agent of a session.
+type Client struct {
+	IP        string
+	UserAgent string
+}
+
+type (
+	principalKey struct{}
+	clientKey    struct{}
+)
+
+func WithPrincipal(ctx context.Context, principal Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFrom returns the principal of an authenticated request.
+func PrincipalFrom(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(Principal)
+	return principal, ok
+}
+
+func WithClient(ctx context.Context, client Client) context.Context {
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+// ClientFrom returns the client put into the context by mw.AuthMiddleware,
+// an empty one if there is none.
+func ClientFrom(ctx context.Context) Client {
+	client, _ := ctx.Value(clientKey{}).(Client)
+	return client
+}
+
+var ErrNotAuthorized = apperr.Unauthenticated("not authorized")
+
+// Authorize checks that the request is made on behalf of a user and may do what scope
+// stands for, an empty scope is allowed to everyone. The error it returns otherwise
+// is meant to be shown to the client.
+func Authorize(ctx context.Context, scope Scope) (Principal, error) {
+	principal, ok := PrincipalFrom(ctx)
+	if !ok {
+		return Principal{}, ErrNotAuthorized
+	}
+	if !isnumber.IsNumber(principal.UserID) {
+		return Principal{}, apperr.Unauthenticated("wrong user id")
+	}
+	if scope != "" && !principal.Allows(scope) {
+		if scope == ScopeAccount {
+			return Principal{}, apperr.Forbidden("api keys can't manage the account")
+		}
+		return Principal{}, apperr.Forbidden("api key doesn't have %s scope", scope)
 	}
-	return ctx.Value("user").(string), nil
+	return principal, nil
+}
+
+// Identity is a user of an external OpenID Connect provider as its ID token describes them.
+type Identity struct {
+	Issuer        string
+	Subject       string
+	Name          string
+	Email         string
+	EmailVerified bool
 }
@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokens(t *testing.T) {
+	now := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	tokens := NewTokens([]byte("secret"))
+	tokens.Clock = func() time.Time { return now }
+
+	pair, err := tokens.Issue(Principal{UserID: "7", SessionID: "3"})
+	require.NoError(t, err)
+
+	t.Run("tokens are verified by their type", func(t *testing.T) {
+		principal, err := tokens.Verify(pair.AccessToken)
+		require.NoError(t, err)
+		require.Equal(t, Principal{UserID: "7", SessionID: "3"}, principal)
+		principal, err = tokens.VerifyRefresh(pair.RefreshToken)
+		require.NoError(t, err)
+		require.Equal(t, "7", principal.UserID)
+
+		_, err = tokens.Verify(pair.RefreshToken)
+		require.ErrorIs(t, err, ErrInvalidToken)
+		_, err = tokens.VerifyRefresh(pair.AccessToken)
+		require.ErrorIs(t, err, ErrInvalidToken)
+	})
+
+	t.Run("tokens without session are rejected", func(t *testing.T) {
+		pair, err := tokens.Issue(Principal{UserID: "7"})
+		require.NoError(t, err)
+		_, err = tokens.Verify(pair.AccessToken)
+		require.ErrorIs(t, err, ErrInvalidToken)
+	})
+
+	t.Run("tokens signed with other secret are rejected", func(t *testing.T) {
+		other := NewTokens([]byte("other secret"))
+		other.Clock = tokens.Clock
+		_, err := other.Verify(pair.AccessToken)
+		require.ErrorIs(t, err, ErrInvalidToken)
+	})
+
+	t.Run("expired tokens are rejected", func(t *testing.T) {
+		later := NewTokens([]byte("secret"))
+		later.Clock = func() time.Time { return now.Add(DefaultAccessTTL + time.Second) }
+		_, err := later.Verify(pair.AccessToken)
+		require.ErrorIs(t, err, ErrInvalidToken)
+		_, err = later.VerifyRefresh(pair.RefreshToken)
+		require.NoError(t, err)
+	})
+}
+
+func TestPassword(t *testing.T) {
+	_, err := HashPassword("short")
+	require.Error(t, err)
+	_, err = HashPassword(strings.Repeat("пароль", 7))
+	require.EqualError(t, err, "password should be at most 72 bytes long")
+	_, err = HashPassword(strings.Repeat("p", 72))
+	require.NoError(t, err)
+
+	hash, err := HashPassword("correct horse")
+	require.NoError(t, err)
+	require.NoError(t, CheckPassword(hash, "correct horse"))
+	require.ErrorIs(t, CheckPassword(hash, "wrong horse"), ErrWrongPassword)
+	require.ErrorIs(t, CheckMissingPassword("correct horse"), ErrWrongPassword)
+	require.ErrorIs(t, CheckMissingPassword("no such user"), ErrWrongPassword)
+}
+
+func TestAPIKeys(t *testing.T) {
+	key, hash, err := NewAPIKey()
+	require.NoError(t, err)
+	require.True(t, IsAPIKey(key))
+	require.Equal(t, hash, HashAPIKey(key))
+	other, _, err := NewAPIKey()
+	require.NoError(t, err)
+	require.NotEqual(t, key, other)
+
+	scopes, err := ParseScopes([]string{"posts:write", "posts:write"})
+	require.NoError(t, err)
+	require.Equal(t, []Scope{ScopePostsWrite}, scopes)
+	_, err = ParseScopes([]string{"account"})
+	require.EqualError(t, err, `unknown scope "account"`)
+	_, err = ParseScopes([]string{"read"})
+	require.EqualError(t, err, `unknown scope "read"`)
+	_, err = ParseScopes(nil)
+	require.Error(t, err)
+
+	bot := Principal{UserID: "1", APIKeyID: "1", Scopes: scopes}
+	require.True(t, bot.Allows(ScopePostsWrite))
+	require.False(t, bot.Allows(ScopeCommentsWrite))
+	require.False(t, bot.Allows(ScopeAccount))
+	require.True(t, Principal{UserID: "1", SessionID: "1"}.Allows(ScopeAccount))
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	email, err := NormalizeEmail("SrGold78@Example.com")
+	require.NoError(t, err)
+	require.Equal(t, "srgold78@example.com", email)
+	for _, wrong := range []string{"", "srgold78", "Sergey <srgold78@example.com>", "srgold78@example.com\r\nBcc: all@example.com"} {
+		_, err := NormalizeEmail(wrong)
+		require.ErrorIs(t, err, ErrWrongEmail, wrong)
+	}
+}
@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/apperr"
+)
+
+// TokenPurpose tells what a token sent by e-mail is good for, a token can't be used for another purpose.
+type TokenPurpose string
+
+const (
+	PurposePasswordReset TokenPurpose = "password_reset"
+	PurposeVerifyEmail   TokenPurpose = "verify_email"
+
+	PasswordResetTTL = time.Hour
+	VerifyEmailTTL   = 24 * time.Hour
+)
+
+var (
+	ErrWrongEmail        = apperr.Invalid("wrong email provided")
+	ErrInvalidEmailToken = apperr.Invalid("invalid or expired token")
+)
+
+// NormalizeEmail checks that email is a bare address and lower-cases it,
+// which is how addresses are stored and compared.
+func NormalizeEmail(email string) (string, error) {
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != strings.TrimSpace(email) {
+		return "", ErrWrongEmail
+	}
+	return strings.ToLower(address.Address), nil
+}
+
+// NewEmailToken returns a new single-use token to be sent by e-mail and its hash, only the hash is stored.
+func NewEmailToken() (token string, hash string, err error) {
+	token, err = randomSecret()
+	if err != nil {
+		return "", "", err
+	}
+	return token, HashEmailToken(token), nil
+}
+
+func HashEmailToken(token string) string {
+	return hashSecret(token)
+}
@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"sync"
+	"unicode/utf8"
+
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/apperr"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	minPasswordLength = 8
+	// maxPasswordBytes is as much as bcrypt hashes, it refuses longer passwords.
+	maxPasswordBytes = 72
+)
+
+var ErrWrongPassword = apperr.Unauthenticated("wrong name or password")
+
+// dummyHash is what passwords of users that don't exist are checked against.
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("no such user"), bcrypt.DefaultCost)
+	return hash
+})
+
+// HashPassword returns the bcrypt hash stored in users.password_hash.
+func HashPassword(password string) (string, error) {
+	if utf8.RuneCountInString(password) < minPasswordLength {
+		return "", apperr.Invalid("password should be at least %d characters long", minPasswordLength)
+	}
+	if len(password) > maxPasswordBytes {
+		return "", apperr.Invalid("password should be at most %d bytes long", maxPasswordBytes)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+func CheckPassword(hash string, password string) error {
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return ErrWrongPassword
+	}
+	return nil
+}
+
+// CheckMissingPassword fails like CheckPassword does for a user without a password or that
+// doesn't exist. It takes as long as checking a real one, so that the time a login takes
+// doesn't tell which names are taken.
+func CheckMissingPassword(password string) error {
+	bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+	return ErrWrongPassword
+}
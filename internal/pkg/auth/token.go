@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/apperr"
+)
+
+const (
+	DefaultAccessTTL  = 15 * time.Minute
+	DefaultRefreshTTL = 30 * 24 * time.Hour
+
+	accessToken  = "access"
+	refreshToken = "refresh"
+)
+
+var (
+	ErrInvalidToken   = apperr.Unauthenticated("invalid token")
+	ErrSessionExpired = apperr.Unauthenticated("session is revoked or expired")
+)
+
+// Tokens issues and verifies HMAC signed JWTs. Access tokens authenticate requests,
+// refresh tokens live longer and are only good for getting a new pair of tokens.
+type Tokens struct {
+	Secret     []byte
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+	Clock      func() time.Time
+}
+
+type Pair struct {
+	AccessToken  string
+	RefreshToken string
+}
+
+type claims struct {
+	jwt.RegisteredClaims
+	Type      string `json:"typ"`
+	SessionID string `json:"sid"`
+}
+
+func NewTokens(secret []byte) *Tokens {
+	return &Tokens{
+		Secret:     secret,
+		AccessTTL:  DefaultAccessTTL,
+		RefreshTTL: DefaultRefreshTTL,
+		Clock:      time.Now,
+	}
+}
+
+func (t *Tokens) sign(principal Principal, tokenType string, ttl time.Duration) (string, error) {
+	now := t.Clock()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   principal.UserID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
+		Type:      tokenType,
+		SessionID: principal.SessionID,
+	})
+	return token.SignedString(t.Secret)
+}
+
+func (t *Tokens) verify(token string, tokenType string) (Principal, error) {
+	var parsed claims
+	_, err := jwt.ParseWithClaims(token, &parsed, func(*jwt.Token) (any, error) {
+		return t.Secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithTimeFunc(t.Clock), jwt.WithExpirationRequired())
+	if err != nil || parsed.Type != tokenType || parsed.Subject == "" || parsed.SessionID == "" {
+		return Principal{}, ErrInvalidToken
+	}
+	return Principal{UserID: parsed.Subject, SessionID: parsed.SessionID}, nil
+}
+
+// Issue returns a new pair of tokens for principal, both bound to its session.
+func (t *Tokens) Issue(principal Principal) (Pair, error) {
+	access, err := t.sign(principal, accessToken, t.AccessTTL)
+	if err != nil {
+		return Pair{}, err
+	}
+	refresh, err := t.sign(principal, refreshToken, t.RefreshTTL)
+	if err != nil {
+		return Pair{}, err
+	}
+	return Pair{AccessToken: access, RefreshToken: refresh}, nil
+}
+
+// Verify checks an access token and returns whom it was issued to.
+func (t *Tokens) Verify(token string) (Principal, error) {
+	return t.verify(token, accessToken)
+}
+
+// VerifyRefresh checks a refresh token and returns whom it was issued to.
+func (t *Tokens) VerifyRefresh(token string) (Principal, error) {
+	return t.verify(token, refreshToken)
+}
@@ -0,0 +1,337 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is every setting of the program. Load starts from Default, then applies a YAML or TOML
+// file, environment variables and flags, each overriding what came before.
+type Config struct {
+	Port int `yaml:"port" toml:"port"`
+	// TrustedProxies are addresses and networks whose X-Forwarded-For and X-Real-IP are believed.
+	TrustedProxies []string `yaml:"trusted_proxies" toml:"trusted_proxies"`
+	Storage        string   `yaml:"storage" toml:"storage"`
+	// Migrations is the mode database.Migrate runs in when the storage is opened.
+	Migrations string `yaml:"migrations" toml:"migrations"`
+	// AuthSecret signs tokens, serve makes up one if it is empty.
+	AuthSecret string `yaml:"auth_secret" toml:"auth_secret"`
+	// SubscriptionTimeout closes subscriptions that live longer than it, zero means never.
+	SubscriptionTimeout time.Duration `yaml:"subscription_timeout" toml:"subscription_timeout"`
+	Limits              Limits        `yaml:"limits" toml:"limits"`
+	Timeouts            Timeouts      `yaml:"timeouts" toml:"timeouts"`
+	// Dev is for development on one's own machine: e-mails SMTP isn't set to send are
+	// logged with their bodies, tokens included.
+	Dev bool `yaml:"dev" toml:"dev"`
+	// SMTP is used to send e-mails if its Addr is set.
+	SMTP SMTP `yaml:"smtp" toml:"smtp"`
+	// OIDC enables login with an OpenID Connect provider if its Issuer is set.
+	OIDC OIDC `yaml:"oidc" toml:"oidc"`
+}
+
+// MaxPageSize is the most rows a connection returns, whatever first, last or PageSize ask for.
+const MaxPageSize = 100
+
+type Limits struct {
+	// PageSize is how many rows a connection returns when neither first nor last is given.
+	PageSize int `yaml:"page_size" toml:"page_size"`
+	// NameLength, AboutLength and CommentLength replace max of the @length directives naming them.
+	NameLength    int `yaml:"max_name_length" toml:"max_name_length"`
+	AboutLength   int `yaml:"max_about_length" toml:"max_about_length"`
+	CommentLength int `yaml:"max_comment_length" toml:"max_comment_length"`
+}
+
+// Length returns the limit a @length directive names, e.g. "comment" or "name".
+func (l Limits) Length(limit string) (int, bool) {
+	switch limit {
+	case "name":
+		return l.NameLength, true
+	case "about":
+		return l.AboutLength, true
+	case "comment":
+		return l.CommentLength, true
+	}
+	return 0, false
+}
+
+// WithDefaults returns l with the limits that aren't positive taken from Default, so that
+// Limits{} of a storage or resolver made without a Config behaves like the default one.
+func (l Limits) WithDefaults() Limits {
+	defaults := Default().Limits
+	for _, limit := range []struct{ value, fallback *int }{
+		{&l.PageSize, &defaults.PageSize},
+		{&l.NameLength, &defaults.NameLength},
+		{&l.AboutLength, &defaults.AboutLength},
+		{&l.CommentLength, &defaults.CommentLength},
+	} {
+		if *limit.value <= 0 {
+			*limit.value = *limit.fallback
+		}
+	}
+	return l
+}
+
+type Timeouts struct {
+	// Query bounds queries of a single row, LongQuery those reading pages and trees or changing many rows.
+	Query     time.Duration `yaml:"query" toml:"query"`
+	LongQuery time.Duration `yaml:"long_query" toml:"long_query"`
+}
+
+// WithDefaults returns t with the timeouts that aren't positive taken from Default,
+// a zero one would fail every query.
+func (t Timeouts) WithDefaults() Timeouts {
+	defaults := Default().Timeouts
+	if t.Query <= 0 {
+		t.Query = defaults.Query
+	}
+	if t.LongQuery <= 0 {
+		t.LongQuery = defaults.LongQuery
+	}
+	return t
+}
+
+type SMTP struct {
+	Addr     string `yaml:"addr" toml:"addr"`
+	From     string `yaml:"from" toml:"from"`
+	Username string `yaml:"username" toml:"username"`
+	Password string `yaml:"password" toml:"password"`
+}
+
+type OIDC struct {
+	Issuer       string `yaml:"issuer" toml:"issuer"`
+	ClientID     string `yaml:"client_id" toml:"client_id"`
+	ClientSecret string `yaml:"client_secret" toml:"client_secret"`
+	RedirectURL  string `yaml:"redirect_url" toml:"redirect_url"`
+}
+
+func Default() *Config {
+	return &Config{
+		Port:       8080,
+		Migrations: "up",
+		Limits: Limits{
+			PageSize:      20,
+			NameLength:    32,
+			AboutLength:   200,
+			CommentLength: 2000,
+		},
+		Timeouts: Timeouts{
+			Query:     5 * time.Second,
+			LongQuery: 30 * time.Second,
+		},
+	}
+}
+
+// list is a flag of comma separated values, setting it replaces the values it had.
+type list []string
+
+func (l *list) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *list) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// prefix parses an address or a network in CIDR notation, an address is a network of its own.
+func prefix(value string) (netip.Prefix, error) {
+	if addr, err := netip.ParseAddr(value); err == nil {
+		return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+	}
+	parsed, err := netip.ParsePrefix(value)
+	return parsed.Masked(), err
+}
+
+// TrustedPrefixes returns TrustedProxies parsed, Validate has checked them.
+func (c *Config) TrustedPrefixes() []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0, len(c.TrustedProxies))
+	for _, proxy := range c.TrustedProxies {
+		if parsed, err := prefix(proxy); err == nil {
+			prefixes = append(prefixes, parsed)
+		}
+	}
+	return prefixes
+}
+
+// envName is the variable setting the same as the flag called name, e.g. MAX_NAME_LENGTH for max-name-length.
+func envName(name string) string {
+	return strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// flags binds a flag to every setting of c, the environment variables are named after them.
+func (c *Config) flags(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.IntVar(&c.Port, "port", c.Port, "port to serve on")
+	flags.Var((*list)(&c.TrustedProxies), "trusted-proxies", "comma separated addresses and networks of proxies telling the address of clients")
+	flags.StringVar(&c.Storage, "storage", c.Storage, `"memory", a postgresql:// URL or a SQLite file name`)
+	flags.StringVar(&c.Migrations, "migrations", c.Migrations, "up, down, reset (drops all data), none, status or to:<version>")
+	flags.StringVar(&c.AuthSecret, "auth-secret", c.AuthSecret, "secret signing tokens")
+	flags.DurationVar(&c.SubscriptionTimeout, "subscription-timeout", c.SubscriptionTimeout, "how long subscriptions live, 0 for ever")
+	flags.IntVar(&c.Limits.PageSize, "page-size", c.Limits.PageSize, "rows in a page when first and last aren't given, at most 100")
+	flags.IntVar(&c.Limits.NameLength, "max-name-length", c.Limits.NameLength, "longest user name")
+	flags.IntVar(&c.Limits.AboutLength, "max-about-length", c.Limits.AboutLength, "longest about of a user")
+	flags.IntVar(&c.Limits.CommentLength, "max-comment-length", c.Limits.CommentLength, "longest comment")
+	flags.DurationVar(&c.Timeouts.Query, "query-timeout", c.Timeouts.Query, "timeout of queries of a single row")
+	flags.DurationVar(&c.Timeouts.LongQuery, "long-query-timeout", c.Timeouts.LongQuery, "timeout of queries of pages, trees and many rows")
+	flags.BoolVar(&c.Dev, "dev", c.Dev, "log e-mails with their tokens when smtp-addr is empty, never in production")
+	flags.StringVar(&c.SMTP.Addr, "smtp-addr", c.SMTP.Addr, "host:port of the SMTP server, e-mails are only logged if empty")
+	flags.StringVar(&c.SMTP.From, "smtp-from", c.SMTP.From, "sender of e-mails")
+	flags.StringVar(&c.SMTP.Username, "smtp-username", c.SMTP.Username, "SMTP user")
+	flags.StringVar(&c.SMTP.Password, "smtp-password", c.SMTP.Password, "SMTP password")
+	flags.StringVar(&c.OIDC.Issuer, "oidc-issuer", c.OIDC.Issuer, "OpenID Connect provider, login with it is off if empty")
+	flags.StringVar(&c.OIDC.ClientID, "oidc-client-id", c.OIDC.ClientID, "client id registered with the provider")
+	flags.StringVar(&c.OIDC.ClientSecret, "oidc-client-secret", c.OIDC.ClientSecret, "client secret registered with the provider")
+	flags.StringVar(&c.OIDC.RedirectURL, "oidc-redirect-url", c.OIDC.RedirectURL, "URL of /auth/oidc/callback the provider sends users back to")
+	flags.VisitAll(func(f *flag.Flag) {
+		f.Usage += " (" + envName(f.Name) + ")"
+	})
+	return flags
+}
+
+const fileUsage = "YAML or TOML file with the settings (CONFIG)"
+
+// Usage prints the flags Load accepts with their defaults and variables.
+func Usage(w io.Writer) {
+	flags := Default().flags("")
+	flags.String("config", "", fileUsage)
+	flags.SetOutput(w)
+	flags.PrintDefaults()
+}
+
+// Load reads the settings from the file named by -config or CONFIG, the environment, which
+// .env of the working directory adds to, and flags at the start of args, then validates them.
+// What follows the flags in args is returned.
+func Load(args []string) (*Config, []string, error) {
+	// .env doesn't override variables that are already set
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, fmt.Errorf("failed to read .env: %w", err)
+	}
+	// flags are parsed first for the file and applied last over the rest
+	flags := Default().flags("ozon-task")
+	file := flags.String("config", os.Getenv("CONFIG"), fileUsage)
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	cfg := Default()
+	if *file != "" {
+		if err := cfg.readFile(*file); err != nil {
+			return nil, nil, fmt.Errorf("failed to read %s: %w", *file, err)
+		}
+	}
+	settings := cfg.flags("")
+	var errs []error
+	settings.VisitAll(func(f *flag.Flag) {
+		env := envName(f.Name)
+		if value := os.Getenv(env); value != "" {
+			if err := settings.Set(f.Name, value); err != nil {
+				errs = append(errs, fmt.Errorf("wrong %s provided: %q", env, value))
+			}
+		}
+	})
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name != "config" {
+			settings.Set(f.Name, f.Value.String())
+		}
+	})
+	if err := errors.Join(errs...); err != nil {
+		return nil, nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return cfg, flags.Args(), nil
+}
+
+// readFile applies the settings of a YAML or TOML file told apart by its extension,
+// settings it doesn't have keep their values and ones c doesn't know are an error.
+func (c *Config) readFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(content))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(c); err != nil && err != io.EOF {
+			return err
+		}
+	case ".toml":
+		meta, err := toml.Decode(string(content), c)
+		if err != nil {
+			return err
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("unknown setting %s", undecoded[0])
+		}
+	default:
+		return errors.New("expected a .yaml, .yml or .toml file")
+	}
+	return nil
+}
+
+// Validate reports every setting out of its range, named by its flag.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	check(c.Port > 0 && c.Port < 1<<16, "port should be from 1 to 65535, got %d", c.Port)
+	for _, proxy := range c.TrustedProxies {
+		_, err := prefix(proxy)
+		check(err == nil, "trusted-proxies should be addresses or networks, got %q", proxy)
+	}
+	_, err := ParseMigrationMode(c.Migrations)
+	check(err == nil, "%v", err)
+	check(c.SubscriptionTimeout >= 0, "subscription-timeout can't be negative")
+	for _, limit := range []struct {
+		name  string
+		value int
+	}{
+		{"page-size", c.Limits.PageSize},
+		{"max-name-length", c.Limits.NameLength},
+		{"max-about-length", c.Limits.AboutLength},
+		{"max-comment-length", c.Limits.CommentLength},
+	} {
+		check(limit.value > 0, "%s should be at least 1, got %d", limit.name, limit.value)
+	}
+	check(c.Limits.PageSize <= MaxPageSize, "page-size should be at most %d, got %d", MaxPageSize, c.Limits.PageSize)
+	check(c.Timeouts.Query > 0, "query-timeout should be positive")
+	check(c.Timeouts.LongQuery > 0, "long-query-timeout should be positive")
+	if c.SMTP.Addr != "" {
+		_, _, err := net.SplitHostPort(c.SMTP.Addr)
+		check(err == nil, "smtp-addr should be host:port, got %q", c.SMTP.Addr)
+		check(c.SMTP.From != "", "smtp-from is needed to send e-mails")
+	}
+	if c.OIDC.Issuer != "" {
+		check(c.OIDC.ClientID != "", "oidc-client-id is needed to log in with %s", c.OIDC.Issuer)
+		check(c.OIDC.RedirectURL != "", "oidc-redirect-url is needed to log in with %s", c.OIDC.Issuer)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,128 @@
+package config
+
+import (
+	"flag"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// clearEnv unsets the variables Load reads for the duration of the test.
+func clearEnv(t *testing.T) {
+	t.Setenv("CONFIG", "")
+	Default().flags("").VisitAll(func(f *flag.Flag) {
+		t.Setenv(envName(f.Name), "")
+	})
+}
+
+func writeFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	clearEnv(t)
+	cfg, args, err := Load(nil)
+	require.NoError(t, err)
+	require.Equal(t, Default(), cfg)
+	require.Empty(t, args)
+	length, ok := cfg.Limits.Length("comment")
+	require.True(t, ok)
+	require.Equal(t, 2000, length)
+}
+
+func TestLoadLayers(t *testing.T) {
+	for _, file := range []struct{ name, content string }{
+		{"config.yaml", `
+port: 9000
+trusted_proxies: [127.0.0.1]
+storage: test.db
+limits:
+  page_size: 30
+  max_name_length: 40
+timeouts:
+  query: 2s
+`},
+		{"config.toml", `
+port = 9000
+trusted_proxies = ["127.0.0.1"]
+storage = "test.db"
+
+[limits]
+page_size = 30
+max_name_length = 40
+
+[timeouts]
+query = "2s"
+`},
+	} {
+		t.Run(file.name, func(t *testing.T) {
+			clearEnv(t)
+			t.Setenv("CONFIG", writeFile(t, file.name, file.content))
+			t.Setenv("PAGE_SIZE", "40")
+			t.Setenv("STORAGE", "memory")
+			t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, ::1")
+			t.Setenv("DEV", "true")
+			cfg, args, err := Load([]string{"-page-size", "50", "seed", "-users", "3"})
+			require.NoError(t, err)
+			require.Equal(t, []string{"seed", "-users", "3"}, args)
+			require.Equal(t, 9000, cfg.Port)
+			require.Equal(t, []string{"10.0.0.0/8", "::1"}, cfg.TrustedProxies)
+			require.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("::1/128")}, cfg.TrustedPrefixes())
+			require.Equal(t, "memory", cfg.Storage)
+			require.True(t, cfg.Dev)
+			require.Equal(t, 50, cfg.Limits.PageSize)
+			require.Equal(t, 40, cfg.Limits.NameLength)
+			require.Equal(t, 200, cfg.Limits.AboutLength)
+			require.Equal(t, 2*time.Second, cfg.Timeouts.Query)
+			require.Equal(t, 30*time.Second, cfg.Timeouts.LongQuery)
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	clearEnv(t)
+	_, _, err := Load([]string{"-config", writeFile(t, "config.yaml", "limits:\n  page: 10\n")})
+	require.ErrorContains(t, err, "field page not found")
+	_, _, err = Load([]string{"-config", writeFile(t, "config.toml", "[limits]\npage = 10\n")})
+	require.ErrorContains(t, err, "unknown setting limits.page")
+	_, _, err = Load([]string{"-config", writeFile(t, "config.json", "{}")})
+	require.ErrorContains(t, err, "expected a .yaml, .yml or .toml file")
+
+	t.Setenv("QUERY_TIMEOUT", "soon")
+	_, _, err = Load(nil)
+	require.EqualError(t, err, `wrong QUERY_TIMEOUT provided: "soon"`)
+	t.Setenv("QUERY_TIMEOUT", "")
+
+	_, _, err = Load([]string{"-trusted-proxies", "10.0.0.0/8,proxy"})
+	require.EqualError(t, err, `trusted-proxies should be addresses or networks, got "proxy"`)
+	_, _, err = Load([]string{"-page-size", "0", "-smtp-addr", "localhost", "-oidc-issuer", "https://accounts.example.com"})
+	require.EqualError(t, err, "page-size should be at least 1, got 0\n"+
+		`smtp-addr should be host:port, got "localhost"`+"\n"+
+		"smtp-from is needed to send e-mails\n"+
+		"oidc-client-id is needed to log in with https://accounts.example.com\n"+
+		"oidc-redirect-url is needed to log in with https://accounts.example.com")
+	_, _, err = Load([]string{"-page-size", "101", "-migrations", "sideways"})
+	require.EqualError(t, err, `unknown migrations mode "sideways", expected up, down, reset, none, status or to:<version>`+"\n"+
+		"page-size should be at most 100, got 101")
+	_, _, err = Load([]string{"-migrations", "to:latest"})
+	require.EqualError(t, err, `wrong version in migrations mode "to:latest"`)
+	_, _, err = Load([]string{"-h"})
+	require.ErrorIs(t, err, flag.ErrHelp)
+}
+
+func TestWithDefaults(t *testing.T) {
+	defaults := Default()
+	require.Equal(t, defaults.Limits, Limits{}.WithDefaults())
+	require.Equal(t, defaults.Timeouts, Timeouts{}.WithDefaults())
+	limits := Limits{PageSize: 5, CommentLength: -1}.WithDefaults()
+	require.Equal(t, 5, limits.PageSize)
+	require.Equal(t, defaults.Limits.NameLength, limits.NameLength)
+	require.Equal(t, defaults.Limits.CommentLength, limits.CommentLength)
+	require.Equal(t, time.Second, Timeouts{Query: time.Second}.WithDefaults().Query)
+}
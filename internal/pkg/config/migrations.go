@@ -0,0 +1,42 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Modes of Migrations, "to:<version>" is the remaining one.
+const (
+	MigrateUp     = "up"
+	MigrateDown   = "down"
+	MigrateReset  = "reset"
+	MigrateNone   = "none"
+	MigrateStatus = "status"
+	MigrateTo     = "to:"
+)
+
+type MigrationMode struct {
+	Name string
+	// Version is what "to:<version>" migrates to.
+	Version int64
+}
+
+// ParseMigrationMode checks mode, the empty one means up. Modes are case-insensitive.
+func ParseMigrationMode(mode string) (MigrationMode, error) {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	switch mode {
+	case "":
+		return MigrationMode{Name: MigrateUp}, nil
+	case MigrateUp, MigrateDown, MigrateReset, MigrateNone, MigrateStatus:
+		return MigrationMode{Name: mode}, nil
+	}
+	if version, ok := strings.CutPrefix(mode, MigrateTo); ok {
+		parsed, err := strconv.ParseInt(version, 10, 64)
+		if err != nil || parsed < 0 {
+			return MigrationMode{}, fmt.Errorf("wrong version in migrations mode %q", mode)
+		}
+		return MigrationMode{Name: MigrateTo, Version: parsed}, nil
+	}
+	return MigrationMode{}, fmt.Errorf("unknown migrations mode %q, expected up, down, reset, none, status or to:<version>", mode)
+}
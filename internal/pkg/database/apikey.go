@@ -0,0 +1,160 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/idkwhyureadthis/ozon-task/graph/model"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/apperr"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/auth"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/isnumber"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/policy"
+)
+
+const apiKeyColumns = "id, name, scopes, created_at, last_used_at"
+
+func joinScopes(scopes []auth.Scope) string {
+	joined := make([]string, len(scopes))
+	for i, scope := range scopes {
+		joined[i] = string(scope)
+	}
+	return strings.Join(joined, " ")
+}
+
+func splitScopes(scopes string) []auth.Scope {
+	var split []auth.Scope
+	for _, scope := range strings.Fields(scopes) {
+		split = append(split, auth.Scope(scope))
+	}
+	return split
+}
+
+func toAPIKey(id string, name string, scopes string, createdAt time.Time, lastUsedAt sql.NullTime) *model.APIKey {
+	key := &model.APIKey{
+		ID:        id,
+		Name:      name,
+		Scopes:    strings.Fields(scopes),
+		CreatedAt: createdAt.UTC().Format(time.RFC3339),
+	}
+	if lastUsedAt.Valid {
+		used := lastUsedAt.Time.UTC().Format(time.RFC3339)
+		key.LastUsedAt = &used
+	}
+	return key
+}
+
+func scanAPIKey(row scanner) (*model.APIKey, error) {
+	var (
+		id, name, scopes string
+		createdAt        time.Time
+		lastUsedAt       sql.NullTime
+	)
+	if err := row.Scan(&id, &name, &scopes, &createdAt, &lastUsedAt); err != nil {
+		return nil, err
+	}
+	return toAPIKey(id, name, scopes, createdAt, lastUsedAt), nil
+}
+
+func (db *DB) CreateAPIKey(ctx context.Context, name string, scopes []auth.Scope, keyHash string) (*model.APIKey, error) {
+	user, err := db.authorizedUser(ctx, auth.ScopeAccount)
+	if err != nil {
+		return nil, err
+	}
+	rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().Query)
+	defer cancel()
+	createdAt := timestamp(time.Now())
+	lastInsertId, err := db.insert(rqCtx, "INSERT INTO api_keys (user_id, name, key_hash, scopes, created_at) VALUES (?, ?, ?, ?, ?)",
+		user.ID, name, keyHash, joinScopes(scopes), createdAt)
+	if err != nil {
+		log.Println("failed to create api key:", err)
+		return nil, apperr.ErrInternal
+	}
+	return toAPIKey(fmt.Sprint(lastInsertId), name, joinScopes(scopes), createdAt, sql.NullTime{}), nil
+}
+
+func (db *DB) TouchAPIKey(ctx context.Context, keyHash string) (auth.Principal, error) {
+	rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().Query)
+	defer cancel()
+	var id, userId, scopes string
+	err := db.queryRow(rqCtx, "SELECT id, user_id, scopes FROM api_keys WHERE key_hash = ? AND revoked_at IS NULL", keyHash).Scan(&id, &userId, &scopes)
+	if err == sql.ErrNoRows {
+		return auth.Principal{}, auth.ErrInvalidToken
+	}
+	if err != nil {
+		return auth.Principal{}, err
+	}
+	if _, err := db.exec(rqCtx, "UPDATE api_keys SET last_used_at = ? WHERE id = ?", timestamp(time.Now()), isnumber.TryConvertToInt(id)); err != nil {
+		return auth.Principal{}, err
+	}
+	return auth.Principal{UserID: userId, APIKeyID: id, Scopes: splitScopes(scopes)}, nil
+}
+
+func (db *DB) GetAPIKeys(ctx context.Context) ([]*model.APIKey, error) {
+	user, err := db.authorizedUser(ctx, auth.ScopeAccount)
+	if err != nil {
+		return nil, err
+	}
+	rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().Query)
+	defer cancel()
+	rows, err := db.query(rqCtx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE user_id = ? AND revoked_at IS NULL ORDER BY id", user.ID)
+	if err != nil {
+		log.Println("failed to get api keys:", err)
+		return nil, apperr.ErrInternal
+	}
+	defer rows.Close()
+	keys := []*model.APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			log.Println("failed to scan api key:", err)
+			return nil, apperr.ErrInternal
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("failed to read api keys:", err)
+		return nil, apperr.ErrInternal
+	}
+	return keys, nil
+}
+
+func (db *DB) RevokeAPIKey(ctx context.Context, id string) (*model.APIKey, error) {
+	user, err := db.authorizedUser(ctx, auth.ScopeAccount)
+	if err != nil {
+		return nil, err
+	}
+	rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().Query)
+	defer cancel()
+	err = db.transact(rqCtx, func(tx *DB) error {
+		var userId string
+		err := tx.queryRow(rqCtx, "SELECT user_id FROM api_keys WHERE id = ? AND revoked_at IS NULL", isnumber.TryConvertToInt(id)).Scan(&userId)
+		if err == sql.ErrNoRows {
+			return apperr.NotFound("api key with such id does not exist")
+		}
+		if err != nil {
+			log.Println("failed to get api key:", err)
+			return apperr.ErrInternal
+		}
+		if err := policy.Check(user, policy.RevokeAPIKey, userId); err != nil {
+			return err
+		}
+		if _, err := tx.exec(rqCtx, "UPDATE api_keys SET revoked_at = ? WHERE id = ?", timestamp(time.Now()), isnumber.TryConvertToInt(id)); err != nil {
+			log.Println("failed to revoke api key:", err)
+			return apperr.ErrInternal
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	key, err := scanAPIKey(db.queryRow(rqCtx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE id = ?", isnumber.TryConvertToInt(id)))
+	if err != nil {
+		log.Println("failed to get api key:", err)
+		return nil, apperr.ErrInternal
+	}
+	return key, nil
+}
@@ -0,0 +1,486 @@
+package database
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/apperr"
+	"github.com/mattn/go-sqlite3"
+)
+
+// A backup is a gzipped tar archive starting with its manifest. SQLite databases are
+// copied whole into sqliteFile, Postgres tables are written as JSON Lines into tables/.
+const (
+	backupVersion = 1
+	manifestFile  = "manifest.json"
+	sqliteFile    = "database.sqlite3"
+	// backupPages are copied by a step of the SQLite backup, writers may go on between steps
+	backupPages = 1024
+)
+
+// backupTables are the tables of a Postgres backup in the order they are restored in.
+var backupTables = []struct {
+	name  string
+	order string
+}{
+	{"users", "id"},
+	{"posts", "id"},
+	// parents before replies
+	{"comments", "depth, id"},
+	{"sessions", "id"},
+	{"api_keys", "id"},
+	{"email_tokens", "id"},
+	{"identities", "id"},
+}
+
+// Manifest describes a backup: what it was taken from and the checksums of its files.
+type Manifest struct {
+	Version   int       `json:"version"`
+	Dialect   Dialect   `json:"dialect"`
+	Schema    int64     `json:"schema"`
+	CreatedAt time.Time `json:"created_at"`
+	Files     []File    `json:"files"`
+}
+
+type File struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	// Rows is the number of rows in a table of a Postgres backup.
+	Rows int `json:"rows,omitempty"`
+}
+
+// checksum returns the size and the SHA-256 of the file at path.
+func checksum(path string) (int64, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	return size, hex.EncodeToString(hash.Sum(nil)), err
+}
+
+// schemaVersion is the version of the last migration applied to db.
+func (db *DB) schemaVersion(ctx context.Context) (int64, error) {
+	provider, err := db.migrations()
+	if err != nil {
+		return 0, err
+	}
+	return provider.GetDBVersion(ctx)
+}
+
+// Backup writes a consistent copy of the database to w while it stays in use. SQLite is copied
+// with its online backup API, Postgres tables are read in a single repeatable read transaction.
+func (db *DB) Backup(ctx context.Context, w io.Writer) (*Manifest, error) {
+	dir, err := os.MkdirTemp("", "ozon-task-backup")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	manifest := &Manifest{Version: backupVersion, Dialect: db.Dialect, CreatedAt: timestamp(time.Now())}
+	if manifest.Schema, err = db.schemaVersion(ctx); err != nil {
+		return nil, err
+	}
+	if db.Dialect == Postgres {
+		err = db.dumpTables(ctx, dir, manifest)
+	} else {
+		err = db.copySQLite(ctx, filepath.Join(dir, sqliteFile))
+		manifest.Files = []File{{Name: sqliteFile}}
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := range manifest.Files {
+		file := &manifest.Files[i]
+		if file.Size, file.SHA256, err = checksum(filepath.Join(dir, file.Name)); err != nil {
+			return nil, err
+		}
+	}
+	return manifest, writeArchive(w, dir, manifest)
+}
+
+// sqliteConn runs fn with the driver connection of conn.
+func sqliteConn(conn *sql.Conn, fn func(*sqlite3.SQLiteConn) error) error {
+	return conn.Raw(func(driverConn any) error {
+		sqliteConn, ok := driverConn.(*sqlite3.SQLiteConn)
+		if !ok {
+			return fmt.Errorf("unexpected driver connection %T", driverConn)
+		}
+		return fn(sqliteConn)
+	})
+}
+
+// copySQLite copies the main database of src into the one of dest with the backup API.
+func copySQLite(ctx context.Context, dest *sql.DB, src *sql.DB) error {
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+	return sqliteConn(destConn, func(destConn *sqlite3.SQLiteConn) error {
+		return sqliteConn(srcConn, func(srcConn *sqlite3.SQLiteConn) error {
+			backup, err := destConn.Backup("main", srcConn, "main")
+			if err != nil {
+				return err
+			}
+			for done := false; !done; {
+				if err := ctx.Err(); err != nil {
+					backup.Close()
+					return err
+				}
+				if done, err = backup.Step(backupPages); err != nil {
+					backup.Close()
+					return err
+				}
+			}
+			return backup.Finish()
+		})
+	})
+}
+
+// copySQLite copies the database into a new file at path.
+func (db *DB) copySQLite(ctx context.Context, path string) error {
+	dest, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+	return copySQLite(ctx, dest, db.Client)
+}
+
+// dumpTables writes every row of backupTables into a file of dir as a JSON object by column names.
+func (db *DB) dumpTables(ctx context.Context, dir string, manifest *Manifest) error {
+	if err := os.Mkdir(filepath.Join(dir, "tables"), 0o700); err != nil {
+		return err
+	}
+	return db.snapshot(ctx, func(tx *DB) error {
+		for _, table := range backupTables {
+			name := "tables/" + table.name + ".jsonl"
+			rows, err := tx.dumpTable(ctx, filepath.Join(dir, name), table.name, table.order)
+			if err != nil {
+				return fmt.Errorf("failed to back up %s: %w", table.name, err)
+			}
+			manifest.Files = append(manifest.Files, File{Name: name, Rows: rows})
+		}
+		return nil
+	})
+}
+
+func (db *DB) dumpTable(ctx context.Context, path string, table string, order string) (int, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	rows, err := db.query(ctx, "SELECT * FROM "+table+" ORDER BY "+order)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	encoder := json.NewEncoder(file)
+	count := 0
+	for rows.Next() {
+		values := make([]any, len(columns))
+		pointers := make([]any, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return 0, err
+		}
+		row := make(map[string]any, len(columns))
+		for i, column := range columns {
+			if text, ok := values[i].([]byte); ok {
+				values[i] = string(text)
+			}
+			row[column] = values[i]
+		}
+		if err := encoder.Encode(row); err != nil {
+			return 0, err
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	return count, file.Close()
+}
+
+func writeArchive(w io.Writer, dir string, manifest *Manifest) error {
+	compressed := gzip.NewWriter(w)
+	archive := tar.NewWriter(compressed)
+	encoded, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = archive.WriteHeader(&tar.Header{Name: manifestFile, Mode: 0o600, Size: int64(len(encoded)), ModTime: manifest.CreatedAt})
+	if err != nil {
+		return err
+	}
+	if _, err := archive.Write(encoded); err != nil {
+		return err
+	}
+	for _, file := range manifest.Files {
+		if err := addFile(archive, dir, file, manifest.CreatedAt); err != nil {
+			return err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	return compressed.Close()
+}
+
+func addFile(archive *tar.Writer, dir string, file File, modTime time.Time) error {
+	content, err := os.Open(filepath.Join(dir, file.Name))
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	if err := archive.WriteHeader(&tar.Header{Name: file.Name, Mode: 0o600, Size: file.Size, ModTime: modTime}); err != nil {
+		return err
+	}
+	_, err = io.Copy(archive, content)
+	return err
+}
+
+// errBadBackup is returned for archives that aren't backups or were damaged.
+var errBadBackup = apperr.Invalid("not a backup or a damaged one")
+
+// backupFiles are the names of the files a backup of dialect consists of besides its manifest.
+func backupFiles(dialect Dialect) map[string]bool {
+	if dialect != Postgres {
+		return map[string]bool{sqliteFile: true}
+	}
+	names := map[string]bool{}
+	for _, table := range backupTables {
+		names["tables/"+table.name+".jsonl"] = true
+	}
+	return names
+}
+
+// readArchive unpacks a backup of dialect into dir and checks its files against the manifest.
+func readArchive(r io.Reader, dir string, dialect Dialect) (*Manifest, error) {
+	compressed, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, errBadBackup
+	}
+	archive := tar.NewReader(compressed)
+	header, err := archive.Next()
+	if err != nil || header.Name != manifestFile {
+		return nil, errBadBackup
+	}
+	var manifest Manifest
+	if err := json.NewDecoder(archive).Decode(&manifest); err != nil {
+		return nil, errBadBackup
+	}
+	if manifest.Version != backupVersion {
+		return nil, apperr.Invalid("backup of version %d, expected %d", manifest.Version, backupVersion)
+	}
+	if manifest.Dialect != dialect {
+		return nil, apperr.Invalid("backup of %s can't be restored into %s", manifest.Dialect, dialect)
+	}
+	// names are checked before anything is written, so that a crafted manifest can't
+	// have files written outside dir
+	names := backupFiles(dialect)
+	expected := map[string]File{}
+	for _, file := range manifest.Files {
+		if !names[file.Name] {
+			return nil, apperr.Invalid("unexpected file %q in the backup", file.Name)
+		}
+		expected[file.Name] = file
+	}
+	if len(expected) != len(names) {
+		return nil, errBadBackup
+	}
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errBadBackup
+		}
+		file, ok := expected[header.Name]
+		if !ok {
+			return nil, apperr.Invalid("unexpected file %q in the backup", header.Name)
+		}
+		delete(expected, header.Name)
+		if err := extract(archive, filepath.Join(dir, filepath.FromSlash(file.Name)), file); err != nil {
+			return nil, err
+		}
+	}
+	for name := range expected {
+		return nil, apperr.Invalid("file %q is missing from the backup", name)
+	}
+	return &manifest, nil
+}
+
+// extract writes the next file of archive to path, failing if it doesn't match its checksum.
+func extract(archive io.Reader, path string, file File) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	content, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(content, hash), archive)
+	if err != nil {
+		return errBadBackup
+	}
+	if size != file.Size || hex.EncodeToString(hash.Sum(nil)) != file.SHA256 {
+		return apperr.Invalid("checksum of %q doesn't match the manifest", file.Name)
+	}
+	return content.Close()
+}
+
+// Restore replaces the contents of the database with a backup made by Backup from the
+// same dialect, once every file of it matches the manifest. A Postgres backup needs the
+// schema it was taken from, a SQLite one brings its own.
+func (db *DB) Restore(ctx context.Context, r io.Reader) (*Manifest, error) {
+	dir, err := os.MkdirTemp("", "ozon-task-restore")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	manifest, err := readArchive(r, dir, db.Dialect)
+	if err != nil {
+		return nil, err
+	}
+	provider, err := db.migrations()
+	if err != nil {
+		return nil, err
+	}
+	sources := provider.ListSources()
+	if len(sources) == 0 || manifest.Schema > sources[len(sources)-1].Version {
+		return nil, apperr.Invalid("backup of schema version %d is newer than the migrations of this build", manifest.Schema)
+	}
+	if db.Dialect == Postgres {
+		return manifest, db.loadTables(ctx, dir, manifest)
+	}
+	return manifest, db.restoreSQLite(ctx, filepath.Join(dir, sqliteFile))
+}
+
+func (db *DB) restoreSQLite(ctx context.Context, path string) error {
+	src, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	var integrity string
+	if err := src.QueryRowContext(ctx, "PRAGMA integrity_check").Scan(&integrity); err != nil || integrity != "ok" {
+		return errBadBackup
+	}
+	return copySQLite(ctx, db.Client, src)
+}
+
+func (db *DB) loadTables(ctx context.Context, dir string, manifest *Manifest) error {
+	schema, err := db.schemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if schema != manifest.Schema {
+		return apperr.Invalid("backup of schema version %d can't be restored into version %d, migrate to it first", manifest.Schema, schema)
+	}
+	names := make([]string, len(backupTables))
+	for i, table := range backupTables {
+		names[i] = table.name
+	}
+	// attempted once like Import, the tables are read from files though
+	_, err = db.attempt(ctx, func(tx *DB) error {
+		if _, err := tx.exec(ctx, "TRUNCATE "+strings.Join(names, ", ")+" RESTART IDENTITY"); err != nil {
+			return err
+		}
+		for _, table := range backupTables {
+			if err := tx.loadTable(ctx, filepath.Join(dir, "tables", table.name+".jsonl"), table.name); err != nil {
+				return fmt.Errorf("failed to restore %s: %w", table.name, err)
+			}
+			_, err := tx.exec(ctx, fmt.Sprintf("SELECT setval(pg_get_serial_sequence('%[1]s', 'id'), MAX(id)) FROM %[1]s", table.name))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// loadTable inserts the rows dumpTable wrote, their keys have to be columns of table.
+func (db *DB) loadTable(ctx context.Context, path string, table string) error {
+	known, err := db.columns(ctx, table)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(file)
+	decoder.UseNumber()
+	for {
+		var row map[string]any
+		if err := decoder.Decode(&row); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		columns := make([]string, 0, len(row))
+		values := make([]any, 0, len(row))
+		for column, value := range row {
+			if !known[column] {
+				return apperr.Invalid("%s has no column %q", table, column)
+			}
+			columns = append(columns, `"`+column+`"`)
+			values = append(values, value)
+		}
+		query := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s", table, strings.Join(columns, ", "), placeholders(len(values)))
+		if _, err := db.exec(ctx, query, values...); err != nil {
+			return err
+		}
+	}
+}
+
+// columns returns the names of the columns of table in Postgres.
+func (db *DB) columns(ctx context.Context, table string) (map[string]bool, error) {
+	rows, err := db.query(ctx, "SELECT column_name FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = ?", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns := map[string]bool{}
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return nil, err
+		}
+		columns[column] = true
+	}
+	return columns, rows.Err()
+}
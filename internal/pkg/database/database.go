@@ -3,50 +3,78 @@ package database
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"strings"
-	"time"
 
-	"github.com/99designs/gqlgen/graphql"
 	"github.com/idkwhyureadthis/ozon-task/graph/model"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/apperr"
 	"github.com/idkwhyureadthis/ozon-task/internal/pkg/auth"
-	"github.com/idkwhyureadthis/ozon-task/internal/pkg/cropstrings"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/config"
 	"github.com/idkwhyureadthis/ozon-task/internal/pkg/isnumber"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/policy"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/pubsub"
 	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
-	"github.com/pressly/goose/v3"
 )
 
 type DB struct {
-	Client *sql.DB
+	Client  *sql.DB
+	Events  *pubsub.Broker
+	Dialect Dialect
+	// Limits and Timeouts left unset fall back to those of config.Default.
+	Limits   config.Limits
+	Timeouts config.Timeouts
+	// tx is set on the copies of DB transact hands out.
+	tx *tx
 }
 
-type Post struct {
-	Id            string
-	Data          string
-	Author        json.RawMessage
-	IsCommentable bool
+const subscriberBufferSize = 16
+
+// limits returns Limits, the ones left unset fall back to config.Default.
+func (db *DB) limits() config.Limits {
+	return db.Limits.WithDefaults()
 }
 
-var database *DB
+// timeouts returns Timeouts, the ones left unset fall back to config.Default.
+func (db *DB) timeouts() config.Timeouts {
+	return db.Timeouts.WithDefaults()
+}
 
-func Connect(connString string, migrations string) {
-	if strings.HasPrefix(connString, "postgresql://") {
+// Connect chooses the backend by cfg.Storage: "memory" keeps everything in process,
+// a postgresql:// URL connects to Postgres and anything else is a SQLite file name.
+// cfg.Migrations is the mode Migrate runs the SQL backends in, failing to migrate stops the program.
+func Connect(cfg *config.Config) Storage {
+	connString, migrations := cfg.Storage, cfg.Migrations
+	if _, err := config.ParseMigrationMode(migrations); err != nil {
+		log.Fatal("wrong migrations mode:", err)
+	}
+	var database Storage
+	if connString == "memory" {
+		log.Println("using in-memory storage")
+		memory := NewMemory()
+		memory.Limits = cfg.Limits
+		database = memory
+	} else if strings.HasPrefix(connString, "postgresql://") {
 		conn, err := sql.Open("postgres", connString)
 		if err != nil {
 			log.Fatal("unable to open postgres DB:", err)
 		}
 		log.Println("successfully connected to postgres DB")
-		database = &DB{
-			Client: conn,
+		db := &DB{
+			Client:   conn,
+			Events:   pubsub.New(subscriberBufferSize),
+			Dialect:  Postgres,
+			Limits:   cfg.Limits,
+			Timeouts: cfg.Timeouts,
 		}
-		database.SetupMigrations(migrations, "postgres")
+		if err := db.Migrate(context.Background(), migrations); err != nil {
+			log.Fatal("failed to migrate postgres DB:", err)
+		}
+		database = db
 
 	} else {
-		goose.SetDialect("sqlite3")
 		dbName := "internal/database/" + connString
 		if connString == "" {
 			dbName = "internal/database/db.sql"
@@ -58,218 +86,316 @@ func Connect(connString string, migrations string) {
 			}
 			file.Close()
 		}
-		conn, err := sql.Open("sqlite3", dbName)
+		// transactions take the write lock when they begin: two that read first and
+		// then both try to write would have one of them fail as busy right away
+		conn, err := sql.Open("sqlite3", dbName+"?_foreign_keys=on&_txlock=immediate")
 		if err != nil {
 			log.Fatal("unable to open sqlite3 DB:", err)
 		}
 		log.Println("successfully connected to sqlite3 DB")
-		database = &DB{
-			Client: conn,
+		db := &DB{
+			Client:   conn,
+			Events:   pubsub.New(subscriberBufferSize),
+			Dialect:  SQLite,
+			Limits:   cfg.Limits,
+			Timeouts: cfg.Timeouts,
+		}
+		if err := db.Migrate(context.Background(), migrations); err != nil {
+			log.Fatal("failed to migrate sqlite3 DB:", err)
 		}
-		database.SetupMigrations(migrations, "sqlite3")
+		database = db
 	}
-	log.Println(database)
+	return database
 }
 
-func GetConnection() *DB {
-	return database
+func (db *DB) Close() error {
+	return db.Client.Close()
 }
 
-func (db *DB) SetupMigrations(migrations string, drivers string) {
-	pathToMigrations := "internal/migrations/" + drivers
-	log.Println("setting up migrations...")
-	goose.Up(db.Client, pathToMigrations)
+const (
+	userColumns    = "id, name, about, deleted_at IS NOT NULL, role"
+	postColumns    = "id, data, author_id, is_commentable, deleted_at IS NOT NULL"
+	commentColumns = "id, post_id, author_id, parent_id, path, data, " +
+		"EXISTS (SELECT 1 FROM comments replies WHERE replies.parent_id = comments.id AND " + visibleReply + "), " +
+		"deleted_at IS NOT NULL, hidden_at IS NOT NULL"
+)
+
+type scanner interface {
+	Scan(dest ...any) error
 }
 
-func (db *DB) CreateUser(ctx context.Context, input *model.CreateUserInput) *model.User {
+// scanUser, scanPost and scanComment replace what deleted rows hold with tombstones.
+func scanUser(row scanner, extra ...any) (*model.User, error) {
 	var (
-		name         string
-		about        string
-		user         model.User
-		lastInsertId int
+		user model.User
+		role string
 	)
+	err := row.Scan(append([]any{&user.ID, &user.Name, &user.About, &user.Deleted, &role}, extra...)...)
+	if err != nil {
+		return nil, err
+	}
+	user.Role = toRole(role)
+	if user.Deleted {
+		user.Name, user.About = deletedText, ""
+	}
+	return &user, nil
+}
 
-	stmt, _ := db.Client.Prepare("INSERT INTO users (name, about) VALUES ($1, $2) RETURNING id;")
-
-	name = cropstrings.CropToLength(input.Name, 32)
-	if input.About != "" {
-		croppedAbout := cropstrings.CropToLength(input.About, 200)
-		about = croppedAbout
+func scanPost(row scanner) (*model.Post, error) {
+	var post model.Post
+	err := row.Scan(&post.ID, &post.Data, &post.AuthorID, &post.Commentable, &post.Deleted)
+	if err != nil {
+		return nil, err
 	}
-	stmt.QueryRow(name, about).Scan(&lastInsertId)
-	user = model.User{
-		ID:    fmt.Sprint(lastInsertId),
-		Name:  name,
-		About: about,
+	if post.Deleted {
+		post.Data, post.Commentable = deletedText, false
 	}
-	return &user
+	return &post, nil
 }
 
-func (db *DB) GetUser(ctx context.Context, id string) *model.User {
-	var user model.User
-	rqCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	query := fmt.Sprintf("SELECT * FROM users WHERE id = %v;", id)
-	row, err := db.Client.QueryContext(rqCtx, query)
+// scanComment reads commentColumns, extra destinations take columns selected after them.
+func scanComment(row scanner, extra ...any) (*model.Comment, error) {
+	var (
+		comment  model.Comment
+		parentId sql.NullString
+		path     string
+	)
+	dest := []any{&comment.ID, &comment.PostID, &comment.CreatorID, &parentId, &path, &comment.Text, &comment.HasReplies, &comment.Deleted, &comment.Hidden}
+	err := row.Scan(append(dest, extra...)...)
 	if err != nil {
-		log.Println("failed to get user:", err)
-		graphql.AddErrorf(ctx, "server error occurred")
-		return &model.User{}
+		return nil, err
 	}
-	defer row.Close()
-	var count int
-	for row.Next() {
-		err = row.Scan(&user.ID, &user.Name, &user.About)
-		if err != nil {
-			log.Println("failed to scan sql response", err)
-			graphql.AddErrorf(ctx, "server error occurred")
-			return &model.User{}
+	comment.AnswerTo = "-1"
+	if parentId.Valid {
+		comment.AnswerTo = parentId.String
+	}
+	comment.InitialComment = threadRoot(path)
+	switch {
+	case comment.Deleted:
+		comment.Text = deletedText
+	case comment.Hidden:
+		comment.Text = hiddenText
+	}
+	return &comment, nil
+}
+
+// actor returns the user the request is made on behalf of, deleted or not, checking scope
+// if it uses an API key. The user looked up by the directives of the field is taken from
+// ctx when it's there.
+func (db *DB) actor(ctx context.Context, scope auth.Scope) (*model.User, error) {
+	principal, err := auth.Authorize(ctx, scope)
+	if err != nil {
+		return nil, err
+	}
+	user, ok := policy.ActorFrom(ctx)
+	if !ok || user.ID != principal.UserID {
+		if user, err = db.GetUser(ctx, principal.UserID); err == errUserNotFound {
+			return nil, errDeletedActor
+		} else if err != nil {
+			return nil, err
 		}
-		count++
 	}
-	if count == 0 {
-		graphql.AddErrorf(ctx, "user with such id does not exist")
-		return &model.User{}
+	return user, nil
+}
+
+// authorizedUser does the check every mutation starts with: the request is made
+// on behalf of an existing user who is not deleted, and with scope if it uses an API key.
+// Mutations of what others own check the policy with the user it returns as well, the
+// directives of the schema do the same before, storage doesn't count on them.
+func (db *DB) authorizedUser(ctx context.Context, scope auth.Scope) (*model.User, error) {
+	user, err := db.actor(ctx, scope)
+	if err != nil {
+		return nil, err
 	}
-	if count != 1 {
-		graphql.AddErrorf(ctx, "wrong user id provided")
-		return &model.User{}
+	if user.Deleted {
+		return nil, errDeletedActor
 	}
-	return &user
+	return user, nil
 }
 
-func (db *DB) GetPost(ctx context.Context, id string) *model.Post {
-	var post *model.Post
-	rqCtx, cancel := context.WithTimeout(context.Background(), time.Second*30)
-	query := fmt.Sprintf("SELECT * FROM posts WHERE id = %v", id)
+func (db *DB) CreateUser(ctx context.Context, input *model.CreateUserInput) (*model.User, error) {
+	name, about := input.Name, input.About
+	email, err := inputEmail(input.Email)
+	if err != nil {
+		return nil, err
+	}
+	rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().Query)
 	defer cancel()
-	row, err := db.Client.QueryContext(rqCtx, query)
+	var lastInsertId int
+	err = db.transact(rqCtx, func(tx *DB) error {
+		if err := tx.claimEmail(rqCtx, email); err != nil {
+			return err
+		}
+		lastInsertId, err = tx.insert(rqCtx, "INSERT INTO users (name, about, email) VALUES (?, ?, ?)", name, about, email)
+		if err != nil {
+			log.Println("failed to create user:", err)
+			return apperr.ErrInternal
+		}
+		return nil
+	})
 	if err != nil {
-		log.Println("failed to get data from database", err)
-		graphql.AddErrorf(ctx, "server error occurred")
-		return &model.Post{}
+		return nil, err
 	}
-	count := 0
+	return &model.User{
+		ID:    fmt.Sprint(lastInsertId),
+		Name:  name,
+		About: about,
+		Role:  model.RoleUser,
+	}, nil
+}
 
-	for row.Next() {
-		var pst Post
-		var author model.User
-		row.Scan(&pst.Id, &pst.Data, &pst.Author, &pst.IsCommentable)
-		err := json.Unmarshal(pst.Author, &author)
+func (db *DB) Register(ctx context.Context, input *model.RegisterInput, passwordHash string) (*model.User, error) {
+	name, about := input.Name, input.About
+	email, err := inputEmail(input.Email)
+	if err != nil {
+		return nil, err
+	}
+	rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().Query)
+	defer cancel()
+	var lastInsertId int
+	err = db.transact(rqCtx, func(tx *DB) error {
+		var taken bool
+		err := tx.queryRow(rqCtx, "SELECT EXISTS (SELECT 1 FROM users WHERE name = ? AND password_hash IS NOT NULL)", name).Scan(&taken)
 		if err != nil {
-			log.Println("error parsing json", err)
-			graphql.AddErrorf(ctx, "server error occurred")
+			log.Println("failed to check user name:", err)
+			return apperr.ErrInternal
+		}
+		if taken {
+			return apperr.Invalid("user with such name already exists")
 		}
-		post = &model.Post{
-			ID:          pst.Id,
-			Data:        pst.Data,
-			Author:      &author,
-			Commentable: pst.IsCommentable,
+		if err := tx.claimEmail(rqCtx, email); err != nil {
+			return err
+		}
+		lastInsertId, err = tx.insert(rqCtx, "INSERT INTO users (name, about, password_hash, email) VALUES (?, ?, ?, ?)", name, about, passwordHash, email)
+		if err != nil {
+			log.Println("failed to register user:", err)
+			return apperr.ErrInternal
 		}
-		count++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &model.User{
+		ID:    fmt.Sprint(lastInsertId),
+		Name:  name,
+		About: about,
+		Role:  model.RoleUser,
+	}, nil
+}
+
+func (db *DB) GetCredentials(ctx context.Context, name string) (*model.User, string, error) {
+	rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().Query)
+	defer cancel()
+	var passwordHash string
+	user, err := scanUser(db.queryRow(rqCtx, "SELECT "+userColumns+", password_hash FROM users "+
+		"WHERE name = ? AND password_hash IS NOT NULL AND deleted_at IS NULL", name), &passwordHash)
+	if err == sql.ErrNoRows {
+		return nil, "", auth.ErrWrongPassword
 	}
-	if count == 0 {
-		graphql.AddErrorf(ctx, "post with such id not found")
-		return &model.Post{}
+	if err != nil {
+		log.Println("failed to get credentials:", err)
+		return nil, "", apperr.ErrInternal
+	}
+	return user, passwordHash, nil
+}
+
+func (db *DB) GetUser(ctx context.Context, id string) (*model.User, error) {
+	rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().Query)
+	defer cancel()
+	userId := isnumber.TryConvertToInt(id)
+	user, err := scanUser(db.queryRow(rqCtx, "SELECT "+userColumns+" FROM users WHERE id = ?", userId))
+	if err == sql.ErrNoRows {
+		return nil, errUserNotFound
+	}
+	if err != nil {
+		log.Println("failed to get user:", err)
+		return nil, apperr.ErrInternal
+	}
+	return user, nil
+}
+
+func (db *DB) GetPost(ctx context.Context, id string) (*model.Post, error) {
+	rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().LongQuery)
+	defer cancel()
+	postId := isnumber.TryConvertToInt(id)
+	post, err := scanPost(db.queryRow(rqCtx, "SELECT "+postColumns+" FROM posts WHERE id = ?", postId))
+	if err == sql.ErrNoRows {
+		return nil, errPostNotFound
 	}
-	if count != 1 {
-		graphql.AddErrorf(ctx, "wrong post id provided")
-		return &model.Post{}
+	if err != nil {
+		log.Println("failed to get data from database", err)
+		return nil, apperr.ErrInternal
 	}
-	return post
+	return post, nil
 }
 
-func (db *DB) GetPosts(ctx context.Context, page int) []*model.Post {
-	var posts []*model.Post
-	limit := 20
-	offset := limit * (page - 1)
-	query := fmt.Sprintf("SELECT * FROM posts ORDER BY id ASC LIMIT %d OFFSET %d", limit, offset)
-	if page < 1 {
-		graphql.AddErrorf(ctx, "page number should be greater than 1")
-		return posts
+func (db *DB) GetPosts(ctx context.Context, page Page) (*model.PostConnection, error) {
+	w, err := page.window(db.limits().PageSize)
+	if err != nil {
+		return nil, err
 	}
-	rqCtx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().LongQuery)
 	defer cancel()
-	rows, err := db.Client.QueryContext(rqCtx, query)
+	var totalCount int
+	err = db.queryRow(rqCtx, "SELECT COUNT(*) FROM posts WHERE deleted_at IS NULL").Scan(&totalCount)
+	if err != nil {
+		log.Println("error while counting posts", err)
+		return nil, apperr.ErrInternal
+	}
+	conditions, args, tail := w.keyset()
+	conditions = append([]string{"deleted_at IS NULL"}, conditions...)
+	rows, err := db.query(rqCtx, "SELECT "+postColumns+" FROM posts"+where(conditions)+" "+tail, args...)
 	if err != nil {
 		log.Println("error while getting posts", err)
-		graphql.AddErrorf(ctx, "error while getting posts %v", err)
-		return posts
+		return nil, apperr.ErrInternal
 	}
 	defer rows.Close()
-	var cnt = 0
+	posts := []*model.Post{}
 	for rows.Next() {
-		cnt++
-		var post Post
-		var author model.User
-		err = rows.Scan(&post.Id, &post.Data, &post.Author, &post.IsCommentable)
-		if err != nil {
-			graphql.AddErrorf(ctx, "error while getting posts %v", err)
-			return []*model.Post{}
-		}
-		err = json.Unmarshal(post.Author, &author)
+		post, err := scanPost(rows)
 		if err != nil {
-			log.Println("failed unmarshalling json", err)
-			graphql.AddErrorf(ctx, "error while parsing json")
-			return []*model.Post{}
+			log.Println("failed to scan post", err)
+			return nil, apperr.ErrInternal
 		}
-		postToAdd := model.Post{
-			ID:          post.Id,
-			Data:        post.Data,
-			Author:      &author,
-			Commentable: post.IsCommentable,
-		}
-		posts = append(posts, &postToAdd)
+		posts = append(posts, post)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("error while reading posts", err)
+		return nil, apperr.ErrInternal
 	}
-	return posts
+	posts, hasMore := trim(w, posts)
+	return postConnection(w, posts, hasMore, totalCount), nil
 }
 
-func (db *DB) CreatePost(ctx context.Context, input *model.CreatePostInput) *model.Post {
-	var createdId int
+func (db *DB) CreatePost(ctx context.Context, input *model.CreatePostInput) (*model.Post, error) {
 	commentable := 0
 	if input.Commentable {
 		commentable = 1
 	}
-	userId, err := auth.IsAuthorized(ctx)
-	if err != nil {
-		return &model.Post{}
-	}
-	author := db.GetUser(ctx, userId)
-	if (model.User{}) == *author {
-		return &model.Post{}
-	}
-	authorByte, err := json.Marshal(author)
-	authorJson := json.RawMessage(authorByte)
-	if err != nil {
-		log.Println("failed to marshall user json", err)
-		graphql.AddErrorf(ctx, "failed to parse user as json")
-	}
-	stmt, err := db.Client.Prepare("INSERT INTO posts (data, author, is_commentable) VALUES ($1, $2, $3) returning id;")
+	author, err := db.authorizedUser(ctx, auth.ScopePostsWrite)
 	if err != nil {
-		log.Println("error in preparing query", err)
-		graphql.AddErrorf(ctx, "server error occurred")
-		return &model.Post{}
+		return nil, err
 	}
-	err = stmt.QueryRow(input.Data, authorJson, commentable).Scan(&createdId)
+	rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().LongQuery)
+	defer cancel()
+	createdId, err := db.insert(rqCtx, "INSERT INTO posts (data, author_id, is_commentable) VALUES (?, ?, ?)", input.Data, author.ID, commentable)
 	if err != nil {
 		log.Println("error in getting data", err)
-		graphql.AddErrorf(ctx, "server error occurred")
-		return &model.Post{}
+		return nil, apperr.ErrInternal
 	}
 
 	return &model.Post{
 		ID:          fmt.Sprint(createdId),
 		Data:        input.Data,
 		Commentable: input.Commentable,
-		Author:      author,
-	}
+		AuthorID:    author.ID,
+	}, nil
 }
 
-func (db *DB) UpdatePost(ctx context.Context, id string, input *model.UpdatePostInput) *model.Post {
+func (db *DB) UpdatePost(ctx context.Context, id string, input *model.UpdatePostInput) (*model.Post, error) {
 	var (
-		updatedId   int
-		postCreator json.RawMessage
-		creatorJson model.User
+		postCreator string
 		commentable = 0
 	)
 
@@ -277,415 +403,429 @@ func (db *DB) UpdatePost(ctx context.Context, id string, input *model.UpdatePost
 		commentable = 1
 	}
 
-	userId, err := auth.IsAuthorized(ctx)
-	if err != nil {
-		return &model.Post{}
-	}
-
-	author := db.GetUser(ctx, userId)
-	if (model.User{}) == *author {
-		return &model.Post{}
-	}
-
-	query := fmt.Sprintf("SELECT author FROM posts WHERE id = %v;", id)
-	err = db.Client.QueryRow(query).Scan(&postCreator)
+	actor, err := db.authorizedUser(ctx, auth.ScopePostsWrite)
 	if err != nil {
-		log.Println("error occurred while scanning author", err)
-		graphql.AddErrorf(ctx, "server error occurred")
-		return &model.Post{}
+		return nil, err
 	}
 
-	err = json.Unmarshal(postCreator, &creatorJson)
-
-	if err != nil {
-		log.Println("failed to unmarshal json", err)
-		graphql.AddErrorf(ctx, "server error occurred")
-		return &model.Post{}
-	}
-
-	if creatorJson.ID != userId {
-		graphql.AddErrorf(ctx, "cant change post of other users")
-		return &model.Post{}
-	}
+	rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().LongQuery)
+	defer cancel()
+	postId := isnumber.TryConvertToInt(id)
+	err = db.transact(rqCtx, func(tx *DB) error {
+		err := tx.queryRow(rqCtx, "SELECT author_id FROM posts WHERE id = ? AND deleted_at IS NULL", postId).Scan(&postCreator)
+		if err == sql.ErrNoRows {
+			return errPostNotFound
+		}
+		if err != nil {
+			log.Println("error occurred while scanning author", err)
+			return apperr.ErrInternal
+		}
+		if err := policy.Check(actor, policy.EditPost, postCreator); err != nil {
+			return err
+		}
 
-	if (model.UpdatePostInput{}) == *input {
-		graphql.AddErrorf(ctx, "nothing to edit")
-		return &model.Post{}
-	}
+		if (model.UpdatePostInput{}) == *input {
+			return apperr.Invalid("nothing to edit")
+		}
 
-	query = fmt.Sprintf("UPDATE posts SET data = '%v', is_commentable = %v WHERE id = %v RETURNING id;", input.Data, commentable, id)
-	err = db.Client.QueryRow(query).Scan(&updatedId)
+		_, err = tx.exec(rqCtx, "UPDATE posts SET data = ?, is_commentable = ? WHERE id = ?", input.Data, commentable, postId)
+		if err != nil {
+			log.Println("error occurred while updating post", err)
+			return apperr.ErrInternal
+		}
+		return nil
+	})
 	if err != nil {
-		log.Println("error occurred while scanning postId", err)
-		graphql.AddErrorf(ctx, "server error occurred")
-		return &model.Post{}
+		return nil, err
 	}
 	return &model.Post{
-		ID:          fmt.Sprint(updatedId),
+		ID:          fmt.Sprint(postId),
 		Data:        input.Data,
 		Commentable: input.Commentable,
-		Author:      &creatorJson,
-	}
+		AuthorID:    postCreator,
+	}, nil
 }
 
-func (db *DB) UpdateUser(ctx context.Context, input *model.UpdateUserInput) *model.User {
-	var changedUser model.User
-	userId, err := auth.IsAuthorized(ctx)
+func (db *DB) UpdateUser(ctx context.Context, input *model.UpdateUserInput) (*model.User, error) {
+	user, err := db.authorizedUser(ctx, auth.ScopeAccount)
 	if err != nil {
-		return &model.User{}
+		return nil, err
 	}
-	user := db.GetUser(ctx, userId)
-	if (model.User{}) == (*user) {
-		return &model.User{}
+	rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().Query)
+	defer cancel()
+	_, err = db.exec(rqCtx, "UPDATE users SET about = ? WHERE id = ?", input.About, user.ID)
+	if err != nil {
+		log.Println("error updating user", err)
+		return nil, apperr.ErrInternal
 	}
-	query := fmt.Sprintf("UPDATE users SET about = '%v' WHERE id = %v returning *", input.About, userId)
-	err = db.Client.QueryRow(query).Scan(&changedUser.ID, &changedUser.Name, &changedUser.About)
+	changedUser, err := scanUser(db.queryRow(rqCtx, "SELECT "+userColumns+" FROM users WHERE id = ?", user.ID))
 	if err != nil {
 		log.Println("error scanning data", err)
-		graphql.AddErrorf(ctx, "error parsing data")
-		return &model.User{}
+		return nil, apperr.ErrInternal
 	}
-	return &changedUser
+	return changedUser, nil
 }
 
-func (db *DB) CreateComment(ctx context.Context, input *model.CreateCommentInput) *model.Comment {
+func (db *DB) CreateComment(ctx context.Context, input *model.CreateCommentInput) (*model.Comment, error) {
 	text := input.Text
-	if len(input.Text) > 2000 {
-		text = cropstrings.CropToLength(text, 2000)
-	}
-	userId, err := auth.IsAuthorized(ctx)
-	initialComment := -1
 	answerTo := isnumber.TryConvertToInt(input.AnswerTo)
+	user, err := db.authorizedUser(ctx, auth.ScopeCommentsWrite)
 	if err != nil {
-		return &model.Comment{}
-	}
-	user := db.GetUser(ctx, userId)
-	if (model.User{}) == (*user) {
-		return &model.Comment{}
-	}
-	userJson, err := json.Marshal(user)
-	if err != nil {
-		log.Println("error marshalling JSON", err)
-		graphql.AddErrorf(ctx, "internal server error")
-		return &model.Comment{}
-	}
-	post := db.GetPost(ctx, input.Post)
-	if (model.Post{}) == (*post) {
-		return &model.Comment{}
+		return nil, err
 	}
-	if !post.Commentable {
-		graphql.AddErrorf(ctx, "cannot comment this post (commenting disabled)")
-		return &model.Comment{}
-	}
-	postJson, err := json.Marshal(post)
-	if err != nil {
-		log.Println("error marshalling JSON", err)
-		graphql.AddErrorf(ctx, "server error occurred")
-		return &model.Comment{}
-	}
-	if answerTo != -1 {
-		var initialCommentStr string
-		updateAnswerQuery := fmt.Sprintf("UPDATE comments SET has_replies = 1 WHERE id = %d RETURNING answer_to", answerTo)
-		err = db.Client.QueryRow(updateAnswerQuery).Scan(&initialCommentStr)
+	rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().LongQuery)
+	defer cancel()
+	var comment *model.Comment
+	// the post and the parent are checked in the same transaction the reply is added in,
+	// so that they can't be deleted or closed for comments in between
+	err = db.transact(rqCtx, func(tx *DB) error {
+		post, err := tx.GetPost(rqCtx, input.Post)
 		if err != nil {
-			graphql.AddErrorf(ctx, "failed to answer to comment that doesn't exist")
-			return &model.Comment{}
+			return err
 		}
-		initialComment = isnumber.TryConvertToInt(initialCommentStr)
-	}
-	query := fmt.Sprintf(`
-	INSERT INTO COMMENTS (post, author, initial_comment, answer_to, data, has_replies)
-	VALUES ('%s', '%s', %v, %d, '%s', %d) RETURNING id;`, postJson, userJson, initialComment, answerTo, text, 0)
-	var createdID int
-	err = db.Client.QueryRow(query).Scan(&createdID)
+		if post.Deleted {
+			return errPostNotFound
+		}
+		if !post.Commentable {
+			return apperr.Forbidden("cannot comment this post (commenting disabled)")
+		}
+		var (
+			parentId   any
+			parentPath string
+		)
+		if answerTo != -1 {
+			var parentPost string
+			err := tx.queryRow(rqCtx, "SELECT post_id, path FROM comments WHERE id = ? AND deleted_at IS NULL", answerTo).Scan(&parentPost, &parentPath)
+			if err == sql.ErrNoRows {
+				return apperr.NotFound("failed to answer to comment that doesn't exist")
+			}
+			if err != nil {
+				log.Println("error getting parent comment", err)
+				return apperr.ErrInternal
+			}
+			if parentPost != post.ID {
+				return apperr.Invalid("failed to answer to comment of other post")
+			}
+			parentId = answerTo
+		}
+		// path and depth are filled in by the comments_set_path trigger
+		createdID, err := tx.insert(rqCtx, "INSERT INTO comments (post_id, author_id, parent_id, data) VALUES (?, ?, ?, ?)",
+			post.ID, user.ID, parentId, text)
+		if err != nil {
+			log.Println("error inserting comment", err)
+			return apperr.ErrInternal
+		}
+		comment = &model.Comment{
+			ID:             fmt.Sprint(createdID),
+			Text:           text,
+			PostID:         post.ID,
+			CreatorID:      user.ID,
+			InitialComment: threadRoot(commentPath(parentPath, createdID)),
+			AnswerTo:       fmt.Sprint(answerTo),
+		}
+		return nil
+	})
 	if err != nil {
-		log.Println("error inserting comment", err)
-		graphql.AddErrorf(ctx, "server error occurred")
-		return &model.Comment{}
+		return nil, err
 	}
-	return &model.Comment{
-		ID:             fmt.Sprint(createdID),
-		Text:           text,
-		Post:           post,
-		Creator:        user,
-		InitialComment: fmt.Sprint(initialComment),
-		AnswerTo:       fmt.Sprint(answerTo),
+	db.Events.Publish(pubsub.PostTopic(comment.PostID), comment)
+	if answerTo != -1 {
+		db.Events.Publish(pubsub.CommentTopic(fmt.Sprint(answerTo)), comment)
 	}
+	return comment, nil
 }
 
-func (db *DB) GetComment(ctx context.Context, id string) *model.Comment {
-	type DBResponse struct {
-		id              int
-		post            json.RawMessage
-		author          json.RawMessage
-		initial_comment int
-		answer_to       int
-		data            string
-		has_replies     int
-	}
-	var resp DBResponse
-	var comm model.Comment
-
-	query := fmt.Sprintf(`SELECT * FROM comments WHERE id = %v`, id)
-
-	err := db.Client.QueryRow(query).Scan(&resp.id, &resp.post, &resp.author, &resp.initial_comment, &resp.answer_to, &resp.data, &resp.has_replies)
-	if err == sql.ErrNoRows {
-		graphql.AddErrorf(ctx, "comment with such id does not exits")
-		return &model.Comment{}
-	}
-	if err != nil {
-		log.Println("failed to get data from DB", err)
-		graphql.AddErrorf(ctx, "server error occurred")
-		return &model.Comment{}
-	}
-	err = json.Unmarshal(resp.post, &comm.Post)
-	if err != nil {
-		log.Println("failed to marshall json", err)
-		graphql.AddErrorf(ctx, "server error occurred")
-		return &model.Comment{}
+// getByIds selects rows of table with the given ids and returns them in the order of ids.
+func getByIds[T any](ctx context.Context, db *DB, table string, columns string, scan func(scanner) (T, string, error), ids []string) ([]T, []error) {
+	found := map[string]T{}
+	intIds := []any{}
+	for _, id := range ids {
+		if intId := isnumber.TryConvertToInt(id); intId != -1 {
+			intIds = append(intIds, intId)
+		}
 	}
-	err = json.Unmarshal(resp.author, &comm.Creator)
-	if err != nil {
-		log.Println("failed to marshall json", err)
-		graphql.AddErrorf(ctx, "server error occurred")
-		return &model.Comment{}
+	if len(intIds) > 0 {
+		rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().LongQuery)
+		defer cancel()
+		query := fmt.Sprintf("SELECT %s FROM %s WHERE id IN %s", columns, table, placeholders(len(intIds)))
+		rows, err := db.query(rqCtx, query, intIds...)
+		if err != nil {
+			log.Println("failed to get", table, "by ids", err)
+			return byIds(ids, found, apperr.ErrInternal)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			value, id, err := scan(rows)
+			if err != nil {
+				log.Println("failed to scan", table, err)
+				return byIds(ids, map[string]T{}, apperr.ErrInternal)
+			}
+			found[id] = value
+		}
+		// rows cut short by an error aren't missing, every id that wasn't read fails with it
+		if err := rows.Err(); err != nil {
+			log.Println("failed to read", table, "by ids", err)
+			return byIds(ids, found, apperr.ErrInternal)
+		}
 	}
-	comm.InitialComment = fmt.Sprint(resp.initial_comment)
-	comm.ID = fmt.Sprint(resp.id)
-	comm.AnswerTo = fmt.Sprint(resp.answer_to)
-	comm.Text = resp.data
-
-	return &comm
+	return byIds(ids, found, apperr.NotFound("%s with such id does not exist", strings.TrimSuffix(table, "s")))
 }
 
-func (db *DB) UpdateComment(ctx context.Context, commId string, input *model.UpdateCommentInput) *model.Comment {
-	type DBResponse struct {
-		id             int
-		post           json.RawMessage
-		author         json.RawMessage
-		initialComment int
-		data           string
-		answerTo       string
-		hasReplies     int
-	}
-
-	if len(input.Data) > 2000 {
-		input.Data = cropstrings.CropToLength(input.Data, 2000)
-	}
-
-	userId, err := auth.IsAuthorized(ctx)
-	if err != nil {
-		return &model.Comment{}
-	}
+func (db *DB) GetUsersByIds(ctx context.Context, ids []string) ([]*model.User, []error) {
+	return getByIds(ctx, db, "users", userColumns, func(row scanner) (*model.User, string, error) {
+		user, err := scanUser(row)
+		if err != nil {
+			return nil, "", err
+		}
+		return user, user.ID, nil
+	}, ids)
+}
 
-	user := db.GetUser(ctx, userId)
-	if (*user) == (model.User{}) {
-		return &model.Comment{}
-	}
+func (db *DB) GetPostsByIds(ctx context.Context, ids []string) ([]*model.Post, []error) {
+	return getByIds(ctx, db, "posts", postColumns, func(row scanner) (*model.Post, string, error) {
+		post, err := scanPost(row)
+		if err != nil {
+			return nil, "", err
+		}
+		return post, post.ID, nil
+	}, ids)
+}
 
-	var authorJson json.RawMessage
-	var author model.User
+func (db *DB) GetCommentsByIds(ctx context.Context, ids []string) ([]*model.Comment, []error) {
+	return getByIds(ctx, db, "comments", commentColumns, func(row scanner) (*model.Comment, string, error) {
+		comment, err := scanComment(row)
+		if err != nil {
+			return nil, "", err
+		}
+		return comment, comment.ID, nil
+	}, ids)
+}
 
-	getAuthorQuery := fmt.Sprintf(`SELECT author FROM comments WHERE id = %s`, commId)
+func (db *DB) CommentAdded(ctx context.Context, postId string) <-chan *model.Comment {
+	return db.Events.Subscribe(ctx, pubsub.PostTopic(postId))
+}
 
-	err = db.Client.QueryRow(getAuthorQuery).Scan(&authorJson)
+func (db *DB) ReplyAdded(ctx context.Context, commentId string) <-chan *model.Comment {
+	return db.Events.Subscribe(ctx, pubsub.CommentTopic(commentId))
+}
 
+func (db *DB) GetComment(ctx context.Context, id string) (*model.Comment, error) {
+	rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().LongQuery)
+	defer cancel()
+	commentId := isnumber.TryConvertToInt(id)
+	comm, err := scanComment(db.queryRow(rqCtx, "SELECT "+commentColumns+" FROM comments WHERE id = ?", commentId))
 	if err == sql.ErrNoRows {
-		graphql.AddErrorf(ctx, "comment with such id not found")
-		return &model.Comment{}
+		return nil, apperr.NotFound("comment with such id does not exits")
 	}
 	if err != nil {
-		log.Println("error occurred scanning DB", err)
-		graphql.AddErrorf(ctx, "server error occurred")
-		return &model.Comment{}
+		log.Println("failed to get data from DB", err)
+		return nil, apperr.ErrInternal
 	}
+	return comm, nil
+}
 
-	err = json.Unmarshal(authorJson, &author)
-
+func (db *DB) UpdateComment(ctx context.Context, commId string, input *model.UpdateCommentInput) (*model.Comment, error) {
+	actor, err := db.authorizedUser(ctx, auth.ScopeCommentsWrite)
 	if err != nil {
-		graphql.AddErrorf(ctx, "server error occurred")
-		return &model.Comment{}
+		return nil, err
 	}
 
-	if author.ID != userId {
-		graphql.AddErrorf(ctx, "can't edit comment of other person")
-		return &model.Comment{}
-	}
+	var authorId string
 
-	query := fmt.Sprintf(`UPDATE comments SET data = '%s' WHERE id = %s returning *;`, input.Data, commId)
+	rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().LongQuery)
+	defer cancel()
+	commentId := isnumber.TryConvertToInt(commId)
+	err = db.transact(rqCtx, func(tx *DB) error {
+		err := tx.queryRow(rqCtx, "SELECT author_id FROM comments WHERE id = ? AND deleted_at IS NULL", commentId).Scan(&authorId)
 
-	resp := DBResponse{}
-	err = db.Client.QueryRow(query).Scan(&resp.id, &resp.post, &resp.author, &resp.initialComment, &resp.answerTo, &resp.data, &resp.hasReplies)
+		if err == sql.ErrNoRows {
+			return apperr.NotFound("comment with such id not found")
+		}
+		if err != nil {
+			log.Println("error occurred scanning DB", err)
+			return apperr.ErrInternal
+		}
+		if err := policy.Check(actor, policy.EditComment, authorId); err != nil {
+			return err
+		}
 
+		_, err = tx.exec(rqCtx, "UPDATE comments SET data = ? WHERE id = ?", input.Data, commentId)
+		if err != nil {
+			log.Println("failed to update comment", err)
+			return apperr.ErrInternal
+		}
+		return nil
+	})
 	if err != nil {
-		log.Println("failed to parse data from query", err)
-		graphql.AddErrorf(ctx, "server error occurred")
-		return &model.Comment{}
+		return nil, err
 	}
 
-	commentPost := model.Post{}
-	err = json.Unmarshal(resp.post, &commentPost)
+	newComment, err := scanComment(db.queryRow(rqCtx, "SELECT "+commentColumns+" FROM comments WHERE id = ?", commentId))
 	if err != nil {
-		log.Println("failed to unmarshal data", err)
-		graphql.AddErrorf(ctx, "server error occurred")
-		return &model.Comment{}
-	}
-	newComment := model.Comment{
-		ID:             fmt.Sprint(resp.id),
-		Text:           input.Data,
-		Post:           &commentPost,
-		AnswerTo:       fmt.Sprint(resp.answerTo),
-		InitialComment: fmt.Sprint(resp.initialComment),
-		Creator:        &author,
+		log.Println("failed to parse data from query", err)
+		return nil, apperr.ErrInternal
 	}
-	return &newComment
+	return newComment, nil
 }
 
-func (db *DB) GetComments(ctx context.Context, postID string, page int) []*model.Comment {
-	limit := 20
-	offset := (page - 1) * limit
-	if page < 1 {
-		graphql.AddErrorf(ctx, "pages start with 1")
-		return []*model.Comment{}
-	}
-	post := db.GetPost(ctx, postID)
-	if post == (&model.Post{}) {
-		graphql.AddErrorf(ctx, "post not found")
-		return []*model.Comment{}
-	}
-	postJson, err := json.Marshal(post)
+// commentConnection returns the window of comments matching filter.
+func (db *DB) commentConnection(ctx context.Context, w window, filter string, filterArgs ...any) (*model.CommentConnection, error) {
+	rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().LongQuery)
+	defer cancel()
+	var totalCount int
+	err := db.queryRow(rqCtx, "SELECT COUNT(*) FROM comments WHERE "+filter, filterArgs...).Scan(&totalCount)
 	if err != nil {
-		log.Println("failed to marshal json", err)
-		graphql.AddErrorf(ctx, "server error occurred")
-		return []*model.Comment{}
+		log.Println("error counting comments", err)
+		return nil, apperr.ErrInternal
 	}
-	query := fmt.Sprintf(`SELECT * FROM comments WHERE post::text = '%s' AND answer_to = -1 LIMIT %d OFFSET %d`, postJson, limit, offset)
-
-	rows, err := db.Client.Query(query)
+	conditions, args, tail := w.keyset()
+	conditions = append([]string{filter}, conditions...)
+	args = append(filterArgs, args...)
+	rows, err := db.query(rqCtx, "SELECT "+commentColumns+" FROM comments"+where(conditions)+" "+tail, args...)
 	if err != nil {
 		log.Println("error performing query", err)
-		graphql.AddErrorf(ctx, "server error occurred")
-		return []*model.Comment{}
+		return nil, apperr.ErrInternal
 	}
+	defer rows.Close()
 
 	comments := []*model.Comment{}
-
-	type DBResponse struct {
-		id             int
-		post           json.RawMessage
-		author         json.RawMessage
-		initialComment int
-		answerTo       int
-		data           string
-		hasReplies     int
-	}
 	for rows.Next() {
-		resp := DBResponse{}
-		err = rows.Scan(&resp.id, &resp.post, &resp.author, &resp.initialComment, &resp.answerTo, &resp.data, &resp.hasReplies)
-		hasReplies := false
-		if resp.hasReplies > 0 {
-			hasReplies = true
-		}
-		post := model.Post{}
-		err = json.Unmarshal(resp.post, &post)
-		if err != nil {
-			log.Println("error decoding json", err)
-			graphql.AddErrorf(ctx, "server error occurred")
-			return []*model.Comment{}
-		}
-
-		creator := model.User{}
-		err = json.Unmarshal(resp.author, &creator)
+		comment, err := scanComment(rows)
 		if err != nil {
-			log.Println("error decoding json", err)
-			graphql.AddErrorf(ctx, "server error occurred")
-			return []*model.Comment{}
+			log.Println("error decoding comment", err)
+			return nil, apperr.ErrInternal
 		}
-
-		comment := model.Comment{
-			ID:             fmt.Sprint(resp.id),
-			Text:           resp.data,
-			Post:           &post,
-			AnswerTo:       fmt.Sprint(resp.answerTo),
-			InitialComment: fmt.Sprint(resp.initialComment),
-			Creator:        &creator,
-			HasReplies:     hasReplies,
-		}
-		comments = append(comments, &comment)
+		comments = append(comments, comment)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("error reading comments", err)
+		return nil, apperr.ErrInternal
 	}
-	return comments
+	comments, hasMore := trim(w, comments)
+	return commentConnection(w, comments, hasMore, totalCount), nil
 }
 
-func (db *DB) GetReplies(ctx context.Context, commentId string, page int) []*model.Comment {
-	limit := 20
-	offset := (page - 1) * limit
-	if page < 1 {
-		graphql.AddErrorf(ctx, "pages start with 1")
-		return []*model.Comment{}
+func (db *DB) GetComments(ctx context.Context, postID string, page Page) (*model.CommentConnection, error) {
+	w, err := page.window(db.limits().PageSize)
+	if err != nil {
+		return nil, err
 	}
-	commentIdInt := isnumber.TryConvertToInt(commentId)
-	if commentIdInt == -1 {
-		graphql.AddErrorf(ctx, "wrong commentId provided")
-		return []*model.Comment{}
+	post, err := db.GetPost(ctx, postID)
+	if err != nil {
+		return nil, err
 	}
-	if db.GetComment(ctx, commentId) == (&model.Comment{}) {
-		return []*model.Comment{}
+	if post.Deleted {
+		return nil, errPostNotFound
 	}
+	return db.commentConnection(ctx, w, "post_id = ? AND parent_id IS NULL AND "+visibleComment, post.ID)
+}
 
-	query := fmt.Sprintf("SELECT * FROM comments WHERE answer_to = %d LIMIT %d OFFSET %d", commentIdInt, limit, offset)
+func (db *DB) GetReplies(ctx context.Context, commentId string, page Page) (*model.CommentConnection, error) {
+	connections, errs := db.GetRepliesByIds(ctx, []string{commentId}, page)
+	return connections[0], errs[0]
+}
 
-	rows, err := db.Client.Query(query)
+var errWrongCommentId = apperr.Invalid("wrong commentId provided")
 
+func (db *DB) GetRepliesByIds(ctx context.Context, ids []string, page Page) ([]*model.CommentConnection, []error) {
+	connections := make([]*model.CommentConnection, len(ids))
+	w, err := page.window(db.limits().PageSize)
 	if err != nil {
-		log.Println("failed to perform query", err)
-		graphql.AddErrorf(ctx, "server error occurred")
-		return []*model.Comment{}
+		errs := make([]error, len(ids))
+		for i := range errs {
+			errs[i] = err
+		}
+		return connections, errs
+	}
+	_, errs := db.GetCommentsByIds(ctx, ids)
+	var parents []any
+	for i, id := range ids {
+		if isnumber.TryConvertToInt(id) == -1 {
+			errs[i] = errWrongCommentId
+		}
+		if errs[i] == nil {
+			parents = append(parents, isnumber.TryConvertToInt(id))
+		}
+	}
+	if len(parents) == 0 {
+		return connections, errs
+	}
+	pages, err := db.replyPages(ctx, w, parents)
+	for i, id := range ids {
+		switch {
+		case errs[i] != nil:
+		case err != nil:
+			errs[i] = err
+		default:
+			page := pages[fmt.Sprint(isnumber.TryConvertToInt(id))]
+			comments, hasMore := trim(w, page.comments)
+			connections[i] = commentConnection(w, comments, hasMore, page.totalCount)
+		}
 	}
+	return connections, errs
+}
 
-	comments := []*model.Comment{}
+// replyPage is the window of replies to a comment before trim.
+type replyPage struct {
+	comments   []*model.Comment
+	totalCount int
+}
 
-	type DBResponse struct {
-		id             int
-		post           json.RawMessage
-		author         json.RawMessage
-		initialComment int
-		answerTo       int
-		data           string
-		hasReplies     int
+// replyPages takes the window of visible replies to each of parents in two queries, whatever
+// the number of parents is: one counts the replies, the other numbers them per parent.
+func (db *DB) replyPages(ctx context.Context, w window, parents []any) (map[string]*replyPage, error) {
+	rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().LongQuery)
+	defer cancel()
+	pages := map[string]*replyPage{}
+	for _, parent := range parents {
+		pages[fmt.Sprint(parent)] = &replyPage{comments: []*model.Comment{}}
 	}
-	for rows.Next() {
-		resp := DBResponse{}
-		err = rows.Scan(&resp.id, &resp.post, &resp.author, &resp.initialComment, &resp.answerTo, &resp.data, &resp.hasReplies)
-		hasReplies := false
-		if resp.hasReplies > 0 {
-			hasReplies = true
-		}
-		post := model.Post{}
-		err = json.Unmarshal(resp.post, &post)
-		if err != nil {
-			log.Println("error decoding json", err)
-			graphql.AddErrorf(ctx, "server error occurred")
-			return []*model.Comment{}
+	in := "parent_id IN " + placeholders(len(parents))
+	counts, err := db.query(rqCtx, "SELECT parent_id, COUNT(*) FROM comments WHERE "+in+" AND "+visibleComment+" GROUP BY parent_id", parents...)
+	if err != nil {
+		log.Println("error counting replies", err)
+		return nil, apperr.ErrInternal
+	}
+	defer counts.Close()
+	for counts.Next() {
+		var (
+			parent string
+			count  int
+		)
+		if err := counts.Scan(&parent, &count); err != nil {
+			log.Println("error counting replies", err)
+			return nil, apperr.ErrInternal
 		}
+		pages[parent].totalCount = count
+	}
+	if err := counts.Err(); err != nil {
+		log.Println("error counting replies", err)
+		return nil, apperr.ErrInternal
+	}
 
-		creator := model.User{}
-		err = json.Unmarshal(resp.author, &creator)
+	conditions, args, _ := w.keyset()
+	conditions = append([]string{in, visibleComment}, conditions...)
+	args = append(append([]any{}, parents...), args...)
+	ranked := "SELECT id, ROW_NUMBER() OVER (PARTITION BY parent_id ORDER BY id " + w.order() + ") AS n FROM comments" + where(conditions)
+	rows, err := db.query(rqCtx, "SELECT "+commentColumns+" FROM comments WHERE id IN (SELECT id FROM ("+ranked+") ranked WHERE n <= ?) ORDER BY id "+w.order(),
+		append(args, w.limit+1)...)
+	if err != nil {
+		log.Println("error performing query", err)
+		return nil, apperr.ErrInternal
+	}
+	defer rows.Close()
+	for rows.Next() {
+		comment, err := scanComment(rows)
 		if err != nil {
-			log.Println("error decoding json", err)
-			graphql.AddErrorf(ctx, "server error occurred")
-			return []*model.Comment{}
+			log.Println("error decoding comment", err)
+			return nil, apperr.ErrInternal
 		}
-
-		comment := model.Comment{
-			ID:             fmt.Sprint(resp.id),
-			Text:           resp.data,
-			Post:           &post,
-			AnswerTo:       fmt.Sprint(resp.answerTo),
-			InitialComment: fmt.Sprint(resp.initialComment),
-			Creator:        &creator,
-			HasReplies:     hasReplies,
-		}
-		comments = append(comments, &comment)
+		page := pages[comment.AnswerTo]
+		page.comments = append(page.comments, comment)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("error reading replies", err)
+		return nil, apperr.ErrInternal
 	}
-	return comments
+	return pages, nil
 }
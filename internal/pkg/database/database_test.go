@@ -0,0 +1,1068 @@
+package database
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/idkwhyureadthis/ozon-task/graph/model"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/apperr"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/auth"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/config"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/isnumber"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/pubsub"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"github.com/pressly/goose/v3"
+	"github.com/stretchr/testify/require"
+)
+
+var hostileStrings = []string{
+	`it's`,
+	`'); DROP TABLE users; --`,
+	`' OR '1'='1`,
+	`"double" and 'single' quotes`,
+	`back\slash \' \"`,
+	`? $1 $2 %s %v`,
+	`{"id": "1"}`,
+	"new\nline\ttab",
+	`д'Артаньян'); --`,
+}
+
+func newTestDB(t *testing.T) *DB {
+	conn, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db")+"?_foreign_keys=on&_txlock=immediate")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	defaults := config.Default()
+	db := &DB{
+		Client:   conn,
+		Events:   pubsub.New(subscriberBufferSize),
+		Dialect:  SQLite,
+		Limits:   defaults.Limits,
+		Timeouts: defaults.Timeouts,
+	}
+	require.NoError(t, db.Migrate(context.Background(), MigrateUp))
+	return db
+}
+
+// newPostgresTestDB connects to the Postgres DB TEST_STORAGE points to, as graph tests do,
+// and empties it. It returns nil when TEST_STORAGE isn't a Postgres connection string.
+func newPostgresTestDB(t *testing.T) *DB {
+	storage := os.Getenv("TEST_STORAGE")
+	if !strings.HasPrefix(storage, "postgresql://") {
+		return nil
+	}
+	cfg := config.Default()
+	cfg.Storage = storage
+	db := Connect(cfg).(*DB)
+	t.Cleanup(func() { db.Close() })
+	_, err := db.Client.Exec(`TRUNCATE users, posts, comments RESTART IDENTITY CASCADE`)
+	require.NoError(t, err)
+	return db
+}
+
+// testContext returns a context resolvers would get for a request made by user.
+func testContext(user string) context.Context {
+	ctx := context.Background()
+	if user != "" {
+		ctx = auth.WithPrincipal(ctx, auth.Principal{UserID: user})
+	}
+	return ctx
+}
+
+// must returns value of calls that are expected to succeed, failing the test otherwise.
+func must[T any](value T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return value
+}
+
+// requireError checks that err is an apperr.Error with code and message.
+func requireError(t *testing.T, err error, code apperr.Code, message string) {
+	t.Helper()
+	require.EqualError(t, err, message)
+	appErr, ok := apperr.As(err)
+	require.True(t, ok)
+	require.Equal(t, code, appErr.Code)
+}
+
+func TestRebind(t *testing.T) {
+	query := "SELECT * FROM comments WHERE data = '?' AND id = ? AND answer_to = ?"
+	require.Equal(t, query, SQLite.Rebind(query))
+	require.Equal(t, "SELECT * FROM comments WHERE data = '?' AND id = $1 AND answer_to = $2", Postgres.Rebind(query))
+}
+
+func TestHostileStrings(t *testing.T) {
+	db := newTestDB(t)
+
+	for _, str := range hostileStrings {
+		t.Run(str, func(t *testing.T) {
+			ctx := testContext("")
+			user := must(db.CreateUser(ctx, &model.CreateUserInput{Name: str, About: str}))
+			require.Equal(t, str, user.Name)
+
+			ctx = testContext(user.ID)
+			updatedUser := must(db.UpdateUser(ctx, &model.UpdateUserInput{About: str + str}))
+			require.Equal(t, str+str, updatedUser.About)
+			require.Equal(t, *updatedUser, *must(db.GetUser(ctx, user.ID)))
+
+			post := must(db.CreatePost(ctx, &model.CreatePostInput{Data: str, Commentable: true}))
+			updatedPost := must(db.UpdatePost(ctx, post.ID, &model.UpdatePostInput{Data: str + str, Commentable: true}))
+			require.Equal(t, str+str, must(db.GetPost(ctx, post.ID)).Data)
+			require.Equal(t, updatedPost.Data, must(db.GetPost(ctx, post.ID)).Data)
+
+			comment := must(db.CreateComment(ctx, &model.CreateCommentInput{Text: str, Post: post.ID, AnswerTo: "-1"}))
+			reply := must(db.CreateComment(ctx, &model.CreateCommentInput{Text: str, Post: post.ID, AnswerTo: comment.ID}))
+			must(db.UpdateComment(ctx, reply.ID, &model.UpdateCommentInput{Data: str + str}))
+
+			comments := must(db.GetComments(ctx, post.ID, Page{})).Edges
+			require.Len(t, comments, 1)
+			require.Equal(t, str, comments[0].Node.Text)
+			require.True(t, comments[0].Node.HasReplies)
+
+			replies := must(db.GetReplies(ctx, comment.ID, Page{})).Edges
+			require.Len(t, replies, 1)
+			require.Equal(t, str+str, replies[0].Node.Text)
+		})
+	}
+
+	var count int
+	require.NoError(t, db.Client.QueryRow("SELECT COUNT(*) FROM users").Scan(&count))
+	require.Equal(t, len(hostileStrings), count)
+}
+
+func TestIdsAreBound(t *testing.T) {
+	db := newTestDB(t)
+	ctx := testContext("")
+	must(db.CreateUser(ctx, &model.CreateUserInput{Name: "srgold78"}))
+
+	user, err := db.GetUser(ctx, "1 OR 1=1")
+	require.Nil(t, user)
+	requireError(t, err, apperr.CodeNotFound, "user with such id does not exist")
+}
+
+func TestKeysetPagination(t *testing.T) {
+	db := newTestDB(t)
+	ctx := testContext("")
+	user := must(db.CreateUser(ctx, &model.CreateUserInput{Name: "srgold78"}))
+	ctx = testContext(user.ID)
+	for range 25 {
+		must(db.CreatePost(ctx, &model.CreatePostInput{Data: "пост"}))
+	}
+
+	first := must(db.GetPosts(ctx, Page{}))
+	require.Len(t, first.Edges, db.Limits.PageSize)
+	require.True(t, first.PageInfo.HasNextPage)
+	require.Equal(t, 25, first.TotalCount)
+
+	must(db.CreatePost(ctx, &model.CreatePostInput{Data: "новый пост"}))
+
+	second := must(db.GetPosts(ctx, Page{After: first.PageInfo.EndCursor}))
+	require.Len(t, second.Edges, 6)
+	require.Equal(t, "21", second.Edges[0].Node.ID)
+	require.False(t, second.PageInfo.HasNextPage)
+
+	last := 3
+	previous := must(db.GetPosts(ctx, Page{Last: &last, Before: second.PageInfo.StartCursor}))
+	require.Len(t, previous.Edges, 3)
+	require.Equal(t, "18", previous.Edges[0].Node.ID)
+	require.Equal(t, "20", previous.Edges[2].Node.ID)
+	require.True(t, previous.PageInfo.HasPreviousPage)
+
+	db.Limits.PageSize = 7
+	require.Len(t, must(db.GetPosts(ctx, Page{})).Edges, 7)
+}
+
+func TestGetByIds(t *testing.T) {
+	db := newTestDB(t)
+	ctx := testContext("")
+	must(db.CreateUser(ctx, &model.CreateUserInput{Name: "srgold78"}))
+	must(db.CreateUser(ctx, &model.CreateUserInput{Name: "srgold77"}))
+	ctx = testContext("2")
+	post := must(db.CreatePost(ctx, &model.CreatePostInput{Data: "пост", Commentable: true}))
+	comment := must(db.CreateComment(ctx, &model.CreateCommentInput{Text: "комментарий", Post: post.ID, AnswerTo: "-1"}))
+
+	users, errs := db.GetUsersByIds(ctx, []string{"2", "x", "3", "1"})
+	require.Equal(t, "srgold77", users[0].Name)
+	require.Equal(t, "srgold78", users[3].Name)
+	require.Nil(t, users[1])
+	require.NoError(t, errs[0])
+	require.EqualError(t, errs[1], "user with such id does not exist")
+	require.EqualError(t, errs[2], "user with such id does not exist")
+
+	posts, errs := db.GetPostsByIds(ctx, []string{post.ID})
+	require.NoError(t, errs[0])
+	require.Equal(t, "2", posts[0].AuthorID)
+
+	comments, errs := db.GetCommentsByIds(ctx, []string{comment.ID})
+	require.NoError(t, errs[0])
+	require.Equal(t, post.ID, comments[0].PostID)
+	require.Equal(t, "2", comments[0].CreatorID)
+}
+
+func TestForeignKeysMigration(t *testing.T) {
+	conn, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db")+"?_foreign_keys=on")
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, goose.SetDialect("sqlite3"))
+	require.NoError(t, goose.UpTo(conn, "../../migrations/sqlite3", 4))
+
+	_, err = conn.Exec(`INSERT INTO users (name, about) VALUES ('srgold78', 'Влад Младший')`)
+	require.NoError(t, err)
+	_, err = conn.Exec(`INSERT INTO posts (data, author, is_commentable) VALUES
+		('пост', '{"id":"1","name":"srgold78","about":"Влад Младший"}', 1),
+		('пост удалённого пользователя', '{"id":"7","name":"ghost","about":""}', 1)`)
+	require.NoError(t, err)
+	_, err = conn.Exec(`INSERT INTO comments (post, author, initial_comment, answer_to, data, has_replies) VALUES
+		('{"id":"1","data":"пост","commentable":true}', '{"id":"1","name":"srgold78","about":""}', -1, -1, 'комментарий', 0),
+		('{"id":"2","data":"пост удалённого пользователя","commentable":true}', '{"id":"1","name":"srgold78","about":""}', -1, -1, 'сирота', 0)`)
+	require.NoError(t, err)
+
+	require.NoError(t, goose.UpTo(conn, "../../migrations/sqlite3", 5))
+
+	var postId, authorId int
+	require.NoError(t, conn.QueryRow(`SELECT post_id, author_id FROM comments`).Scan(&postId, &authorId))
+	require.Equal(t, 1, postId)
+	require.Equal(t, 1, authorId)
+	var count int
+	require.NoError(t, conn.QueryRow(`SELECT COUNT(*) FROM posts`).Scan(&count))
+	require.Equal(t, 1, count)
+	var data string
+	require.NoError(t, conn.QueryRow(`SELECT data FROM orphaned_posts`).Scan(&data))
+	require.Equal(t, "пост удалённого пользователя", data)
+	require.NoError(t, conn.QueryRow(`SELECT data FROM orphaned_comments`).Scan(&data))
+	require.Equal(t, "сирота", data)
+
+	_, err = conn.Exec(`INSERT INTO comments (post_id, author_id, initial_comment, answer_to, data, has_replies) VALUES (42, 1, -1, -1, 'нет поста', 0)`)
+	require.Error(t, err)
+
+	require.NoError(t, goose.DownTo(conn, "../../migrations/sqlite3", 4))
+	var author string
+	require.NoError(t, conn.QueryRow(`SELECT author FROM comments WHERE id = 1`).Scan(&author))
+	require.JSONEq(t, `{"id":"1","name":"srgold78","about":"Влад Младший"}`, author)
+	require.NoError(t, conn.QueryRow(`SELECT author FROM posts WHERE id = 2`).Scan(&author))
+	require.JSONEq(t, `{"id":"7","name":"ghost","about":""}`, author)
+	require.NoError(t, conn.QueryRow(`SELECT COUNT(*) FROM comments`).Scan(&count))
+	require.Equal(t, 2, count)
+	_, err = conn.Exec(`SELECT * FROM orphaned_posts`)
+	require.Error(t, err)
+}
+
+func TestUpdatedUserIsSeenEverywhere(t *testing.T) {
+	db := newTestDB(t)
+	ctx := testContext("")
+	user := must(db.CreateUser(ctx, &model.CreateUserInput{Name: "srgold78", About: "старое описание"}))
+	ctx = testContext(user.ID)
+	post := must(db.CreatePost(ctx, &model.CreatePostInput{Data: "пост", Commentable: true}))
+	must(db.CreateComment(ctx, &model.CreateCommentInput{Text: "комментарий", Post: post.ID, AnswerTo: "-1"}))
+	must(db.UpdatePost(ctx, post.ID, &model.UpdatePostInput{Data: "изменённый пост", Commentable: true}))
+	must(db.UpdateUser(ctx, &model.UpdateUserInput{About: "новое описание"}))
+
+	comments := must(db.GetComments(ctx, post.ID, Page{})).Edges
+	require.Len(t, comments, 1)
+	users, _ := db.GetUsersByIds(ctx, []string{comments[0].Node.CreatorID})
+	require.Equal(t, "новое описание", users[0].About)
+}
+
+func TestCommentTree(t *testing.T) {
+	db := newTestDB(t)
+	ctx := testContext("")
+	user := must(db.CreateUser(ctx, &model.CreateUserInput{Name: "srgold78"}))
+	ctx = testContext(user.ID)
+	post := must(db.CreatePost(ctx, &model.CreatePostInput{Data: "пост", Commentable: true}))
+	otherPost := must(db.CreatePost(ctx, &model.CreatePostInput{Data: "другой пост", Commentable: true}))
+
+	reply := func(answerTo string) string {
+		return must(db.CreateComment(ctx, &model.CreateCommentInput{Text: "комментарий", Post: post.ID, AnswerTo: answerTo})).ID
+	}
+	// 1
+	// ├── 2
+	// │   └── 4
+	// │       └── 6
+	// └── 3
+	// 5
+	root := reply("-1")
+	first := reply(root)
+	second := reply(root)
+	nested := reply(first)
+	other := reply("-1")
+	deepest := reply(nested)
+	for id := 1; id <= 12; id++ {
+		// ids of two digits check that padded paths sort as numbers
+		reply(deepest)
+	}
+
+	comment := must(db.GetComment(ctx, deepest))
+	require.Equal(t, nested, comment.AnswerTo)
+	require.Equal(t, root, comment.InitialComment)
+	require.True(t, comment.HasReplies)
+	require.Equal(t, "-1", must(db.GetComment(ctx, root)).InitialComment)
+	require.False(t, must(db.GetComment(ctx, second)).HasReplies)
+
+	subtree, err := db.subtree(ctx, isnumber.TryConvertToInt(root))
+	require.NoError(t, err)
+	ids := []string{}
+	for _, comment := range subtree {
+		ids = append(ids, comment.ID)
+	}
+	require.Equal(t, []string{root, first, nested, deepest, "7", "8", "9", "10", "11", "12", "13", "14", "15", "16", "17", "18", second}, ids)
+
+	count, err := db.descendantsCount(ctx, isnumber.TryConvertToInt(root))
+	require.NoError(t, err)
+	require.Equal(t, 16, count)
+	count, err = db.descendantsCount(ctx, isnumber.TryConvertToInt(other))
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+
+	maxDepth, limit := 1, 3
+	thread := must(db.GetThread(ctx, root, &maxDepth, nil))
+	require.Equal(t, root, thread.Comment.ID)
+	require.False(t, thread.MoreReplies)
+	require.Len(t, thread.Replies, 2)
+	require.Equal(t, first, thread.Replies[0].Comment.ID)
+	require.True(t, thread.Replies[0].MoreReplies)
+	require.Empty(t, thread.Replies[0].Replies)
+	require.False(t, thread.Replies[1].MoreReplies)
+
+	thread = must(db.GetThread(ctx, root, nil, &limit))
+	require.True(t, thread.MoreReplies)
+	require.Equal(t, nested, thread.Replies[0].Replies[0].Comment.ID)
+	require.False(t, thread.Replies[0].MoreReplies)
+	require.True(t, thread.Replies[0].Replies[0].MoreReplies)
+
+	require.Equal(t, 2, must(db.GetComments(ctx, post.ID, Page{})).TotalCount)
+	require.Equal(t, 2, must(db.GetReplies(ctx, root, Page{})).TotalCount)
+
+	_, err = db.CreateComment(ctx, &model.CreateCommentInput{Text: "не туда", Post: otherPost.ID, AnswerTo: root})
+	requireError(t, err, apperr.CodeValidation, "failed to answer to comment of other post")
+}
+
+func TestCommentPathsMigration(t *testing.T) {
+	conn, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db")+"?_foreign_keys=on")
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, goose.SetDialect("sqlite3"))
+	require.NoError(t, goose.UpTo(conn, "../../migrations/sqlite3", 5))
+
+	_, err = conn.Exec(`INSERT INTO users (name, about) VALUES ('srgold78', '')`)
+	require.NoError(t, err)
+	_, err = conn.Exec(`INSERT INTO posts (data, author_id, is_commentable) VALUES ('пост', 1, 1)`)
+	require.NoError(t, err)
+	_, err = conn.Exec(`INSERT INTO comments (post_id, author_id, initial_comment, answer_to, data, has_replies) VALUES
+		(1, 1, -1, -1, 'корень', 1),
+		(1, 1, -1, 1, 'ответ', 1),
+		(1, 1, -1, 2, 'ответ на ответ', 0),
+		(1, 1, -1, 42, 'ответ удалённому', 0)`)
+	require.NoError(t, err)
+
+	require.NoError(t, goose.UpTo(conn, "../../migrations/sqlite3", 6))
+
+	paths := []string{}
+	rows, err := conn.Query(`SELECT path FROM comments ORDER BY path`)
+	require.NoError(t, err)
+	for rows.Next() {
+		var path string
+		require.NoError(t, rows.Scan(&path))
+		paths = append(paths, path)
+	}
+	require.NoError(t, rows.Close())
+	require.Equal(t, []string{"0000000001/", "0000000001/0000000002/", "0000000001/0000000002/0000000003/", "0000000004/"}, paths)
+
+	_, err = conn.Exec(`INSERT INTO comments (post_id, author_id, parent_id, data) VALUES (1, 1, 3, 'новый')`)
+	require.NoError(t, err)
+	var (
+		path  string
+		depth int
+	)
+	require.NoError(t, conn.QueryRow(`SELECT path, depth FROM comments WHERE id = 5`).Scan(&path, &depth))
+	require.Equal(t, commentPath("0000000001/0000000002/0000000003/", 5), path)
+	require.Equal(t, 3, depth)
+
+	require.NoError(t, goose.DownTo(conn, "../../migrations/sqlite3", 5))
+	var initialComment, answerTo, hasReplies int
+	require.NoError(t, conn.QueryRow(`SELECT initial_comment, answer_to, has_replies FROM comments WHERE id = 3`).Scan(&initialComment, &answerTo, &hasReplies))
+	require.Equal(t, 1, initialComment)
+	require.Equal(t, 2, answerTo)
+	require.Equal(t, 1, hasReplies)
+}
+
+func TestPurgeCutoffInOtherZone(t *testing.T) {
+	for name, storage := range map[string]Storage{"sqlite": newTestDB(t), "memory": NewMemory()} {
+		t.Run(name, func(t *testing.T) {
+			author := must(storage.CreateUser(context.Background(), &model.CreateUserInput{Name: "srgold78"}))
+			ctx := testContext(author.ID)
+			post := must(storage.CreatePost(ctx, &model.CreatePostInput{Data: "пост", Commentable: true}))
+			comment := must(storage.CreateComment(ctx, &model.CreateCommentInput{Text: "комментарий", Post: post.ID, AnswerTo: "-1"}))
+			must(storage.DeleteComment(ctx, comment.ID))
+
+			// an hour ago east of UTC reads as later than now when compared as text
+			before := time.Now().Add(-time.Hour).In(time.FixedZone("UTC+3", 3*60*60))
+			require.NoError(t, storage.Purge(ctx, before))
+			require.Equal(t, "комментарий", must(storage.RestoreComment(ctx, comment.ID)).Text)
+		})
+	}
+}
+
+func TestDeleteAndPurge(t *testing.T) {
+	db := newTestDB(t)
+	ctx := testContext("")
+	author := must(db.CreateUser(ctx, &model.CreateUserInput{Name: "srgold78"}))
+	replier := must(db.CreateUser(ctx, &model.CreateUserInput{Name: "srgold77"}))
+	authorCtx, replierCtx := testContext(author.ID), testContext(replier.ID)
+	post := must(db.CreatePost(authorCtx, &model.CreatePostInput{Data: "пост", Commentable: true}))
+	comment := must(db.CreateComment(authorCtx, &model.CreateCommentInput{Text: "комментарий", Post: post.ID, AnswerTo: "-1"}))
+	reply := must(db.CreateComment(replierCtx, &model.CreateCommentInput{Text: "ответ", Post: post.ID, AnswerTo: comment.ID}))
+
+	ctx = testContext(author.ID)
+	tombstone := must(db.DeleteComment(ctx, comment.ID))
+	require.Equal(t, "[deleted]", tombstone.Text)
+	require.True(t, tombstone.Deleted)
+	require.Equal(t, reply.ID, must(db.GetReplies(ctx, comment.ID, Page{})).Edges[0].Node.ID)
+	require.Equal(t, 1, must(db.GetComments(ctx, post.ID, Page{})).TotalCount)
+	_, err := db.UpdateComment(ctx, comment.ID, &model.UpdateCommentInput{Data: "правка"})
+	requireError(t, err, apperr.CodeNotFound, "comment with such id not found")
+
+	// a tombstone somebody replied to outlives the purge, it goes once the reply is gone too
+	require.NoError(t, db.Purge(ctx, time.Now().Add(time.Minute)))
+	var data string
+	require.NoError(t, db.Client.QueryRow("SELECT data FROM comments WHERE id = ?", comment.ID).Scan(&data))
+	require.Empty(t, data)
+	ctx = testContext(replier.ID)
+	must(db.DeleteComment(ctx, reply.ID))
+	require.Equal(t, 0, must(db.GetComments(ctx, post.ID, Page{})).TotalCount)
+	require.NoError(t, db.Purge(ctx, time.Now().Add(time.Minute)))
+	var count int
+	require.NoError(t, db.Client.QueryRow("SELECT COUNT(*) FROM comments").Scan(&count))
+	require.Equal(t, 0, count)
+
+	ctx = testContext(author.ID)
+	deleted := must(db.DeleteUser(ctx, author.ID))
+	require.Equal(t, "[deleted]", deleted.Name)
+	require.Equal(t, 0, must(db.GetPosts(ctx, Page{})).TotalCount)
+	require.True(t, must(db.GetPost(ctx, post.ID)).Deleted)
+	_, err = db.CreatePost(ctx, &model.CreatePostInput{Data: "пост", Commentable: true})
+	requireError(t, err, apperr.CodeUnauthenticated, "user with such id does not exist")
+
+	ctx = testContext(author.ID)
+	restored := must(db.RestoreUser(ctx, author.ID))
+	require.Equal(t, "srgold78", restored.Name)
+	require.Equal(t, "пост", must(db.GetPost(ctx, post.ID)).Data)
+
+	must(db.DeletePost(ctx, post.ID))
+	_, err = db.Client.Exec("UPDATE posts SET deleted_at = ?", time.Now().Add(-RestoreWindow-time.Hour).UTC())
+	require.NoError(t, err)
+	_, err = db.RestorePost(ctx, post.ID)
+	requireError(t, err, apperr.CodeValidation, "restore window has passed")
+	require.NoError(t, db.Purge(ctx, time.Now().Add(-RestoreWindow)))
+	require.NoError(t, db.Client.QueryRow("SELECT COUNT(*) FROM posts").Scan(&count))
+	require.Equal(t, 0, count)
+}
+
+func TestTouched(t *testing.T) {
+	client := auth.Client{IP: "127.0.0.1", UserAgent: "curl/8.0"}
+	now := time.Now()
+	require.True(t, touched(client, now.Add(-time.Second), client, now))
+	require.False(t, touched(client, now.Add(-touchInterval), client, now))
+	require.False(t, touched(client, now, auth.Client{IP: "10.0.0.1", UserAgent: "curl/8.0"}, now))
+	require.False(t, touched(client, now, auth.Client{IP: "127.0.0.1", UserAgent: "firefox"}, now))
+}
+
+func TestSessions(t *testing.T) {
+	for name, storage := range map[string]Storage{"sqlite": newTestDB(t), "memory": NewMemory()} {
+		t.Run(name, func(t *testing.T) {
+			ctx := testContext("")
+			owner := must(storage.CreateUser(ctx, &model.CreateUserInput{Name: "srgold78"}))
+			other := must(storage.CreateUser(ctx, &model.CreateUserInput{Name: "srgold77"}))
+			client := auth.Client{IP: "127.0.0.1", UserAgent: "curl/8.0"}
+			expiresAt := time.Now().Add(time.Hour)
+			first := must(storage.CreateSession(ctx, owner.ID, client, expiresAt))
+			second := must(storage.CreateSession(ctx, owner.ID, auth.Client{}, expiresAt))
+			expired := must(storage.CreateSession(ctx, owner.ID, auth.Client{}, time.Now().Add(-time.Hour)))
+			foreign := must(storage.CreateSession(ctx, other.ID, client, expiresAt))
+
+			current := auth.Principal{UserID: owner.ID, SessionID: first.ID}
+			require.NoError(t, storage.TouchSession(ctx, current, auth.Client{IP: "10.0.0.1", UserAgent: "firefox"}))
+			require.ErrorIs(t, storage.TouchSession(ctx, auth.Principal{UserID: owner.ID, SessionID: expired.ID}, client), auth.ErrSessionExpired)
+			require.ErrorIs(t, storage.TouchSession(ctx, auth.Principal{UserID: owner.ID, SessionID: foreign.ID}, client), auth.ErrSessionExpired)
+
+			ctx = auth.WithPrincipal(testContext(""), current)
+			sessions := must(storage.GetSessions(ctx))
+			require.Len(t, sessions, 2)
+			ids := []string{sessions[0].ID, sessions[1].ID}
+			require.ElementsMatch(t, []string{first.ID, second.ID}, ids)
+			for _, session := range sessions {
+				require.Equal(t, session.ID == first.ID, session.Current)
+				if session.Current {
+					require.Equal(t, "10.0.0.1", session.IP)
+					require.Equal(t, "firefox", session.UserAgent)
+				}
+			}
+
+			_, err := storage.RevokeSession(ctx, foreign.ID)
+			requireError(t, err, apperr.CodeForbidden, "can't revoke session of other users")
+
+			ctx = auth.WithPrincipal(testContext(""), current)
+			revoked := must(storage.RevokeSession(ctx, second.ID))
+			require.Equal(t, second.ID, revoked.ID)
+			require.ErrorIs(t, storage.TouchSession(ctx, auth.Principal{UserID: owner.ID, SessionID: second.ID}, client), auth.ErrSessionExpired)
+			_, err = storage.RevokeSession(ctx, second.ID)
+			requireError(t, err, apperr.CodeValidation, "session is already revoked")
+
+			ctx = auth.WithPrincipal(testContext(""), current)
+			must(storage.CreateSession(ctx, owner.ID, client, expiresAt))
+			require.Equal(t, 1, must(storage.RevokeAllSessions(ctx, true)))
+			require.NoError(t, storage.TouchSession(ctx, current, client))
+			require.Equal(t, 1, must(storage.RevokeAllSessions(ctx, false)))
+			require.ErrorIs(t, storage.TouchSession(ctx, current, client), auth.ErrSessionExpired)
+
+			require.NoError(t, storage.Purge(ctx, time.Now().Add(time.Minute)))
+			ctx = auth.WithPrincipal(testContext(""), auth.Principal{UserID: other.ID, SessionID: foreign.ID})
+			require.Len(t, must(storage.GetSessions(ctx)), 1)
+			_, err = storage.RevokeSession(ctx, first.ID)
+			requireError(t, err, apperr.CodeNotFound, "session with such id does not exist")
+		})
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	for name, storage := range map[string]Storage{"sqlite": newTestDB(t), "memory": NewMemory()} {
+		t.Run(name, func(t *testing.T) {
+			ctx := testContext("")
+			owner := must(storage.CreateUser(ctx, &model.CreateUserInput{Name: "srgold78"}))
+			other := must(storage.CreateUser(ctx, &model.CreateUserInput{Name: "srgold77"}))
+
+			ownerCtx := testContext(owner.ID)
+			key := must(storage.CreateAPIKey(ownerCtx, "release notes", []auth.Scope{auth.ScopePostsWrite}, "hash"))
+			require.Equal(t, []string{"posts:write"}, key.Scopes)
+			require.Nil(t, key.LastUsedAt)
+
+			principal, err := storage.TouchAPIKey(ctx, "hash")
+			require.NoError(t, err)
+			require.Equal(t, auth.Principal{UserID: owner.ID, APIKeyID: key.ID, Scopes: []auth.Scope{auth.ScopePostsWrite}}, principal)
+			_, err = storage.TouchAPIKey(ctx, "other hash")
+			require.ErrorIs(t, err, auth.ErrInvalidToken)
+
+			// the key is good for posts only and can't be used to manage the account
+			botCtx := auth.WithPrincipal(testContext(""), principal)
+			post := must(storage.CreatePost(botCtx, &model.CreatePostInput{Data: "релиз", Commentable: true}))
+			require.Equal(t, owner.ID, post.AuthorID)
+			_, err = storage.CreateComment(botCtx, &model.CreateCommentInput{Text: "ответ", Post: post.ID, AnswerTo: "-1"})
+			requireError(t, err, apperr.CodeForbidden, "api key doesn't have comments:write scope")
+			botCtx = auth.WithPrincipal(testContext(""), principal)
+			_, err = storage.CreateAPIKey(botCtx, "another", []auth.Scope{auth.ScopePostsWrite}, "another hash")
+			requireError(t, err, apperr.CodeForbidden, "api keys can't manage the account")
+			botCtx = auth.WithPrincipal(testContext(""), principal)
+			_, err = storage.GetAPIKeys(botCtx)
+			requireError(t, err, apperr.CodeForbidden, "api keys can't manage the account")
+			botCtx = auth.WithPrincipal(testContext(""), principal)
+			_, err = storage.GetSessions(botCtx)
+			requireError(t, err, apperr.CodeForbidden, "api keys can't manage the account")
+
+			keys := must(storage.GetAPIKeys(ownerCtx))
+			require.Len(t, keys, 1)
+			require.NotNil(t, keys[0].LastUsedAt)
+
+			otherCtx := testContext(other.ID)
+			_, err = storage.RevokeAPIKey(otherCtx, key.ID)
+			requireError(t, err, apperr.CodeForbidden, "can't revoke api key of other users")
+			must(storage.RevokeAPIKey(ownerCtx, key.ID))
+			require.Empty(t, must(storage.GetAPIKeys(ownerCtx)))
+			_, err = storage.TouchAPIKey(ctx, "hash")
+			require.ErrorIs(t, err, auth.ErrInvalidToken)
+			_, err = storage.RevokeAPIKey(ownerCtx, key.ID)
+			requireError(t, err, apperr.CodeNotFound, "api key with such id does not exist")
+		})
+	}
+}
+
+func TestEmailTokens(t *testing.T) {
+	for name, storage := range map[string]Storage{"sqlite": newTestDB(t), "memory": NewMemory()} {
+		t.Run(name, func(t *testing.T) {
+			ctx := testContext("")
+			email := "SrGold78@Example.com"
+			user := must(storage.Register(ctx, &model.RegisterInput{Name: "srgold78", Email: &email}, "old hash"))
+			require.True(t, must(storage.CreateEmailToken(ctx, email, auth.PurposeVerifyEmail, "pending", time.Now().Add(time.Hour))))
+			_, err := storage.CreateUser(ctx, &model.CreateUserInput{Name: "srgold77", Email: &email})
+			requireError(t, err, apperr.CodeValidation, "user with such email already exists")
+
+			ctx = testContext("")
+			require.False(t, must(storage.CreateEmailToken(ctx, "nobody@example.com", auth.PurposePasswordReset, "nobody", time.Now().Add(time.Hour))))
+			require.True(t, must(storage.CreateEmailToken(ctx, "srgold78@example.com", auth.PurposePasswordReset, "expired", time.Now().Add(-time.Hour))))
+			_, err = storage.ResetPassword(ctx, "expired", "new hash")
+			requireError(t, err, apperr.CodeValidation, "invalid or expired token")
+
+			ctx = testContext("")
+			require.True(t, must(storage.CreateEmailToken(ctx, "srgold78@example.com", auth.PurposePasswordReset, "replaced", time.Now().Add(time.Hour))))
+			require.True(t, must(storage.CreateEmailToken(ctx, "srgold78@example.com", auth.PurposePasswordReset, "reset", time.Now().Add(time.Hour))))
+			require.True(t, must(storage.CreateEmailToken(ctx, "srgold78@example.com", auth.PurposeVerifyEmail, "verify", time.Now().Add(time.Hour))))
+			_, err = storage.ResetPassword(ctx, "replaced", "new hash")
+			requireError(t, err, apperr.CodeValidation, "invalid or expired token")
+
+			ctx = testContext("")
+			session := must(storage.CreateSession(ctx, user.ID, auth.Client{}, time.Now().Add(time.Hour)))
+			_, err = storage.ResetPassword(ctx, "verify", "new hash")
+			requireError(t, err, apperr.CodeValidation, "invalid or expired token")
+			ctx = testContext("")
+			require.Equal(t, user.ID, must(storage.ResetPassword(ctx, "reset", "new hash")).ID)
+			_, hash, err := storage.GetCredentials(ctx, "srgold78")
+			require.NoError(t, err)
+			require.Equal(t, "new hash", hash)
+			require.ErrorIs(t, storage.TouchSession(ctx, auth.Principal{UserID: user.ID, SessionID: session.ID}, auth.Client{}), auth.ErrSessionExpired)
+			_, err = storage.ResetPassword(ctx, "reset", "newer hash")
+			requireError(t, err, apperr.CodeValidation, "invalid or expired token")
+
+			ctx = testContext("")
+			require.Equal(t, user.ID, must(storage.VerifyEmail(ctx, "verify")).ID)
+			_, err = storage.CreateUser(ctx, &model.CreateUserInput{Name: "srgold77", Email: &email})
+			requireError(t, err, apperr.CodeValidation, "user with such email already exists")
+
+			// an address nobody confirmed in time goes to the next one who gives it
+			other := "srgold76@example.com"
+			must(storage.CreateUser(ctx, &model.CreateUserInput{Name: "squatter", Email: &other}))
+			require.True(t, must(storage.CreateEmailToken(ctx, other, auth.PurposeVerifyEmail, "late", time.Now().Add(-time.Hour))))
+			owner := must(storage.Register(ctx, &model.RegisterInput{Name: "srgold76", Email: &other}, "hash"))
+			_, err = storage.VerifyEmail(ctx, "late")
+			require.Equal(t, auth.ErrInvalidEmailToken, err)
+			require.True(t, must(storage.CreateEmailToken(ctx, other, auth.PurposeVerifyEmail, "owner", time.Now().Add(time.Hour))))
+			require.Equal(t, owner.ID, must(storage.VerifyEmail(ctx, "owner")).ID)
+		})
+	}
+}
+
+func TestIdentityName(t *testing.T) {
+	for _, test := range []struct {
+		identity auth.Identity
+		name     string
+	}{
+		{auth.Identity{Name: "srgold78"}, "srgold78"},
+		{auth.Identity{Name: "Влад Младший"}, "Влад_Младший"},
+		{auth.Identity{Name: " (Влад) ", Email: "srgold78@example.com"}, "Влад"},
+		{auth.Identity{Name: "!!!", Email: "sr gold@example.com"}, "sr_gold"},
+		{auth.Identity{}, "user"},
+		{auth.Identity{Name: strings.Repeat("я", 40)}, strings.Repeat("я", 32)},
+	} {
+		require.Equal(t, test.name, identityName(test.identity, 32), test.identity.Name)
+	}
+}
+
+func TestLinkIdentity(t *testing.T) {
+	for name, storage := range map[string]Storage{"sqlite": newTestDB(t), "memory": NewMemory()} {
+		t.Run(name, func(t *testing.T) {
+			ctx := testContext("")
+			first := must(storage.LinkIdentity(ctx, auth.Identity{Issuer: "https://idp.example.com", Subject: "1", Name: "srgold78"}))
+			require.Equal(t, "srgold78", first.Name)
+			require.Equal(t, first.ID, must(storage.LinkIdentity(ctx, auth.Identity{Issuer: "https://idp.example.com", Subject: "1", Name: "renamed"})).ID)
+			require.NotEqual(t, first.ID, must(storage.LinkIdentity(ctx, auth.Identity{Issuer: "https://other.example.com", Subject: "1"})).ID)
+
+			email := "srgold77@example.com"
+			registered := must(storage.Register(ctx, &model.RegisterInput{Name: "srgold77", Email: &email}, "hash"))
+			// an address the provider didn't verify doesn't link accounts
+			unverified := must(storage.LinkIdentity(ctx, auth.Identity{Issuer: "https://idp.example.com", Subject: "2", Email: "SrGold77@example.com"}))
+			require.NotEqual(t, registered.ID, unverified.ID)
+			require.Equal(t, "SrGold77", unverified.Name)
+			// nor does an address the local user never verified, anyone could have registered it;
+			// the provider verified it, so the new user takes it
+			require.True(t, must(storage.CreateEmailToken(ctx, email, auth.PurposeVerifyEmail, "squatted", time.Now().Add(time.Hour))))
+			taken := must(storage.LinkIdentity(ctx, auth.Identity{Issuer: "https://idp.example.com", Subject: "3", Email: "SrGold77@example.com", EmailVerified: true}))
+			require.NotEqual(t, registered.ID, taken.ID)
+			_, err := storage.VerifyEmail(ctx, "squatted")
+			require.Equal(t, auth.ErrInvalidEmailToken, err)
+			require.True(t, must(storage.CreateEmailToken(ctx, email, auth.PurposePasswordReset, "owner", time.Now().Add(time.Hour))))
+			require.Equal(t, taken.ID, must(storage.ResetPassword(ctx, "owner", "hash")).ID)
+
+			owner := "srgold76@example.com"
+			local := must(storage.Register(ctx, &model.RegisterInput{Name: "srgold76", Email: &owner}, "hash"))
+			require.True(t, must(storage.CreateEmailToken(ctx, owner, auth.PurposeVerifyEmail, "verify", time.Now().Add(time.Hour))))
+			must(storage.VerifyEmail(ctx, "verify"))
+			verified := must(storage.LinkIdentity(ctx, auth.Identity{Issuer: "https://idp.example.com", Subject: "4", Email: "SrGold76@example.com", EmailVerified: true}))
+			require.Equal(t, local.ID, verified.ID)
+
+			ctx = testContext(first.ID)
+			must(storage.DeleteUser(ctx, first.ID))
+			_, err = storage.LinkIdentity(ctx, auth.Identity{Issuer: "https://idp.example.com", Subject: "1"})
+			requireError(t, err, apperr.CodeUnauthenticated, "user with such id does not exist")
+		})
+	}
+}
+
+// Storage checks roles the same way the directives of the schema do, so that nothing
+// calling it bypasses them.
+func TestRoles(t *testing.T) {
+	for name, storage := range map[string]Storage{"sqlite": newTestDB(t), "memory": NewMemory()} {
+		t.Run(name, func(t *testing.T) {
+			ctx := testContext("")
+			author := must(storage.CreateUser(ctx, &model.CreateUserInput{Name: "srgold78"}))
+			moderator := must(storage.CreateUser(ctx, &model.CreateUserInput{Name: "srgold77"}))
+			require.Equal(t, model.RoleUser, author.Role)
+
+			ctx = testContext(author.ID)
+			post := must(storage.CreatePost(ctx, &model.CreatePostInput{Data: "пост", Commentable: true}))
+			comment := must(storage.CreateComment(ctx, &model.CreateCommentInput{Text: "комментарий", Post: post.ID, AnswerTo: "-1"}))
+			_, err := storage.SetUserRole(ctx, moderator.ID, model.RoleModerator)
+			requireError(t, err, apperr.CodeForbidden, "admin role is required")
+			_, err = storage.HideComment(ctx, comment.ID, true)
+			requireError(t, err, apperr.CodeForbidden, "moderator role is required")
+			// nobody asks for the roles granted from the command line
+			require.Equal(t, model.RoleAdmin, must(storage.GrantRole(testContext(""), author.ID, model.RoleAdmin)).Role)
+			_, err = storage.GrantRole(testContext(""), author.ID, "OWNER")
+			requireError(t, err, apperr.CodeValidation, `unknown role "OWNER"`)
+
+			ctx = testContext(author.ID)
+			require.Equal(t, model.RoleModerator, must(storage.SetUserRole(ctx, moderator.ID, model.RoleModerator)).Role)
+			require.Equal(t, model.RoleModerator, must(storage.GetUser(ctx, moderator.ID)).Role)
+			_, err = storage.SetUserRole(ctx, author.ID, model.RoleUser)
+			requireError(t, err, apperr.CodeForbidden, "can't change own role")
+
+			ctx = testContext(moderator.ID)
+			_, err = storage.UpdatePost(ctx, post.ID, &model.UpdatePostInput{Data: "исправлено"})
+			requireError(t, err, apperr.CodeForbidden, "cant change post of other users")
+			ctx = testContext(moderator.ID)
+			hidden := must(storage.HideComment(ctx, comment.ID, true))
+			require.True(t, hidden.Hidden)
+			require.Equal(t, hiddenText, hidden.Text)
+			require.Equal(t, hiddenText, must(storage.GetComments(ctx, post.ID, Page{})).Edges[0].Node.Text)
+			_, err = storage.HideComment(ctx, comment.ID, true)
+			requireError(t, err, apperr.CodeValidation, "comment is already hidden")
+
+			ctx = testContext(moderator.ID)
+			shown := must(storage.HideComment(ctx, comment.ID, false))
+			require.False(t, shown.Hidden)
+			require.Equal(t, "комментарий", shown.Text)
+			_, err = storage.HideComment(ctx, comment.ID, false)
+			requireError(t, err, apperr.CodeValidation, "comment is not hidden")
+		})
+	}
+}
+
+func TestUnsetSettingsFallBackToDefaults(t *testing.T) {
+	db := newTestDB(t)
+	db.Limits, db.Timeouts = config.Limits{}, config.Timeouts{}
+	memory := NewMemory()
+	memory.Limits = config.Limits{}
+	for name, storage := range map[string]Storage{"sqlite": db, "memory": memory} {
+		t.Run(name, func(t *testing.T) {
+			author := must(storage.CreateUser(context.Background(), &model.CreateUserInput{Name: "author"}))
+			ctx := testContext(author.ID)
+			for range config.Default().Limits.PageSize + 1 {
+				must(storage.CreatePost(ctx, &model.CreatePostInput{Data: "post"}))
+			}
+			posts := must(storage.GetPosts(ctx, Page{}))
+			require.Len(t, posts.Edges, config.Default().Limits.PageSize)
+			require.True(t, posts.PageInfo.HasNextPage)
+		})
+	}
+}
+
+func TestTransact(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	countUsers := func() (count int) {
+		require.NoError(t, db.queryRow(ctx, "SELECT COUNT(*) FROM users").Scan(&count))
+		return count
+	}
+
+	err := db.transact(ctx, func(tx *DB) error {
+		must(tx.insert(ctx, "INSERT INTO users (name, about) VALUES ('rolled back', '')"))
+		return apperr.Invalid("changed my mind")
+	})
+	requireError(t, err, apperr.CodeValidation, "changed my mind")
+	require.Equal(t, 0, countUsers())
+
+	attempts := 0
+	err = db.transact(ctx, func(tx *DB) error {
+		attempts++
+		must(tx.insert(ctx, "INSERT INTO users (name, about) VALUES ('retried', '')"))
+		if attempts == 1 {
+			return tx.noted(sqlite3.Error{Code: sqlite3.ErrBusy})
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, attempts)
+	require.Equal(t, 1, countUsers())
+
+	attempts = 0
+	err = db.transact(ctx, func(tx *DB) error {
+		attempts++
+		// the driver error is hidden from transact, the noted one is enough to retry
+		tx.noted(&pq.Error{Code: "40001"})
+		return apperr.ErrInternal
+	})
+	require.Equal(t, apperr.ErrInternal, err)
+	require.Equal(t, txAttempts, attempts)
+
+	attempts = 0
+	err = db.transact(ctx, func(tx *DB) error {
+		attempts++
+		tx.noted(&pq.Error{Code: "23505"})
+		return apperr.ErrInternal
+	})
+	require.Equal(t, apperr.ErrInternal, err)
+	require.Equal(t, 1, attempts)
+
+	for attempt := 2; attempt <= txAttempts; attempt++ {
+		pause := backoff(attempt)
+		require.GreaterOrEqual(t, pause, minBackoff/2)
+		require.LessOrEqual(t, pause, maxBackoff)
+	}
+	require.LessOrEqual(t, backoff(2), minBackoff)
+	require.GreaterOrEqual(t, backoff(txAttempts), maxBackoff/2)
+}
+
+// TestConcurrentReplies makes serializable transactions of Postgres conflict when
+// TEST_STORAGE points to one, see newPostgresTestDB.
+func TestConcurrentReplies(t *testing.T) {
+	storages := map[string]*DB{"sqlite": newTestDB(t)}
+	if db := newPostgresTestDB(t); db != nil {
+		storages["postgres"] = db
+	}
+	for name, db := range storages {
+		t.Run(name, func(t *testing.T) {
+			author := must(db.CreateUser(context.Background(), &model.CreateUserInput{Name: "author"}))
+			ctx := testContext(author.ID)
+			post := must(db.CreatePost(ctx, &model.CreatePostInput{Data: "post", Commentable: true}))
+			root := must(db.CreateComment(ctx, &model.CreateCommentInput{Post: post.ID, Text: "root", AnswerTo: "-1"}))
+
+			const replies = 20
+			errs := make(chan error, replies)
+			for i := 0; i < replies; i++ {
+				go func() {
+					_, err := db.CreateComment(ctx, &model.CreateCommentInput{Post: post.ID, Text: "reply", AnswerTo: root.ID})
+					errs <- err
+				}()
+			}
+			for i := 0; i < replies; i++ {
+				require.NoError(t, <-errs)
+			}
+			got := must(db.GetReplies(ctx, root.ID, Page{}))
+			require.Equal(t, replies, got.TotalCount)
+		})
+	}
+}
+
+func TestMissingPostComments(t *testing.T) {
+	for name, storage := range map[string]Storage{"sqlite": newTestDB(t), "memory": NewMemory()} {
+		t.Run(name, func(t *testing.T) {
+			_, err := storage.GetComments(testContext(""), "42", Page{})
+			requireError(t, err, apperr.CodeNotFound, "post with such id not found")
+		})
+	}
+}
+
+func TestRepliesByIds(t *testing.T) {
+	for name, storage := range map[string]Storage{"sqlite": newTestDB(t), "memory": NewMemory()} {
+		t.Run(name, func(t *testing.T) {
+			author := must(storage.CreateUser(context.Background(), &model.CreateUserInput{Name: "author"}))
+			ctx := testContext(author.ID)
+			post := must(storage.CreatePost(ctx, &model.CreatePostInput{Data: "post", Commentable: true}))
+			first := must(storage.CreateComment(ctx, &model.CreateCommentInput{Post: post.ID, Text: "first", AnswerTo: "-1"}))
+			second := must(storage.CreateComment(ctx, &model.CreateCommentInput{Post: post.ID, Text: "second", AnswerTo: "-1"}))
+			var replies []string
+			for range 3 {
+				replies = append(replies, must(storage.CreateComment(ctx, &model.CreateCommentInput{Post: post.ID, Text: "reply", AnswerTo: first.ID})).ID)
+			}
+			only := must(storage.CreateComment(ctx, &model.CreateCommentInput{Post: post.ID, Text: "reply", AnswerTo: second.ID}))
+
+			ids := func(connection *model.CommentConnection) []string {
+				var ids []string
+				for _, edge := range connection.Edges {
+					ids = append(ids, edge.Node.ID)
+				}
+				return ids
+			}
+			two := 2
+			connections, errs := storage.GetRepliesByIds(ctx, []string{first.ID, second.ID, only.ID, "42", "abc"}, Page{First: &two})
+			require.NoError(t, errs[0])
+			require.Equal(t, replies[:2], ids(connections[0]))
+			require.Equal(t, 3, connections[0].TotalCount)
+			require.True(t, connections[0].PageInfo.HasNextPage)
+			require.NoError(t, errs[1])
+			require.Equal(t, []string{only.ID}, ids(connections[1]))
+			require.Equal(t, 1, connections[1].TotalCount)
+			require.False(t, connections[1].PageInfo.HasNextPage)
+			require.NoError(t, errs[2])
+			require.Empty(t, connections[2].Edges)
+			require.Equal(t, 0, connections[2].TotalCount)
+			requireError(t, errs[3], apperr.CodeNotFound, "comment with such id does not exist")
+			requireError(t, errs[4], apperr.CodeValidation, "wrong commentId provided")
+
+			after := connections[0].PageInfo.EndCursor
+			connections, errs = storage.GetRepliesByIds(ctx, []string{first.ID, second.ID}, Page{After: after})
+			require.NoError(t, errs[0])
+			require.Equal(t, replies[2:], ids(connections[0]))
+			require.NoError(t, errs[1])
+			require.Equal(t, []string{only.ID}, ids(connections[1]))
+
+			one := 1
+			connections, errs = storage.GetRepliesByIds(ctx, []string{first.ID}, Page{Last: &one})
+			require.NoError(t, errs[0])
+			require.Equal(t, replies[2:], ids(connections[0]))
+			require.True(t, connections[0].PageInfo.HasPreviousPage)
+		})
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	conn, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db")+"?_foreign_keys=on")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	db := &DB{Client: conn, Dialect: SQLite, Timeouts: config.Default().Timeouts}
+	ctx := context.Background()
+	provider := must(db.migrations())
+	_, latest, err := provider.GetVersions(ctx)
+	require.NoError(t, err)
+	version := func() int64 {
+		return must(provider.GetDBVersion(ctx))
+	}
+
+	require.NoError(t, db.Migrate(ctx, MigrateNone))
+	require.Equal(t, int64(0), version())
+	require.NoError(t, db.Migrate(ctx, "to:5"))
+	require.Equal(t, int64(5), version())
+	require.NoError(t, db.Migrate(ctx, MigrateStatus))
+	require.Equal(t, int64(5), version())
+	require.NoError(t, db.Migrate(ctx, ""))
+	require.Equal(t, latest, version())
+	require.NoError(t, db.Migrate(ctx, "TO:6"))
+	require.Equal(t, int64(6), version())
+	require.NoError(t, db.Migrate(ctx, MigrateUp))
+	require.NoError(t, db.Migrate(ctx, MigrateUp))
+	require.Equal(t, latest, version())
+
+	must(db.CreateUser(ctx, &model.CreateUserInput{Name: "gone after reset"}))
+	require.NoError(t, db.Migrate(ctx, MigrateReset))
+	require.Equal(t, latest, version())
+	var users int
+	require.NoError(t, db.queryRow(ctx, "SELECT COUNT(*) FROM users").Scan(&users))
+	require.Equal(t, 0, users)
+
+	for _, mode := range []string{"sideways", "to:", "to:five", "to:-1"} {
+		require.Error(t, db.Migrate(ctx, mode), mode)
+	}
+	require.Equal(t, latest, version())
+}
+
+func TestExportImport(t *testing.T) {
+	source, target := newTestDB(t), newTestDB(t)
+	ctx := testContext("")
+	email := "srgold78@example.com"
+	author := must(source.Register(ctx, &model.RegisterInput{Name: "srgold78", About: hostileStrings[1], Email: &email}, "hash"))
+	must(source.GrantRole(ctx, author.ID, model.RoleModerator))
+	gone := must(source.CreateUser(ctx, &model.CreateUserInput{Name: "gone"}))
+	ctx = testContext(author.ID)
+	post := must(source.CreatePost(ctx, &model.CreatePostInput{Data: hostileStrings[0], Commentable: true}))
+	root := must(source.CreateComment(ctx, &model.CreateCommentInput{Post: post.ID, Text: "root", AnswerTo: "-1"}))
+	reply := must(source.CreateComment(ctx, &model.CreateCommentInput{Post: post.ID, Text: "reply", AnswerTo: root.ID}))
+	nested := must(source.CreateComment(ctx, &model.CreateCommentInput{Post: post.ID, Text: "nested", AnswerTo: reply.ID}))
+	must(source.DeleteComment(ctx, reply.ID))
+	must(source.HideComment(ctx, nested.ID, true))
+	must(source.DeleteUser(testContext(gone.ID), gone.ID))
+
+	var exported bytes.Buffer
+	require.NoError(t, source.Export(ctx, &exported))
+	lines := strings.Split(strings.TrimSpace(exported.String()), "\n")
+	require.Len(t, lines, 7)
+	require.JSONEq(t, `{"type":"export","version":1}`, lines[0])
+	require.Contains(t, lines[1], `"email":"srgold78@example.com","password_hash":"hash"`)
+	require.Regexp(t, `"deleted_at":"\d{4}-\d\d-\d\dT\d\d:\d\d:\d\dZ"`, lines[2])
+	require.Contains(t, lines[3], `"commentable":true`)
+
+	require.NoError(t, target.Import(ctx, bytes.NewReader(exported.Bytes())))
+	var again bytes.Buffer
+	require.NoError(t, target.Export(ctx, &again))
+	require.Equal(t, exported.String(), again.String())
+	require.Equal(t, must(source.GetUser(ctx, author.ID)), must(target.GetUser(ctx, author.ID)))
+	require.Equal(t, must(source.GetThread(ctx, root.ID, nil, nil)), must(target.GetThread(ctx, root.ID, nil, nil)))
+	// new rows get ids after the imported ones
+	require.Equal(t, "3", must(target.CreateUser(ctx, &model.CreateUserInput{Name: "new"})).ID)
+
+	err := target.Import(ctx, bytes.NewReader(exported.Bytes()))
+	requireError(t, err, apperr.CodeValidation, "can't import into a database with users, it should be empty")
+	err = newTestDB(t).Import(ctx, strings.NewReader(`{"type":"user","id":1,"name":"no header","role":"user"}`))
+	requireError(t, err, apperr.CodeValidation, "line 1: expected the header of an export of version 1")
+	empty := newTestDB(t)
+	err = empty.Import(ctx, strings.NewReader(lines[0]+"\n"+lines[1]+"\n"+`{"type":"vote","id":1}`))
+	require.ErrorContains(t, err, `line 3: unknown record type "vote"`)
+	_, err = empty.GetUser(ctx, author.ID)
+	require.Equal(t, errUserNotFound, err)
+}
+
+// repack rewrites a backup with its manifest changed by edit.
+func repack(t *testing.T, backup []byte, edit func(*Manifest)) []byte {
+	compressed, err := gzip.NewReader(bytes.NewReader(backup))
+	require.NoError(t, err)
+	archive := tar.NewReader(compressed)
+	var out bytes.Buffer
+	recompressed := gzip.NewWriter(&out)
+	rewritten := tar.NewWriter(recompressed)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		content := must(io.ReadAll(archive))
+		if header.Name == manifestFile {
+			var manifest Manifest
+			require.NoError(t, json.Unmarshal(content, &manifest))
+			edit(&manifest)
+			content = must(json.Marshal(manifest))
+			header.Size = int64(len(content))
+		}
+		require.NoError(t, rewritten.WriteHeader(header))
+		must(rewritten.Write(content))
+	}
+	require.NoError(t, rewritten.Close())
+	require.NoError(t, recompressed.Close())
+	return out.Bytes()
+}
+
+func TestBackupRestore(t *testing.T) {
+	source, target := newTestDB(t), newTestDB(t)
+	ctx := testContext("")
+	author := must(source.CreateUser(ctx, &model.CreateUserInput{Name: "srgold78", About: hostileStrings[1]}))
+	ctx = testContext(author.ID)
+	post := must(source.CreatePost(ctx, &model.CreatePostInput{Data: hostileStrings[0], Commentable: true}))
+	root := must(source.CreateComment(ctx, &model.CreateCommentInput{Post: post.ID, Text: "root", AnswerTo: "-1"}))
+	must(source.CreateComment(ctx, &model.CreateCommentInput{Post: post.ID, Text: "reply", AnswerTo: root.ID}))
+	must(target.CreateUser(ctx, &model.CreateUserInput{Name: "replaced"}))
+
+	var backup bytes.Buffer
+	manifest := must(source.Backup(ctx, &backup))
+	require.Equal(t, SQLite, manifest.Dialect)
+	require.Equal(t, must(source.schemaVersion(ctx)), manifest.Schema)
+	require.Len(t, manifest.Files, 1)
+	require.Equal(t, sqliteFile, manifest.Files[0].Name)
+
+	restored := must(target.Restore(ctx, bytes.NewReader(backup.Bytes())))
+	require.Equal(t, manifest.Files, restored.Files)
+	require.Equal(t, must(source.GetUser(ctx, author.ID)), must(target.GetUser(ctx, author.ID)))
+	require.Equal(t, must(source.GetThread(ctx, root.ID, nil, nil)), must(target.GetThread(ctx, root.ID, nil, nil)))
+	// the restored database keeps working
+	must(target.CreateComment(ctx, &model.CreateCommentInput{Post: post.ID, Text: "after", AnswerTo: root.ID}))
+
+	tampered := repack(t, backup.Bytes(), func(m *Manifest) { m.Files[0].SHA256 = strings.Repeat("0", 64) })
+	_, err := newTestDB(t).Restore(ctx, bytes.NewReader(tampered))
+	requireError(t, err, apperr.CodeValidation, `checksum of "database.sqlite3" doesn't match the manifest`)
+	escaping := repack(t, backup.Bytes(), func(m *Manifest) { m.Files[0].Name = "../../escaped.sqlite3" })
+	_, err = newTestDB(t).Restore(ctx, bytes.NewReader(escaping))
+	requireError(t, err, apperr.CodeValidation, `unexpected file "../../escaped.sqlite3" in the backup`)
+	postgres := repack(t, backup.Bytes(), func(m *Manifest) { m.Dialect = Postgres })
+	_, err = newTestDB(t).Restore(ctx, bytes.NewReader(postgres))
+	requireError(t, err, apperr.CodeValidation, "backup of postgres can't be restored into sqlite3")
+	newer := repack(t, backup.Bytes(), func(m *Manifest) { m.Schema = 1000 })
+	_, err = newTestDB(t).Restore(ctx, bytes.NewReader(newer))
+	requireError(t, err, apperr.CodeValidation, "backup of schema version 1000 is newer than the migrations of this build")
+	_, err = newTestDB(t).Restore(ctx, strings.NewReader("{\"type\":\"export\",\"version\":1}"))
+	requireError(t, err, apperr.CodeValidation, "not a backup or a damaged one")
+}
@@ -0,0 +1,361 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/idkwhyureadthis/ozon-task/graph/model"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/apperr"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/auth"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/isnumber"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/policy"
+)
+
+// Deleted rows are kept with deleted_at set and read back as tombstones holding deletedText,
+// so threads under a deleted comment stay reachable. They can be restored during
+// RestoreWindow, after it Purge removes them for good. Deleting a user or a post deletes
+// their posts and comments with the same deleted_at, which lets restoring bring back exactly them.
+const (
+	deletedText   = "[deleted]"
+	RestoreWindow = 7 * 24 * time.Hour
+)
+
+// visibleComment is the condition for comments shown in lists: deleted ones stay as
+// tombstones only while there are comments left in their subtree. visibleReply is
+// the same condition for comments aliased as replies.
+const (
+	visibleComment = "(deleted_at IS NULL OR EXISTS (SELECT 1 FROM comments nested WHERE nested.deleted_at IS NULL " +
+		"AND nested.path > comments.path AND nested.path < comments.path || '" + pathEnd + "'))"
+	visibleReply = "(replies.deleted_at IS NULL OR EXISTS (SELECT 1 FROM comments nested WHERE nested.deleted_at IS NULL " +
+		"AND nested.path > replies.path AND nested.path < replies.path || '" + pathEnd + "'))"
+)
+
+// deletionTime is stored in deleted_at. Whole seconds in UTC keep it the same after
+// a round trip through SQLite, which stores it as text.
+func deletionTime() time.Time {
+	return time.Now().UTC().Truncate(time.Second)
+}
+
+// restorable checks that a row deleted at deletedAt is still in its restore window.
+func restorable(deletedAt time.Time, notDeleted string) error {
+	if deletedAt.IsZero() {
+		return apperr.Invalid("%s", notDeleted)
+	}
+	if deletedAt.Before(time.Now().Add(-RestoreWindow)) {
+		return apperr.Invalid("restore window has passed")
+	}
+	return nil
+}
+
+type statement struct {
+	query string
+	args  []any
+}
+
+// execAll runs statements one by one and stops at the first failing.
+func (db *DB) execAll(ctx context.Context, statements ...statement) error {
+	for _, statement := range statements {
+		if _, err := db.exec(ctx, statement.query, statement.args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *DB) DeleteUser(ctx context.Context, id string) (*model.User, error) {
+	actor, err := db.authorizedUser(ctx, auth.ScopeAccount)
+	if err != nil {
+		return nil, err
+	}
+	rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().LongQuery)
+	defer cancel()
+	var userId string
+	err = db.transact(rqCtx, func(tx *DB) error {
+		user, err := tx.GetUser(rqCtx, id)
+		if err != nil {
+			return err
+		}
+		if user.Deleted {
+			return errUserNotFound
+		}
+		if err := policy.Check(actor, policy.DeleteUser, user.ID); err != nil {
+			return err
+		}
+		userId = user.ID
+		deletedAt := deletionTime()
+		err = tx.execAll(rqCtx,
+			statement{"UPDATE comments SET deleted_at = ? WHERE deleted_at IS NULL AND (author_id = ? OR post_id IN (SELECT id FROM posts WHERE author_id = ?))",
+				[]any{deletedAt, user.ID, user.ID}},
+			statement{"UPDATE posts SET deleted_at = ? WHERE deleted_at IS NULL AND author_id = ?", []any{deletedAt, user.ID}},
+			statement{"UPDATE users SET deleted_at = ? WHERE id = ?", []any{deletedAt, user.ID}},
+		)
+		if err != nil {
+			log.Println("failed to delete user", err)
+			return apperr.ErrInternal
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return db.GetUser(ctx, userId)
+}
+
+// checkRestoreUser lets deleted users restore their own account only, and the policy decide the rest.
+func checkRestoreUser(actor *model.User, userId string) error {
+	if actor.Deleted && actor.ID != userId {
+		return errDeletedActor
+	}
+	return policy.Check(actor, policy.RestoreUser, userId)
+}
+
+func (db *DB) RestoreUser(ctx context.Context, id string) (*model.User, error) {
+	// deleted users restore themselves, so authorizedUser would turn them away
+	actor, err := db.actor(ctx, auth.ScopeAccount)
+	if err != nil {
+		return nil, err
+	}
+	var userId string
+	rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().LongQuery)
+	defer cancel()
+	err = db.transact(rqCtx, func(tx *DB) error {
+		var deletedAt sql.NullTime
+		err := tx.queryRow(rqCtx, "SELECT id, deleted_at FROM users WHERE id = ?", isnumber.TryConvertToInt(id)).Scan(&userId, &deletedAt)
+		if err == sql.ErrNoRows {
+			return errUserNotFound
+		}
+		if err != nil {
+			log.Println("failed to get user", err)
+			return apperr.ErrInternal
+		}
+		if err := checkRestoreUser(actor, userId); err != nil {
+			return err
+		}
+		if err := restorable(deletedAt.Time, "user is not deleted"); err != nil {
+			return err
+		}
+		err = tx.execAll(rqCtx,
+			statement{"UPDATE comments SET deleted_at = NULL WHERE deleted_at = ? AND (author_id = ? OR post_id IN (SELECT id FROM posts WHERE author_id = ?))",
+				[]any{deletedAt.Time, userId, userId}},
+			statement{"UPDATE posts SET deleted_at = NULL WHERE deleted_at = ? AND author_id = ?", []any{deletedAt.Time, userId}},
+			statement{"UPDATE users SET deleted_at = NULL WHERE id = ?", []any{userId}},
+		)
+		if err != nil {
+			log.Println("failed to restore user", err)
+			return apperr.ErrInternal
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return db.GetUser(ctx, userId)
+}
+
+func (db *DB) DeletePost(ctx context.Context, id string) (*model.Post, error) {
+	actor, err := db.authorizedUser(ctx, auth.ScopePostsWrite)
+	if err != nil {
+		return nil, err
+	}
+	rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().LongQuery)
+	defer cancel()
+	postId := isnumber.TryConvertToInt(id)
+	err = db.transact(rqCtx, func(tx *DB) error {
+		var authorId string
+		err := tx.queryRow(rqCtx, "SELECT author_id FROM posts WHERE id = ? AND deleted_at IS NULL", postId).Scan(&authorId)
+		if err == sql.ErrNoRows {
+			return errPostNotFound
+		}
+		if err != nil {
+			log.Println("error occurred while scanning author", err)
+			return apperr.ErrInternal
+		}
+		if err := policy.Check(actor, policy.DeletePost, authorId); err != nil {
+			return err
+		}
+		deletedAt := deletionTime()
+		err = tx.execAll(rqCtx,
+			statement{"UPDATE comments SET deleted_at = ? WHERE deleted_at IS NULL AND post_id = ?", []any{deletedAt, postId}},
+			statement{"UPDATE posts SET deleted_at = ? WHERE id = ?", []any{deletedAt, postId}},
+		)
+		if err != nil {
+			log.Println("failed to delete post", err)
+			return apperr.ErrInternal
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return db.GetPost(ctx, id)
+}
+
+func (db *DB) RestorePost(ctx context.Context, id string) (*model.Post, error) {
+	actor, err := db.authorizedUser(ctx, auth.ScopePostsWrite)
+	if err != nil {
+		return nil, err
+	}
+	rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().LongQuery)
+	defer cancel()
+	postId := isnumber.TryConvertToInt(id)
+	err = db.transact(rqCtx, func(tx *DB) error {
+		var (
+			authorId  string
+			deletedAt sql.NullTime
+		)
+		err := tx.queryRow(rqCtx, "SELECT author_id, deleted_at FROM posts WHERE id = ?", postId).Scan(&authorId, &deletedAt)
+		if err == sql.ErrNoRows {
+			return errPostNotFound
+		}
+		if err != nil {
+			log.Println("error occurred while scanning author", err)
+			return apperr.ErrInternal
+		}
+		if err := policy.Check(actor, policy.RestorePost, authorId); err != nil {
+			return err
+		}
+		if err := restorable(deletedAt.Time, "post is not deleted"); err != nil {
+			return err
+		}
+		err = tx.execAll(rqCtx,
+			statement{"UPDATE comments SET deleted_at = NULL WHERE deleted_at = ? AND post_id = ?", []any{deletedAt.Time, postId}},
+			statement{"UPDATE posts SET deleted_at = NULL WHERE id = ?", []any{postId}},
+		)
+		if err != nil {
+			log.Println("failed to restore post", err)
+			return apperr.ErrInternal
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return db.GetPost(ctx, id)
+}
+
+func (db *DB) DeleteComment(ctx context.Context, commId string) (*model.Comment, error) {
+	actor, err := db.authorizedUser(ctx, auth.ScopeCommentsWrite)
+	if err != nil {
+		return nil, err
+	}
+	rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().LongQuery)
+	defer cancel()
+	commentId := isnumber.TryConvertToInt(commId)
+	err = db.transact(rqCtx, func(tx *DB) error {
+		var authorId string
+		err := tx.queryRow(rqCtx, "SELECT author_id FROM comments WHERE id = ? AND deleted_at IS NULL", commentId).Scan(&authorId)
+		if err == sql.ErrNoRows {
+			return apperr.NotFound("comment with such id not found")
+		}
+		if err != nil {
+			log.Println("error occurred scanning DB", err)
+			return apperr.ErrInternal
+		}
+		if err := policy.Check(actor, policy.DeleteComment, authorId); err != nil {
+			return err
+		}
+		_, err = tx.exec(rqCtx, "UPDATE comments SET deleted_at = ? WHERE id = ?", deletionTime(), commentId)
+		if err != nil {
+			log.Println("failed to delete comment", err)
+			return apperr.ErrInternal
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return db.GetComment(ctx, commId)
+}
+
+func (db *DB) RestoreComment(ctx context.Context, commId string) (*model.Comment, error) {
+	actor, err := db.authorizedUser(ctx, auth.ScopeCommentsWrite)
+	if err != nil {
+		return nil, err
+	}
+	rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().LongQuery)
+	defer cancel()
+	commentId := isnumber.TryConvertToInt(commId)
+	err = db.transact(rqCtx, func(tx *DB) error {
+		var (
+			authorId    string
+			deletedAt   sql.NullTime
+			postDeleted bool
+		)
+		err := tx.queryRow(rqCtx, `
+		SELECT comments.author_id, comments.deleted_at, posts.deleted_at IS NOT NULL
+		FROM comments JOIN posts ON posts.id = comments.post_id WHERE comments.id = ?`, commentId).Scan(&authorId, &deletedAt, &postDeleted)
+		if err == sql.ErrNoRows {
+			return apperr.NotFound("comment with such id not found")
+		}
+		if err != nil {
+			log.Println("error occurred scanning DB", err)
+			return apperr.ErrInternal
+		}
+		if err := policy.Check(actor, policy.RestoreComment, authorId); err != nil {
+			return err
+		}
+		if postDeleted {
+			return errPostNotFound
+		}
+		if err := restorable(deletedAt.Time, "comment is not deleted"); err != nil {
+			return err
+		}
+		_, err = tx.exec(rqCtx, "UPDATE comments SET deleted_at = NULL WHERE id = ?", commentId)
+		if err != nil {
+			log.Println("failed to restore comment", err)
+			return apperr.ErrInternal
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return db.GetComment(ctx, commId)
+}
+
+// Purge removes rows deleted before the given time. Comments somebody replied to and
+// authors of such comments can't go away, they stay as tombstones with their content erased.
+func (db *DB) Purge(ctx context.Context, before time.Time) error {
+	// SQLite compares timestamps as text, before has to look like the stored ones
+	before = timestamp(before)
+	return db.transact(ctx, func(tx *DB) error {
+		return tx.purge(ctx, before)
+	})
+}
+
+func (db *DB) purge(ctx context.Context, before time.Time) error {
+	err := db.execAll(ctx,
+		statement{"DELETE FROM comments WHERE post_id IN (SELECT id FROM posts WHERE deleted_at < ?)", []any{before}},
+		statement{"DELETE FROM posts WHERE deleted_at < ?", []any{before}},
+	)
+	if err != nil {
+		return err
+	}
+	// every pass removes deleted leaves of threads, which makes their deleted parents leaves
+	for {
+		res, err := db.exec(ctx, `
+		DELETE FROM comments WHERE deleted_at < ?
+			AND NOT EXISTS (SELECT 1 FROM comments replies WHERE replies.parent_id = comments.id)`, before)
+		if err != nil {
+			return err
+		}
+		if purged, err := res.RowsAffected(); err != nil || purged == 0 {
+			break
+		}
+	}
+	return db.execAll(ctx,
+		statement{"UPDATE comments SET data = '' WHERE deleted_at < ?", []any{before}},
+		statement{"DELETE FROM sessions WHERE revoked_at < ? OR expires_at < ? OR user_id IN (SELECT id FROM users WHERE deleted_at < ?)",
+			[]any{before, before, before}},
+		statement{"DELETE FROM api_keys WHERE revoked_at < ? OR user_id IN (SELECT id FROM users WHERE deleted_at < ?)", []any{before, before}},
+		statement{`
+		DELETE FROM users WHERE deleted_at < ?
+			AND NOT EXISTS (SELECT 1 FROM posts WHERE posts.author_id = users.id)
+			AND NOT EXISTS (SELECT 1 FROM comments WHERE comments.author_id = users.id)`, []any{before}},
+		statement{"DELETE FROM email_tokens WHERE expires_at < ? OR used_at < ?", []any{before, before}},
+		statement{"DELETE FROM identities WHERE user_id IN (SELECT id FROM users WHERE deleted_at < ?)", []any{before}},
+		statement{"UPDATE users SET name = '', about = '', password_hash = NULL, email = NULL, email_verified_at = NULL WHERE deleted_at < ?", []any{before}},
+	)
+}
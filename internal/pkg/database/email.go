@@ -0,0 +1,205 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/idkwhyureadthis/ozon-task/graph/model"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/apperr"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/auth"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/isnumber"
+)
+
+var errEmailTaken = apperr.Invalid("user with such email already exists")
+
+// inputEmail normalizes the optional email of CreateUserInput and RegisterInput.
+func inputEmail(email *string) (sql.NullString, error) {
+	if email == nil {
+		return sql.NullString{}, nil
+	}
+	normalized, err := auth.NormalizeEmail(*email)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: normalized, Valid: true}, nil
+}
+
+// claimEmail fails if another user holds email, which users_email_idx wouldn't let in.
+// An unverified address is only held while the token sent to confirm it is valid, after
+// that it is released to the caller: whoever gave someone else's address can't keep its
+// owner out, and of everyone who gave it the one who confirms it first keeps it.
+func (db *DB) claimEmail(ctx context.Context, email sql.NullString) error {
+	if !email.Valid {
+		return nil
+	}
+	var (
+		userId string
+		held   bool
+	)
+	err := db.queryRow(ctx, "SELECT id, email_verified_at IS NOT NULL OR EXISTS (SELECT 1 FROM email_tokens "+
+		"WHERE email_tokens.user_id = users.id AND purpose = ? AND used_at IS NULL AND expires_at > ?) FROM users WHERE email = ?",
+		auth.PurposeVerifyEmail, timestamp(time.Now()), email).Scan(&userId, &held)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil
+	case err != nil:
+		log.Println("failed to check email:", err)
+		return apperr.ErrInternal
+	case held:
+		return errEmailTaken
+	}
+	return db.releaseEmail(ctx, userId)
+}
+
+// releaseEmail takes the unverified address away from the user with userId, along with the
+// tokens sent to it, so that someone who proved they own it can have it.
+func (db *DB) releaseEmail(ctx context.Context, userId string) error {
+	err := db.execAll(ctx,
+		statement{"UPDATE users SET email = NULL WHERE id = ? AND email_verified_at IS NULL", []any{userId}},
+		statement{"UPDATE email_tokens SET used_at = ? WHERE user_id = ? AND used_at IS NULL", []any{timestamp(time.Now()), userId}},
+	)
+	if err != nil {
+		log.Println("failed to release email:", err)
+		return apperr.ErrInternal
+	}
+	return nil
+}
+
+func (db *DB) CreateEmailToken(ctx context.Context, email string, purpose auth.TokenPurpose, tokenHash string, expiresAt time.Time) (bool, error) {
+	normalized, err := auth.NormalizeEmail(email)
+	if err != nil {
+		return false, nil
+	}
+	rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().Query)
+	defer cancel()
+	var found bool
+	err = db.transact(rqCtx, func(tx *DB) error {
+		var userId string
+		err := tx.queryRow(rqCtx, "SELECT id FROM users WHERE email = ? AND deleted_at IS NULL", normalized).Scan(&userId)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			log.Println("failed to get user by email:", err)
+			return apperr.ErrInternal
+		}
+		now := timestamp(time.Now())
+		// a new token replaces the ones sent before it
+		err = tx.execAll(rqCtx,
+			statement{"UPDATE email_tokens SET used_at = ? WHERE user_id = ? AND purpose = ? AND used_at IS NULL", []any{now, userId, purpose}},
+			statement{"INSERT INTO email_tokens (user_id, purpose, token_hash, expires_at) VALUES (?, ?, ?, ?)", []any{userId, purpose, tokenHash, timestamp(expiresAt)}},
+		)
+		if err != nil {
+			log.Println("failed to create email token:", err)
+			return apperr.ErrInternal
+		}
+		found = true
+		return nil
+	})
+	return found, err
+}
+
+// findEmailToken returns the ids of an unused and unexpired token with tokenHash and of its user.
+func (db *DB) findEmailToken(ctx context.Context, purpose auth.TokenPurpose, tokenHash string) (string, string, error) {
+	var id, userId string
+	err := db.queryRow(ctx, "SELECT id, user_id FROM email_tokens WHERE token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?",
+		tokenHash, purpose, timestamp(time.Now())).Scan(&id, &userId)
+	if err == sql.ErrNoRows {
+		return "", "", auth.ErrInvalidEmailToken
+	}
+	if err != nil {
+		log.Println("failed to get email token:", err)
+		return "", "", apperr.ErrInternal
+	}
+	return id, userId, nil
+}
+
+// useEmailToken marks the token with id used, it fails if a concurrent request did it first.
+func (db *DB) useEmailToken(ctx context.Context, id string) error {
+	res, err := db.exec(ctx, "UPDATE email_tokens SET used_at = ? WHERE id = ? AND used_at IS NULL", timestamp(time.Now()), isnumber.TryConvertToInt(id))
+	if err != nil {
+		log.Println("failed to use email token:", err)
+		return apperr.ErrInternal
+	}
+	if used, err := res.RowsAffected(); err != nil || used == 0 {
+		return auth.ErrInvalidEmailToken
+	}
+	return nil
+}
+
+func (db *DB) ResetPassword(ctx context.Context, tokenHash string, passwordHash string) (*model.User, error) {
+	rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().Query)
+	defer cancel()
+	var userId string
+	err := db.transact(rqCtx, func(tx *DB) error {
+		var (
+			id  string
+			err error
+		)
+		id, userId, err = tx.findEmailToken(rqCtx, auth.PurposePasswordReset, tokenHash)
+		if err != nil {
+			return err
+		}
+		// users created without a password may share their name with a registered one
+		var taken bool
+		err = tx.queryRow(rqCtx, "SELECT EXISTS (SELECT 1 FROM users WHERE password_hash IS NOT NULL AND id <> ? "+
+			"AND name = (SELECT name FROM users WHERE id = ?))", userId, userId).Scan(&taken)
+		if err != nil {
+			log.Println("failed to check user name:", err)
+			return apperr.ErrInternal
+		}
+		if taken {
+			return apperr.Invalid("user with such name already exists")
+		}
+		if err := tx.useEmailToken(rqCtx, id); err != nil {
+			return err
+		}
+		// the mail got through, so the address is verified as well, and whoever
+		// knew the old password is logged out
+		now := timestamp(time.Now())
+		err = tx.execAll(rqCtx,
+			statement{"UPDATE users SET password_hash = ?, email_verified_at = COALESCE(email_verified_at, ?) WHERE id = ?", []any{passwordHash, now, userId}},
+			statement{"UPDATE sessions SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL", []any{now, userId}},
+		)
+		if err != nil {
+			log.Println("failed to reset password:", err)
+			return apperr.ErrInternal
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return db.GetUser(ctx, userId)
+}
+
+func (db *DB) VerifyEmail(ctx context.Context, tokenHash string) (*model.User, error) {
+	rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().Query)
+	defer cancel()
+	var userId string
+	err := db.transact(rqCtx, func(tx *DB) error {
+		var (
+			id  string
+			err error
+		)
+		id, userId, err = tx.findEmailToken(rqCtx, auth.PurposeVerifyEmail, tokenHash)
+		if err != nil {
+			return err
+		}
+		if err := tx.useEmailToken(rqCtx, id); err != nil {
+			return err
+		}
+		_, err = tx.exec(rqCtx, "UPDATE users SET email_verified_at = COALESCE(email_verified_at, ?) WHERE id = ?", timestamp(time.Now()), userId)
+		if err != nil {
+			log.Println("failed to verify email:", err)
+			return apperr.ErrInternal
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return db.GetUser(ctx, userId)
+}
@@ -0,0 +1,128 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/idkwhyureadthis/ozon-task/graph/model"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/apperr"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/auth"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/cropstrings"
+)
+
+// notInName matches what the @pattern of user names in the schema doesn't let in.
+var notInName = regexp.MustCompile(`[^\p{L}\p{N}_.-]+`)
+
+// identityName picks the name a user created from identity gets. Names taken from identity
+// providers aren't validated by the schema, so spaces and the like are replaced with
+// underscores and the name is cropped to maxLength: it looks like any other name, and the
+// user can log in with it and be found by it.
+func identityName(identity auth.Identity, maxLength int) string {
+	clean := func(name string) string {
+		return strings.Trim(notInName.ReplaceAllString(name, "_"), "_")
+	}
+	name := clean(identity.Name)
+	if name == "" {
+		local, _, _ := strings.Cut(identity.Email, "@")
+		name = clean(local)
+	}
+	if name == "" {
+		name = "user"
+	}
+	return cropstrings.CropToLength(name, maxLength)
+}
+
+// identityEmail returns the address of identity if the provider verified it.
+func identityEmail(identity auth.Identity) sql.NullString {
+	if !identity.EmailVerified {
+		return sql.NullString{}
+	}
+	email, err := auth.NormalizeEmail(identity.Email)
+	if err != nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: email, Valid: true}
+}
+
+func (db *DB) LinkIdentity(ctx context.Context, identity auth.Identity) (*model.User, error) {
+	rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().Query)
+	defer cancel()
+	var userId string
+	// the user an identity gets is created in the same transaction the identity is linked in,
+	// so that a failed link leaves no user behind
+	err := db.transact(rqCtx, func(tx *DB) error {
+		err := tx.queryRow(rqCtx, "SELECT user_id FROM identities WHERE issuer = ? AND subject = ?", identity.Issuer, identity.Subject).Scan(&userId)
+		if err != nil && err != sql.ErrNoRows {
+			log.Println("failed to get identity:", err)
+			return apperr.ErrInternal
+		}
+		if err == sql.ErrNoRows {
+			if userId, err = tx.identityUser(rqCtx, identity); err != nil {
+				return err
+			}
+			_, err = tx.exec(rqCtx, "INSERT INTO identities (user_id, issuer, subject, created_at) VALUES (?, ?, ?, ?)",
+				userId, identity.Issuer, identity.Subject, timestamp(time.Now()))
+			if err != nil {
+				log.Println("failed to link identity:", err)
+				return apperr.ErrInternal
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	user, err := db.GetUser(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	if user.Deleted {
+		return nil, errDeletedActor
+	}
+	return user, nil
+}
+
+// identityUser returns the id of the user a new identity is linked to: the one with the same
+// verified address or a new one. The provider verified the address, so an unverified one of a
+// local user is taken from them: anyone could have registered it.
+func (db *DB) identityUser(ctx context.Context, identity auth.Identity) (string, error) {
+	email := identityEmail(identity)
+	if email.Valid {
+		var (
+			userId            string
+			deleted, verified bool
+		)
+		err := db.queryRow(ctx, "SELECT id, deleted_at IS NOT NULL, email_verified_at IS NOT NULL FROM users WHERE email = ?", email).
+			Scan(&userId, &deleted, &verified)
+		switch {
+		case err == nil && !deleted && verified:
+			return userId, nil
+		case err == nil && !deleted:
+			if err := db.releaseEmail(ctx, userId); err != nil {
+				return "", err
+			}
+		case err == nil:
+			// the address belongs to a deleted user until the purge
+			email = sql.NullString{}
+		case err != sql.ErrNoRows:
+			log.Println("failed to get user by email:", err)
+			return "", apperr.ErrInternal
+		}
+	}
+	var verifiedAt sql.NullTime
+	if email.Valid {
+		verifiedAt = sql.NullTime{Time: timestamp(time.Now()), Valid: true}
+	}
+	lastInsertId, err := db.insert(ctx, "INSERT INTO users (name, about, email, email_verified_at) VALUES (?, '', ?, ?)",
+		identityName(identity, db.limits().NameLength), email, verifiedAt)
+	if err != nil {
+		log.Println("failed to create user:", err)
+		return "", apperr.ErrInternal
+	}
+	return fmt.Sprint(lastInsertId), nil
+}
@@ -0,0 +1,1353 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/idkwhyureadthis/ozon-task/graph/model"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/apperr"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/auth"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/config"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/isnumber"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/policy"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/pubsub"
+)
+
+// Rows of Memory are never taken out of the slices since ids are their positions,
+// deleted rows get deletedAt and purged ones are skipped as if they were gone.
+type memoryUser struct {
+	id              int
+	name            string
+	about           string
+	passwordHash    string
+	email           string
+	emailVerifiedAt time.Time
+	role            model.Role
+	deletedAt       time.Time
+	purged          bool
+}
+
+type memoryPost struct {
+	id          int
+	data        string
+	authorId    int
+	commentable bool
+	deletedAt   time.Time
+	purged      bool
+}
+
+type memoryComment struct {
+	id        int
+	postId    int
+	authorId  int
+	answerTo  int
+	path      string
+	data      string
+	hiddenAt  time.Time
+	deletedAt time.Time
+	purged    bool
+}
+
+type memorySession struct {
+	id         int
+	userId     int
+	createdAt  time.Time
+	lastSeenAt time.Time
+	expiresAt  time.Time
+	client     auth.Client
+	revokedAt  time.Time
+	purged     bool
+}
+
+type memoryAPIKey struct {
+	id         int
+	userId     int
+	name       string
+	keyHash    string
+	scopes     []auth.Scope
+	createdAt  time.Time
+	lastUsedAt time.Time
+	revokedAt  time.Time
+	purged     bool
+}
+
+type memoryEmailToken struct {
+	id        int
+	userId    int
+	purpose   auth.TokenPurpose
+	tokenHash string
+	expiresAt time.Time
+	usedAt    time.Time
+	purged    bool
+}
+
+type memoryIdentity struct {
+	userId  int
+	issuer  string
+	subject string
+}
+
+// Memory is a Storage kept in process memory. Ids are positions in the slices plus one,
+// the same way SERIAL columns hand them out.
+type Memory struct {
+	mu       sync.RWMutex
+	users    []memoryUser
+	posts    []memoryPost
+	comments []memoryComment
+	// replyIds indexes the ids of comments by the id of the comment they answer, so that
+	// walking a thread doesn't scan every comment at each step.
+	replyIds   map[int][]int
+	sessions   []memorySession
+	apiKeys    []memoryAPIKey
+	tokens     []memoryEmailToken
+	identities []memoryIdentity
+	Events     *pubsub.Broker
+	Limits     config.Limits
+}
+
+// NewMemory returns an empty Memory with the default limits.
+func NewMemory() *Memory {
+	return &Memory{
+		Events: pubsub.New(subscriberBufferSize),
+		Limits: config.Default().Limits,
+	}
+}
+
+// limits mirrors DB.limits.
+func (m *Memory) limits() config.Limits {
+	return m.Limits.WithDefaults()
+}
+
+// Truncate drops every row of the given tables and restarts their ids.
+func (m *Memory) Truncate(tables ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, table := range tables {
+		switch table {
+		case "users":
+			m.users = nil
+		case "posts":
+			m.posts = nil
+		case "comments":
+			m.comments = nil
+			m.replyIds = nil
+		case "sessions":
+			m.sessions = nil
+		case "api_keys":
+			m.apiKeys = nil
+		case "email_tokens":
+			m.tokens = nil
+		case "identities":
+			m.identities = nil
+		}
+	}
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+func (m *Memory) user(id int) (*memoryUser, bool) {
+	if id < 1 || id > len(m.users) || m.users[id-1].purged {
+		return nil, false
+	}
+	return &m.users[id-1], true
+}
+
+func (m *Memory) post(id int) (*memoryPost, bool) {
+	if id < 1 || id > len(m.posts) || m.posts[id-1].purged {
+		return nil, false
+	}
+	return &m.posts[id-1], true
+}
+
+func (m *Memory) comment(id int) (*memoryComment, bool) {
+	if id < 1 || id > len(m.comments) || m.comments[id-1].purged {
+		return nil, false
+	}
+	return &m.comments[id-1], true
+}
+
+func (m *Memory) toUser(user *memoryUser) *model.User {
+	role := user.role
+	if role == "" {
+		role = model.RoleUser
+	}
+	if !user.deletedAt.IsZero() {
+		return &model.User{ID: fmt.Sprint(user.id), Name: deletedText, Deleted: true, Role: role}
+	}
+	return &model.User{
+		ID:    fmt.Sprint(user.id),
+		Name:  user.name,
+		About: user.about,
+		Role:  role,
+	}
+}
+
+func (m *Memory) toPost(post *memoryPost) *model.Post {
+	if !post.deletedAt.IsZero() {
+		return &model.Post{ID: fmt.Sprint(post.id), Data: deletedText, AuthorID: fmt.Sprint(post.authorId), Deleted: true}
+	}
+	return &model.Post{
+		ID:          fmt.Sprint(post.id),
+		Data:        post.data,
+		Commentable: post.commentable,
+		AuthorID:    fmt.Sprint(post.authorId),
+	}
+}
+
+func (m *Memory) toComment(comment *memoryComment) *model.Comment {
+	created := &model.Comment{
+		ID:             fmt.Sprint(comment.id),
+		Text:           comment.data,
+		PostID:         fmt.Sprint(comment.postId),
+		AnswerTo:       fmt.Sprint(comment.answerTo),
+		InitialComment: threadRoot(comment.path),
+		CreatorID:      fmt.Sprint(comment.authorId),
+		HasReplies:     m.repliesCount(comment.id) > 0,
+		Hidden:         !comment.hiddenAt.IsZero(),
+	}
+	switch {
+	case !comment.deletedAt.IsZero():
+		created.Text, created.Deleted = deletedText, true
+	case created.Hidden:
+		created.Text = hiddenText
+	}
+	return created
+}
+
+// replies returns the comments answering the comment with id in the order they were
+// added, purged ones included. Lock must be held by the caller.
+func (m *Memory) replies(id int) []*memoryComment {
+	replies := make([]*memoryComment, len(m.replyIds[id]))
+	for i, replyId := range m.replyIds[id] {
+		replies[i] = &m.comments[replyId-1]
+	}
+	return replies
+}
+
+// replied reports whether anything replies to the comment with id, visible or not.
+func (m *Memory) replied(id int) bool {
+	for _, reply := range m.replies(id) {
+		if !reply.purged {
+			return true
+		}
+	}
+	return false
+}
+
+// visible mirrors visibleComment: deleted comments are listed only while there are
+// comments left in their subtree.
+func (m *Memory) visible(comment *memoryComment) bool {
+	if comment.purged {
+		return false
+	}
+	return comment.deletedAt.IsZero() || m.liveDescendant(comment.id)
+}
+
+// liveDescendant reports whether the subtree of the comment with id has a comment that is
+// neither deleted nor purged, it walks the subtree only.
+func (m *Memory) liveDescendant(id int) bool {
+	for _, reply := range m.replies(id) {
+		if (!reply.purged && reply.deletedAt.IsZero()) || m.liveDescendant(reply.id) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Memory) repliesCount(id int) int {
+	count := 0
+	for _, reply := range m.replies(id) {
+		if m.visible(reply) {
+			count++
+		}
+	}
+	return count
+}
+
+// actor mirrors DB.actor. Lock must be held by the caller.
+func (m *Memory) actor(ctx context.Context, scope auth.Scope) (*memoryUser, error) {
+	principal, err := auth.Authorize(ctx, scope)
+	if err != nil {
+		return nil, err
+	}
+	user, ok := m.user(isnumber.TryConvertToInt(principal.UserID))
+	if !ok {
+		return nil, errDeletedActor
+	}
+	return user, nil
+}
+
+// authorizedUser does the check every mutation starts with. Lock must be held by the caller.
+func (m *Memory) authorizedUser(ctx context.Context, scope auth.Scope) (*memoryUser, error) {
+	user, err := m.actor(ctx, scope)
+	if err != nil {
+		return nil, err
+	}
+	if !user.deletedAt.IsZero() {
+		return nil, errDeletedActor
+	}
+	return user, nil
+}
+
+// inputEmail mirrors DB.claimEmail for the optional email of inputs. Lock must be held by the caller.
+func (m *Memory) inputEmail(email *string) (string, error) {
+	normalized, err := inputEmail(email)
+	if err != nil {
+		return "", err
+	}
+	for i := range m.users {
+		user := &m.users[i]
+		if !normalized.Valid || user.email != normalized.String || user.purged {
+			continue
+		}
+		if !user.emailVerifiedAt.IsZero() || m.awaitsVerification(user.id) {
+			return "", errEmailTaken
+		}
+		m.releaseEmail(user)
+	}
+	return normalized.String, nil
+}
+
+// awaitsVerification tells whether a token sent to confirm the address of the user with
+// userId is still valid. Lock must be held by the caller.
+func (m *Memory) awaitsVerification(userId int) bool {
+	now := time.Now()
+	for _, token := range m.tokens {
+		if token.userId == userId && token.purpose == auth.PurposeVerifyEmail && token.usedAt.IsZero() &&
+			token.expiresAt.After(now) && !token.purged {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Memory) CreateUser(ctx context.Context, input *model.CreateUserInput) (*model.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	email, err := m.inputEmail(input.Email)
+	if err != nil {
+		return nil, err
+	}
+	user := memoryUser{
+		id:    len(m.users) + 1,
+		name:  input.Name,
+		about: input.About,
+		email: email,
+	}
+	m.users = append(m.users, user)
+	return m.toUser(&user), nil
+}
+
+func (m *Memory) Register(ctx context.Context, input *model.RegisterInput, passwordHash string) (*model.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name := input.Name
+	for _, user := range m.users {
+		if user.name == name && user.passwordHash != "" && !user.purged {
+			return nil, apperr.Invalid("user with such name already exists")
+		}
+	}
+	email, err := m.inputEmail(input.Email)
+	if err != nil {
+		return nil, err
+	}
+	user := memoryUser{
+		id:           len(m.users) + 1,
+		name:         name,
+		about:        input.About,
+		passwordHash: passwordHash,
+		email:        email,
+	}
+	m.users = append(m.users, user)
+	return m.toUser(&user), nil
+}
+
+func (m *Memory) GetCredentials(ctx context.Context, name string) (*model.User, string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for i := range m.users {
+		user := &m.users[i]
+		if user.name == name && user.passwordHash != "" && user.deletedAt.IsZero() && !user.purged {
+			return m.toUser(user), user.passwordHash, nil
+		}
+	}
+	return nil, "", auth.ErrWrongPassword
+}
+
+func (m *Memory) CreateEmailToken(ctx context.Context, email string, purpose auth.TokenPurpose, tokenHash string, expiresAt time.Time) (bool, error) {
+	normalized, err := auth.NormalizeEmail(email)
+	if err != nil {
+		return false, nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.users {
+		user := &m.users[i]
+		if user.purged || user.email != normalized || !user.deletedAt.IsZero() {
+			continue
+		}
+		now := timestamp(time.Now())
+		for j := range m.tokens {
+			token := &m.tokens[j]
+			if token.userId == user.id && token.purpose == purpose && token.usedAt.IsZero() {
+				token.usedAt = now
+			}
+		}
+		m.tokens = append(m.tokens, memoryEmailToken{
+			id:        len(m.tokens) + 1,
+			userId:    user.id,
+			purpose:   purpose,
+			tokenHash: tokenHash,
+			expiresAt: timestamp(expiresAt),
+		})
+		return true, nil
+	}
+	return false, nil
+}
+
+// releaseEmail mirrors DB.releaseEmail. Lock must be held by the caller.
+func (m *Memory) releaseEmail(user *memoryUser) {
+	user.email = ""
+	now := timestamp(time.Now())
+	for i := range m.tokens {
+		if m.tokens[i].userId == user.id && m.tokens[i].usedAt.IsZero() {
+			m.tokens[i].usedAt = now
+		}
+	}
+}
+
+// emailToken mirrors DB.findEmailToken. Lock must be held by the caller.
+func (m *Memory) emailToken(purpose auth.TokenPurpose, tokenHash string) (*memoryEmailToken, *memoryUser, error) {
+	now := time.Now()
+	for i := range m.tokens {
+		token := &m.tokens[i]
+		if token.purged || token.tokenHash != tokenHash || token.purpose != purpose || !token.usedAt.IsZero() || !token.expiresAt.After(now) {
+			continue
+		}
+		if user, ok := m.user(token.userId); ok {
+			return token, user, nil
+		}
+	}
+	return nil, nil, auth.ErrInvalidEmailToken
+}
+
+func (m *Memory) ResetPassword(ctx context.Context, tokenHash string, passwordHash string) (*model.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	token, user, err := m.emailToken(auth.PurposePasswordReset, tokenHash)
+	if err != nil {
+		return nil, err
+	}
+	for _, other := range m.users {
+		if other.id != user.id && other.name == user.name && other.passwordHash != "" && !other.purged {
+			return nil, apperr.Invalid("user with such name already exists")
+		}
+	}
+	now := timestamp(time.Now())
+	token.usedAt = now
+	user.passwordHash = passwordHash
+	if user.emailVerifiedAt.IsZero() {
+		user.emailVerifiedAt = now
+	}
+	for i := range m.sessions {
+		if m.sessions[i].userId == user.id && m.sessions[i].revokedAt.IsZero() {
+			m.sessions[i].revokedAt = now
+		}
+	}
+	return m.toUser(user), nil
+}
+
+func (m *Memory) VerifyEmail(ctx context.Context, tokenHash string) (*model.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	token, user, err := m.emailToken(auth.PurposeVerifyEmail, tokenHash)
+	if err != nil {
+		return nil, err
+	}
+	token.usedAt = timestamp(time.Now())
+	if user.emailVerifiedAt.IsZero() {
+		user.emailVerifiedAt = token.usedAt
+	}
+	return m.toUser(user), nil
+}
+
+func (m *Memory) LinkIdentity(ctx context.Context, identity auth.Identity) (*model.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	userId := 0
+	for _, linked := range m.identities {
+		if linked.issuer == identity.Issuer && linked.subject == identity.Subject {
+			userId = linked.userId
+		}
+	}
+	if userId == 0 {
+		userId = m.identityUser(identity)
+		m.identities = append(m.identities, memoryIdentity{userId: userId, issuer: identity.Issuer, subject: identity.Subject})
+	}
+	user, ok := m.user(userId)
+	if !ok || !user.deletedAt.IsZero() {
+		return nil, errDeletedActor
+	}
+	return m.toUser(user), nil
+}
+
+// identityUser mirrors DB.identityUser. Lock must be held by the caller.
+func (m *Memory) identityUser(identity auth.Identity) int {
+	email := identityEmail(identity)
+	for i := range m.users {
+		user := &m.users[i]
+		if !email.Valid || user.email != email.String || user.purged {
+			continue
+		}
+		switch {
+		case user.deletedAt.IsZero() && !user.emailVerifiedAt.IsZero():
+			return user.id
+		case user.deletedAt.IsZero():
+			m.releaseEmail(user)
+		default:
+			email.Valid = false
+		}
+	}
+	user := memoryUser{
+		id:   len(m.users) + 1,
+		name: identityName(identity, m.limits().NameLength),
+	}
+	if email.Valid {
+		user.email, user.emailVerifiedAt = email.String, timestamp(time.Now())
+	}
+	m.users = append(m.users, user)
+	return user.id
+}
+
+func (m *Memory) GetUser(ctx context.Context, id string) (*model.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	user, ok := m.user(isnumber.TryConvertToInt(id))
+	if !ok {
+		return nil, errUserNotFound
+	}
+	return m.toUser(user), nil
+}
+
+func (m *Memory) UpdateUser(ctx context.Context, input *model.UpdateUserInput) (*model.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, err := m.authorizedUser(ctx, auth.ScopeAccount)
+	if err != nil {
+		return nil, err
+	}
+	user.about = input.About
+	return m.toUser(user), nil
+}
+
+func (m *Memory) DeleteUser(ctx context.Context, id string) (*model.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	actor, err := m.authorizedUser(ctx, auth.ScopeAccount)
+	if err != nil {
+		return nil, err
+	}
+	user, ok := m.user(isnumber.TryConvertToInt(id))
+	if !ok || !user.deletedAt.IsZero() {
+		return nil, errUserNotFound
+	}
+	if err := policy.Check(m.toUser(actor), policy.DeleteUser, fmt.Sprint(user.id)); err != nil {
+		return nil, err
+	}
+	deletedAt := deletionTime()
+	for i := range m.posts {
+		if m.posts[i].authorId == user.id && m.posts[i].deletedAt.IsZero() {
+			m.deletePost(&m.posts[i], deletedAt)
+		}
+	}
+	for i := range m.comments {
+		if m.comments[i].authorId == user.id && m.comments[i].deletedAt.IsZero() {
+			m.comments[i].deletedAt = deletedAt
+		}
+	}
+	user.deletedAt = deletedAt
+	return m.toUser(user), nil
+}
+
+func (m *Memory) RestoreUser(ctx context.Context, id string) (*model.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	actor, err := m.actor(ctx, auth.ScopeAccount)
+	if err != nil {
+		return nil, err
+	}
+	user, ok := m.user(isnumber.TryConvertToInt(id))
+	if !ok {
+		return nil, errUserNotFound
+	}
+	if err := checkRestoreUser(m.toUser(actor), fmt.Sprint(user.id)); err != nil {
+		return nil, err
+	}
+	if err := restorable(user.deletedAt, "user is not deleted"); err != nil {
+		return nil, err
+	}
+	for i := range m.posts {
+		if m.posts[i].authorId == user.id && m.posts[i].deletedAt.Equal(user.deletedAt) {
+			m.restorePost(&m.posts[i])
+		}
+	}
+	for i := range m.comments {
+		if m.comments[i].authorId == user.id && m.comments[i].deletedAt.Equal(user.deletedAt) {
+			m.comments[i].deletedAt = time.Time{}
+		}
+	}
+	user.deletedAt = time.Time{}
+	return m.toUser(user), nil
+}
+
+func (m *Memory) CreatePost(ctx context.Context, input *model.CreatePostInput) (*model.Post, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	author, err := m.authorizedUser(ctx, auth.ScopePostsWrite)
+	if err != nil {
+		return nil, err
+	}
+	post := memoryPost{
+		id:          len(m.posts) + 1,
+		data:        input.Data,
+		authorId:    author.id,
+		commentable: input.Commentable,
+	}
+	m.posts = append(m.posts, post)
+	return m.toPost(&post), nil
+}
+
+func (m *Memory) GetPost(ctx context.Context, id string) (*model.Post, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	post, ok := m.post(isnumber.TryConvertToInt(id))
+	if !ok {
+		return nil, errPostNotFound
+	}
+	return m.toPost(post), nil
+}
+
+func (m *Memory) GetPosts(ctx context.Context, page Page) (*model.PostConnection, error) {
+	w, err := page.window(m.limits().PageSize)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	listed := []memoryPost{}
+	for _, post := range m.posts {
+		if post.deletedAt.IsZero() && !post.purged {
+			listed = append(listed, post)
+		}
+	}
+	rows, hasMore := memoryWindow(w, listed, func(post *memoryPost) int { return post.id })
+	posts := []*model.Post{}
+	for _, post := range rows {
+		posts = append(posts, m.toPost(post))
+	}
+	return postConnection(w, posts, hasMore, len(listed)), nil
+}
+
+func (m *Memory) UpdatePost(ctx context.Context, id string, input *model.UpdatePostInput) (*model.Post, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	actor, err := m.authorizedUser(ctx, auth.ScopePostsWrite)
+	if err != nil {
+		return nil, err
+	}
+	post, ok := m.post(isnumber.TryConvertToInt(id))
+	if !ok || !post.deletedAt.IsZero() {
+		return nil, errPostNotFound
+	}
+	if err := policy.Check(m.toUser(actor), policy.EditPost, fmt.Sprint(post.authorId)); err != nil {
+		return nil, err
+	}
+	if (model.UpdatePostInput{}) == *input {
+		return nil, apperr.Invalid("nothing to edit")
+	}
+	post.data = input.Data
+	post.commentable = input.Commentable
+	return m.toPost(post), nil
+}
+
+// deletePost marks post and its comments deleted. Lock must be held by the caller.
+func (m *Memory) deletePost(post *memoryPost, deletedAt time.Time) {
+	for i := range m.comments {
+		if m.comments[i].postId == post.id && m.comments[i].deletedAt.IsZero() {
+			m.comments[i].deletedAt = deletedAt
+		}
+	}
+	post.deletedAt = deletedAt
+}
+
+// restorePost brings back post with comments deleted together with it. Lock must be held by the caller.
+func (m *Memory) restorePost(post *memoryPost) {
+	for i := range m.comments {
+		if m.comments[i].postId == post.id && m.comments[i].deletedAt.Equal(post.deletedAt) {
+			m.comments[i].deletedAt = time.Time{}
+		}
+	}
+	post.deletedAt = time.Time{}
+}
+
+func (m *Memory) DeletePost(ctx context.Context, id string) (*model.Post, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	actor, err := m.authorizedUser(ctx, auth.ScopePostsWrite)
+	if err != nil {
+		return nil, err
+	}
+	post, ok := m.post(isnumber.TryConvertToInt(id))
+	if !ok || !post.deletedAt.IsZero() {
+		return nil, errPostNotFound
+	}
+	if err := policy.Check(m.toUser(actor), policy.DeletePost, fmt.Sprint(post.authorId)); err != nil {
+		return nil, err
+	}
+	m.deletePost(post, deletionTime())
+	return m.toPost(post), nil
+}
+
+func (m *Memory) RestorePost(ctx context.Context, id string) (*model.Post, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	actor, err := m.authorizedUser(ctx, auth.ScopePostsWrite)
+	if err != nil {
+		return nil, err
+	}
+	post, ok := m.post(isnumber.TryConvertToInt(id))
+	if !ok {
+		return nil, errPostNotFound
+	}
+	if err := policy.Check(m.toUser(actor), policy.RestorePost, fmt.Sprint(post.authorId)); err != nil {
+		return nil, err
+	}
+	if err := restorable(post.deletedAt, "post is not deleted"); err != nil {
+		return nil, err
+	}
+	m.restorePost(post)
+	return m.toPost(post), nil
+}
+
+func (m *Memory) CreateComment(ctx context.Context, input *model.CreateCommentInput) (*model.Comment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	text := input.Text
+	user, err := m.authorizedUser(ctx, auth.ScopeCommentsWrite)
+	if err != nil {
+		return nil, err
+	}
+	post, ok := m.post(isnumber.TryConvertToInt(input.Post))
+	if !ok || !post.deletedAt.IsZero() {
+		return nil, errPostNotFound
+	}
+	if !post.commentable {
+		return nil, apperr.Forbidden("cannot comment this post (commenting disabled)")
+	}
+	id := len(m.comments) + 1
+	path := commentPath("", id)
+	answerTo := isnumber.TryConvertToInt(input.AnswerTo)
+	if answerTo != -1 {
+		parent, ok := m.comment(answerTo)
+		if !ok || !parent.deletedAt.IsZero() {
+			return nil, apperr.NotFound("failed to answer to comment that doesn't exist")
+		}
+		if parent.postId != post.id {
+			return nil, apperr.Invalid("failed to answer to comment of other post")
+		}
+		path = commentPath(parent.path, id)
+	}
+	comment := memoryComment{
+		id:       id,
+		postId:   post.id,
+		authorId: user.id,
+		answerTo: answerTo,
+		path:     path,
+		data:     text,
+	}
+	m.comments = append(m.comments, comment)
+	if answerTo != -1 {
+		if m.replyIds == nil {
+			m.replyIds = map[int][]int{}
+		}
+		m.replyIds[answerTo] = append(m.replyIds[answerTo], id)
+	}
+
+	created := m.toComment(&comment)
+	m.Events.Publish(pubsub.PostTopic(created.PostID), created)
+	if answerTo != -1 {
+		m.Events.Publish(pubsub.CommentTopic(fmt.Sprint(answerTo)), created)
+	}
+	return created, nil
+}
+
+func (m *Memory) GetComment(ctx context.Context, id string) (*model.Comment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	comment, ok := m.comment(isnumber.TryConvertToInt(id))
+	if !ok {
+		return nil, apperr.NotFound("comment with such id does not exits")
+	}
+	return m.toComment(comment), nil
+}
+
+func (m *Memory) UpdateComment(ctx context.Context, commId string, input *model.UpdateCommentInput) (*model.Comment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	text := input.Data
+	actor, err := m.authorizedUser(ctx, auth.ScopeCommentsWrite)
+	if err != nil {
+		return nil, err
+	}
+	comment, ok := m.comment(isnumber.TryConvertToInt(commId))
+	if !ok || !comment.deletedAt.IsZero() {
+		return nil, apperr.NotFound("comment with such id not found")
+	}
+	if err := policy.Check(m.toUser(actor), policy.EditComment, fmt.Sprint(comment.authorId)); err != nil {
+		return nil, err
+	}
+	comment.data = text
+	return m.toComment(comment), nil
+}
+
+func (m *Memory) DeleteComment(ctx context.Context, commId string) (*model.Comment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	actor, err := m.authorizedUser(ctx, auth.ScopeCommentsWrite)
+	if err != nil {
+		return nil, err
+	}
+	comment, ok := m.comment(isnumber.TryConvertToInt(commId))
+	if !ok || !comment.deletedAt.IsZero() {
+		return nil, apperr.NotFound("comment with such id not found")
+	}
+	if err := policy.Check(m.toUser(actor), policy.DeleteComment, fmt.Sprint(comment.authorId)); err != nil {
+		return nil, err
+	}
+	comment.deletedAt = deletionTime()
+	return m.toComment(comment), nil
+}
+
+func (m *Memory) RestoreComment(ctx context.Context, commId string) (*model.Comment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	actor, err := m.authorizedUser(ctx, auth.ScopeCommentsWrite)
+	if err != nil {
+		return nil, err
+	}
+	comment, ok := m.comment(isnumber.TryConvertToInt(commId))
+	if !ok {
+		return nil, apperr.NotFound("comment with such id not found")
+	}
+	if err := policy.Check(m.toUser(actor), policy.RestoreComment, fmt.Sprint(comment.authorId)); err != nil {
+		return nil, err
+	}
+	if post, ok := m.post(comment.postId); !ok || !post.deletedAt.IsZero() {
+		return nil, errPostNotFound
+	}
+	if err := restorable(comment.deletedAt, "comment is not deleted"); err != nil {
+		return nil, err
+	}
+	comment.deletedAt = time.Time{}
+	return m.toComment(comment), nil
+}
+
+func (m *Memory) HideComment(ctx context.Context, commId string, hidden bool) (*model.Comment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	actor, err := m.authorizedUser(ctx, auth.ScopeCommentsWrite)
+	if err != nil {
+		return nil, err
+	}
+	if err := policy.RequireRole(m.toUser(actor), model.RoleModerator); err != nil {
+		return nil, err
+	}
+	comment, ok := m.comment(isnumber.TryConvertToInt(commId))
+	if !ok || !comment.deletedAt.IsZero() {
+		return nil, apperr.NotFound("comment with such id not found")
+	}
+	if comment.hiddenAt.IsZero() != hidden {
+		if hidden {
+			return nil, apperr.Invalid("comment is already hidden")
+		}
+		return nil, apperr.Invalid("comment is not hidden")
+	}
+	comment.hiddenAt = time.Time{}
+	if hidden {
+		comment.hiddenAt = timestamp(time.Now())
+	}
+	return m.toComment(comment), nil
+}
+
+func (m *Memory) SetUserRole(ctx context.Context, id string, role model.Role) (*model.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	actor, err := m.authorizedUser(ctx, auth.ScopeAccount)
+	if err != nil {
+		return nil, err
+	}
+	if err := policy.RequireRole(m.toUser(actor), model.RoleAdmin); err != nil {
+		return nil, err
+	}
+	if fmt.Sprint(actor.id) == id {
+		return nil, apperr.Forbidden("can't change own role")
+	}
+	return m.grantRole(id, role)
+}
+
+func (m *Memory) GrantRole(ctx context.Context, id string, role model.Role) (*model.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.grantRole(id, role)
+}
+
+func (m *Memory) grantRole(id string, role model.Role) (*model.User, error) {
+	if !role.IsValid() {
+		return nil, apperr.Invalid("unknown role %q", role)
+	}
+	user, ok := m.user(isnumber.TryConvertToInt(id))
+	if !ok || !user.deletedAt.IsZero() {
+		return nil, errUserNotFound
+	}
+	user.role = role
+	return m.toUser(user), nil
+}
+
+// Purge drops rows deleted before the given time the same way DB.Purge does.
+func (m *Memory) Purge(ctx context.Context, before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	expired := func(deletedAt time.Time) bool {
+		return !deletedAt.IsZero() && deletedAt.Before(before)
+	}
+	for i := range m.posts {
+		post := &m.posts[i]
+		if post.purged || !expired(post.deletedAt) {
+			continue
+		}
+		for j := range m.comments {
+			if m.comments[j].postId == post.id {
+				m.comments[j].purged = true
+			}
+		}
+		post.purged = true
+	}
+	for purged := true; purged; {
+		purged = false
+		for i := range m.comments {
+			comment := &m.comments[i]
+			if !comment.purged && expired(comment.deletedAt) && !m.replied(comment.id) {
+				comment.purged = true
+				purged = true
+			}
+		}
+	}
+	for i := range m.comments {
+		if !m.comments[i].purged && expired(m.comments[i].deletedAt) {
+			m.comments[i].data = ""
+		}
+	}
+	for i := range m.sessions {
+		session := &m.sessions[i]
+		user, ok := m.user(session.userId)
+		if expired(session.revokedAt) || session.expiresAt.Before(before) || !ok || expired(user.deletedAt) {
+			session.purged = true
+		}
+	}
+	for i := range m.tokens {
+		token := &m.tokens[i]
+		if token.expiresAt.Before(before) || expired(token.usedAt) {
+			token.purged = true
+		}
+	}
+	identities := m.identities[:0]
+	for _, identity := range m.identities {
+		if user, ok := m.user(identity.userId); ok && !expired(user.deletedAt) {
+			identities = append(identities, identity)
+		}
+	}
+	m.identities = identities
+	for i := range m.apiKeys {
+		key := &m.apiKeys[i]
+		user, ok := m.user(key.userId)
+		if expired(key.revokedAt) || !ok || expired(user.deletedAt) {
+			key.purged = true
+		}
+	}
+	for i := range m.users {
+		user := &m.users[i]
+		if user.purged || !expired(user.deletedAt) {
+			continue
+		}
+		user.name, user.about, user.passwordHash = "", "", ""
+		user.email, user.emailVerifiedAt = "", time.Time{}
+		user.purged = true
+		for j := range m.posts {
+			user.purged = user.purged && (m.posts[j].authorId != user.id || m.posts[j].purged)
+		}
+		for j := range m.comments {
+			user.purged = user.purged && (m.comments[j].authorId != user.id || m.comments[j].purged)
+		}
+	}
+	return nil
+}
+
+// session returns the session with id that was not purged. Lock must be held by the caller.
+func (m *Memory) session(id int) (*memorySession, bool) {
+	if id < 1 || id > len(m.sessions) || m.sessions[id-1].purged {
+		return nil, false
+	}
+	return &m.sessions[id-1], true
+}
+
+func (m *Memory) toSession(ctx context.Context, session *memorySession) *model.Session {
+	principal, _ := auth.PrincipalFrom(ctx)
+	id := fmt.Sprint(session.id)
+	return toSession(id, session.createdAt, session.lastSeenAt, session.expiresAt, session.client, principal.SessionID == id)
+}
+
+func (s *memorySession) active(now time.Time) bool {
+	return s.revokedAt.IsZero() && s.expiresAt.After(now)
+}
+
+func (m *Memory) CreateSession(ctx context.Context, userID string, client auth.Client, expiresAt time.Time) (*model.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := timestamp(time.Now())
+	session := memorySession{
+		id:         len(m.sessions) + 1,
+		userId:     isnumber.TryConvertToInt(userID),
+		createdAt:  now,
+		lastSeenAt: now,
+		expiresAt:  timestamp(expiresAt),
+		client:     client,
+	}
+	m.sessions = append(m.sessions, session)
+	return m.toSession(ctx, &session), nil
+}
+
+func (m *Memory) TouchSession(ctx context.Context, principal auth.Principal, client auth.Client) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := timestamp(time.Now())
+	session, ok := m.session(isnumber.TryConvertToInt(principal.SessionID))
+	if !ok || fmt.Sprint(session.userId) != principal.UserID || !session.active(now) {
+		return auth.ErrSessionExpired
+	}
+	if !touched(session.client, session.lastSeenAt, client, now) {
+		session.lastSeenAt, session.client = now, client
+	}
+	return nil
+}
+
+func (m *Memory) GetSessions(ctx context.Context) ([]*model.Session, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	user, err := m.authorizedUser(ctx, auth.ScopeAccount)
+	if err != nil {
+		return nil, err
+	}
+	now := timestamp(time.Now())
+	sessions := []*model.Session{}
+	for i := len(m.sessions) - 1; i >= 0; i-- {
+		session := &m.sessions[i]
+		if !session.purged && session.userId == user.id && session.active(now) {
+			sessions = append(sessions, m.toSession(ctx, session))
+		}
+	}
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return sessions[i].LastSeenAt > sessions[j].LastSeenAt
+	})
+	return sessions, nil
+}
+
+func (m *Memory) RevokeSession(ctx context.Context, id string) (*model.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, err := m.authorizedUser(ctx, auth.ScopeAccount)
+	if err != nil {
+		return nil, err
+	}
+	session, ok := m.session(isnumber.TryConvertToInt(id))
+	if !ok {
+		return nil, apperr.NotFound("session with such id does not exist")
+	}
+	if err := policy.Check(m.toUser(user), policy.RevokeSession, fmt.Sprint(session.userId)); err != nil {
+		return nil, err
+	}
+	if !session.revokedAt.IsZero() {
+		return nil, apperr.Invalid("session is already revoked")
+	}
+	session.revokedAt = timestamp(time.Now())
+	return m.toSession(ctx, session), nil
+}
+
+func (m *Memory) RevokeAllSessions(ctx context.Context, exceptCurrent bool) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, err := m.authorizedUser(ctx, auth.ScopeAccount)
+	if err != nil {
+		return 0, err
+	}
+	principal, _ := auth.PrincipalFrom(ctx)
+	now := timestamp(time.Now())
+	revoked := 0
+	for i := range m.sessions {
+		session := &m.sessions[i]
+		if session.purged || session.userId != user.id || !session.active(now) {
+			continue
+		}
+		if exceptCurrent && fmt.Sprint(session.id) == principal.SessionID {
+			continue
+		}
+		session.revokedAt = now
+		revoked++
+	}
+	return revoked, nil
+}
+
+func (m *Memory) toAPIKey(key *memoryAPIKey) *model.APIKey {
+	var lastUsedAt sql.NullTime
+	if !key.lastUsedAt.IsZero() {
+		lastUsedAt = sql.NullTime{Time: key.lastUsedAt, Valid: true}
+	}
+	return toAPIKey(fmt.Sprint(key.id), key.name, joinScopes(key.scopes), key.createdAt, lastUsedAt)
+}
+
+func (m *Memory) CreateAPIKey(ctx context.Context, name string, scopes []auth.Scope, keyHash string) (*model.APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, err := m.authorizedUser(ctx, auth.ScopeAccount)
+	if err != nil {
+		return nil, err
+	}
+	key := memoryAPIKey{
+		id:        len(m.apiKeys) + 1,
+		userId:    user.id,
+		name:      name,
+		keyHash:   keyHash,
+		scopes:    scopes,
+		createdAt: timestamp(time.Now()),
+	}
+	m.apiKeys = append(m.apiKeys, key)
+	return m.toAPIKey(&key), nil
+}
+
+func (m *Memory) TouchAPIKey(ctx context.Context, keyHash string) (auth.Principal, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.apiKeys {
+		key := &m.apiKeys[i]
+		if key.purged || key.keyHash != keyHash || !key.revokedAt.IsZero() {
+			continue
+		}
+		key.lastUsedAt = timestamp(time.Now())
+		return auth.Principal{UserID: fmt.Sprint(key.userId), APIKeyID: fmt.Sprint(key.id), Scopes: key.scopes}, nil
+	}
+	return auth.Principal{}, auth.ErrInvalidToken
+}
+
+func (m *Memory) GetAPIKeys(ctx context.Context) ([]*model.APIKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	user, err := m.authorizedUser(ctx, auth.ScopeAccount)
+	if err != nil {
+		return nil, err
+	}
+	keys := []*model.APIKey{}
+	for i := range m.apiKeys {
+		key := &m.apiKeys[i]
+		if !key.purged && key.userId == user.id && key.revokedAt.IsZero() {
+			keys = append(keys, m.toAPIKey(key))
+		}
+	}
+	return keys, nil
+}
+
+func (m *Memory) RevokeAPIKey(ctx context.Context, id string) (*model.APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, err := m.authorizedUser(ctx, auth.ScopeAccount)
+	if err != nil {
+		return nil, err
+	}
+	n := isnumber.TryConvertToInt(id)
+	if n < 1 || n > len(m.apiKeys) || m.apiKeys[n-1].purged || !m.apiKeys[n-1].revokedAt.IsZero() {
+		return nil, apperr.NotFound("api key with such id does not exist")
+	}
+	key := &m.apiKeys[n-1]
+	if err := policy.Check(m.toUser(user), policy.RevokeAPIKey, fmt.Sprint(key.userId)); err != nil {
+		return nil, err
+	}
+	key.revokedAt = timestamp(time.Now())
+	return m.toAPIKey(key), nil
+}
+
+// memoryWindow picks the rows of w out of items, which are kept in id order.
+func memoryWindow[T any](w window, items []T, id func(*T) int) ([]*T, bool) {
+	rows := []*T{}
+	for i := range items {
+		if len(rows) > w.limit {
+			break
+		}
+		item := &items[i]
+		if w.backward {
+			item = &items[len(items)-1-i]
+		}
+		if w.contains(id(item)) {
+			rows = append(rows, item)
+		}
+	}
+	return trim(w, rows)
+}
+
+// commentConnection returns the window of the visible ones of candidates, which are in id order.
+// Lock must be held by the caller.
+func (m *Memory) commentConnection(w window, candidates []*memoryComment) (*model.CommentConnection, error) {
+	matching := []memoryComment{}
+	for _, comment := range candidates {
+		if m.visible(comment) {
+			matching = append(matching, *comment)
+		}
+	}
+	rows, hasMore := memoryWindow(w, matching, func(comment *memoryComment) int { return comment.id })
+	comments := []*model.Comment{}
+	for _, comment := range rows {
+		comments = append(comments, m.toComment(comment))
+	}
+	return commentConnection(w, comments, hasMore, len(matching)), nil
+}
+
+func (m *Memory) GetComments(ctx context.Context, postID string, page Page) (*model.CommentConnection, error) {
+	w, err := page.window(m.limits().PageSize)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	post, ok := m.post(isnumber.TryConvertToInt(postID))
+	if !ok || !post.deletedAt.IsZero() {
+		return nil, errPostNotFound
+	}
+	var roots []*memoryComment
+	for i := range m.comments {
+		if m.comments[i].postId == post.id && m.comments[i].answerTo == -1 {
+			roots = append(roots, &m.comments[i])
+		}
+	}
+	return m.commentConnection(w, roots)
+}
+
+func (m *Memory) GetReplies(ctx context.Context, commentId string, page Page) (*model.CommentConnection, error) {
+	connections, errs := m.GetRepliesByIds(ctx, []string{commentId}, page)
+	return connections[0], errs[0]
+}
+
+func (m *Memory) GetRepliesByIds(ctx context.Context, ids []string, page Page) ([]*model.CommentConnection, []error) {
+	connections := make([]*model.CommentConnection, len(ids))
+	errs := make([]error, len(ids))
+	w, err := page.window(m.limits().PageSize)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for i, id := range ids {
+		if errs[i] = err; err == nil {
+			connections[i], errs[i] = m.replyConnection(w, id)
+		}
+	}
+	return connections, errs
+}
+
+// replyConnection returns the window of visible replies to the comment with commentId. Lock must be held by the caller.
+func (m *Memory) replyConnection(w window, commentId string) (*model.CommentConnection, error) {
+	commentIdInt := isnumber.TryConvertToInt(commentId)
+	if commentIdInt == -1 {
+		return nil, errWrongCommentId
+	}
+	if _, ok := m.comment(commentIdInt); !ok {
+		return nil, apperr.NotFound("comment with such id does not exist")
+	}
+	return m.commentConnection(w, m.replies(commentIdInt))
+}
+
+func (m *Memory) GetThread(ctx context.Context, rootId string, maxDepth *int, limit *int) (*model.CommentThread, error) {
+	depth, size, err := threadBounds(maxDepth, limit)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	root, ok := m.comment(isnumber.TryConvertToInt(rootId))
+	if !ok || !m.visible(root) {
+		return nil, apperr.NotFound("comment with such id does not exits")
+	}
+	repliesCount := map[string]int{}
+	comments := []*model.Comment{}
+	var walk func(comment *memoryComment, level int)
+	walk = func(comment *memoryComment, level int) {
+		if len(comments) == size {
+			return
+		}
+		comments = append(comments, m.toComment(comment))
+		repliesCount[fmt.Sprint(comment.id)] = m.repliesCount(comment.id)
+		if level == depth {
+			return
+		}
+		for _, reply := range m.replies(comment.id) {
+			if m.visible(reply) {
+				walk(reply, level+1)
+			}
+		}
+	}
+	walk(root, 0)
+	return buildThread(comments, repliesCount), nil
+}
+
+func (m *Memory) GetUsersByIds(ctx context.Context, ids []string) ([]*model.User, []error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	found := map[string]*model.User{}
+	for _, id := range ids {
+		if user, ok := m.user(isnumber.TryConvertToInt(id)); ok {
+			found[id] = m.toUser(user)
+		}
+	}
+	return byIds(ids, found, errUserNotFound)
+}
+
+func (m *Memory) GetPostsByIds(ctx context.Context, ids []string) ([]*model.Post, []error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	found := map[string]*model.Post{}
+	for _, id := range ids {
+		if post, ok := m.post(isnumber.TryConvertToInt(id)); ok {
+			found[id] = m.toPost(post)
+		}
+	}
+	return byIds(ids, found, apperr.NotFound("post with such id does not exist"))
+}
+
+func (m *Memory) GetCommentsByIds(ctx context.Context, ids []string) ([]*model.Comment, []error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	found := map[string]*model.Comment{}
+	for _, id := range ids {
+		if comment, ok := m.comment(isnumber.TryConvertToInt(id)); ok {
+			found[id] = m.toComment(comment)
+		}
+	}
+	return byIds(ids, found, apperr.NotFound("comment with such id does not exist"))
+}
+
+func (m *Memory) CommentAdded(ctx context.Context, postId string) <-chan *model.Comment {
+	return m.Events.Subscribe(ctx, pubsub.PostTopic(postId))
+}
+
+func (m *Memory) ReplyAdded(ctx context.Context, commentId string) <-chan *model.Comment {
+	return m.Events.Subscribe(ctx, pubsub.CommentTopic(commentId))
+}
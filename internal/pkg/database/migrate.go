@@ -0,0 +1,95 @@
+package database
+
+import (
+	"context"
+	"io/fs"
+	"log"
+	"path"
+
+	"github.com/idkwhyureadthis/ozon-task/internal/migrations"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/config"
+	"github.com/pressly/goose/v3"
+)
+
+// Modes of Migrate, "to:<version>" is the remaining one.
+const (
+	MigrateUp     = config.MigrateUp
+	MigrateDown   = config.MigrateDown
+	MigrateReset  = config.MigrateReset
+	MigrateNone   = config.MigrateNone
+	MigrateStatus = config.MigrateStatus
+)
+
+// migrations returns the provider of the migrations embedded for the dialect of db.
+func (db *DB) migrations() (*goose.Provider, error) {
+	dir, err := fs.Sub(migrations.FS, string(db.Dialect))
+	if err != nil {
+		return nil, err
+	}
+	return goose.NewProvider(goose.Dialect(db.Dialect), db.Client, dir)
+}
+
+// Migrate brings the schema to what mode asks for:
+//   - up applies the pending migrations;
+//   - down rolls back the last applied one;
+//   - reset rolls all of them back and applies them again, which drops every row;
+//   - none leaves the schema as it is;
+//   - status only logs which migrations are applied;
+//   - to:<version> applies or rolls back migrations until version is the last applied.
+func (db *DB) Migrate(ctx context.Context, mode string) error {
+	parsed, err := config.ParseMigrationMode(mode)
+	if err != nil {
+		return err
+	}
+	if parsed.Name == MigrateNone {
+		return nil
+	}
+	provider, err := db.migrations()
+	if err != nil {
+		return err
+	}
+	var results []*goose.MigrationResult
+	switch parsed.Name {
+	case MigrateStatus:
+		statuses, err := provider.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			log.Printf("migration %s: %s", path.Base(status.Source.Path), status.State)
+		}
+		return nil
+	case MigrateUp:
+		results, err = provider.Up(ctx)
+	case MigrateDown:
+		var result *goose.MigrationResult
+		if result, err = provider.Down(ctx); err == nil {
+			results = append(results, result)
+		}
+	case MigrateReset:
+		if results, err = provider.DownTo(ctx, 0); err == nil {
+			var up []*goose.MigrationResult
+			up, err = provider.Up(ctx)
+			results = append(results, up...)
+		}
+	case config.MigrateTo:
+		var current int64
+		if current, err = provider.GetDBVersion(ctx); err != nil {
+			return err
+		}
+		if parsed.Version < current {
+			results, err = provider.DownTo(ctx, parsed.Version)
+		} else {
+			results, err = provider.UpTo(ctx, parsed.Version)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	version, err := provider.GetDBVersion(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("ran %d migrations, schema is at version %d", len(results), version)
+	return nil
+}
@@ -0,0 +1,177 @@
+package database
+
+import (
+	"encoding/base64"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/idkwhyureadthis/ozon-task/graph/model"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/apperr"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/config"
+)
+
+const (
+	maxPageSize  = config.MaxPageSize
+	cursorPrefix = "cursor:"
+)
+
+// Page holds relay-style connection arguments.
+type Page struct {
+	First  *int
+	After  *string
+	Last   *int
+	Before *string
+}
+
+// window is a Page resolved into a keyset over ids: rows with afterId < id < beforeId,
+// limit of them taken from the start, or from the end when backward is set.
+type window struct {
+	afterId  int
+	beforeId int
+	limit    int
+	backward bool
+}
+
+func EncodeCursor(id string) string {
+	return base64.StdEncoding.EncodeToString([]byte(cursorPrefix + id))
+}
+
+func decodeCursor(cursor string) (int, error) {
+	decoded, err := base64.StdEncoding.DecodeString(cursor)
+	if err != nil || !strings.HasPrefix(string(decoded), cursorPrefix) {
+		return 0, apperr.Invalid("wrong cursor provided")
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(string(decoded), cursorPrefix))
+	if err != nil || id < 1 {
+		return 0, apperr.Invalid("wrong cursor provided")
+	}
+	return id, nil
+}
+
+// window resolves p, pageSize rows are taken when it doesn't say how many.
+func (p Page) window(pageSize int) (window, error) {
+	w := window{limit: pageSize}
+	if p.First != nil && p.Last != nil {
+		return w, apperr.Invalid("first and last can't be used together")
+	}
+	for _, size := range []*int{p.First, p.Last} {
+		if size != nil && (*size < 0 || *size > maxPageSize) {
+			return w, apperr.Invalid("page size should be between 0 and %d", maxPageSize)
+		}
+	}
+	var err error
+	if p.After != nil {
+		if w.afterId, err = decodeCursor(*p.After); err != nil {
+			return w, err
+		}
+	}
+	if p.Before != nil {
+		if w.beforeId, err = decodeCursor(*p.Before); err != nil {
+			return w, err
+		}
+	}
+	if p.First != nil {
+		w.limit = *p.First
+	}
+	if p.Last != nil {
+		w.limit = *p.Last
+		w.backward = true
+	}
+	return w, nil
+}
+
+// keyset returns the conditions and arguments restricting ids to the window
+// together with the ORDER BY and LIMIT clause. One extra row is requested
+// to find out whether there is another page.
+func (w window) keyset() ([]string, []any, string) {
+	var (
+		conditions []string
+		args       []any
+	)
+	if w.afterId > 0 {
+		conditions = append(conditions, "id > ?")
+		args = append(args, w.afterId)
+	}
+	if w.beforeId > 0 {
+		conditions = append(conditions, "id < ?")
+		args = append(args, w.beforeId)
+	}
+	return conditions, args, fmt.Sprintf("ORDER BY id %s LIMIT %d", w.order(), w.limit+1)
+}
+
+// order is the direction rows of the window are taken in, trim puts them back in id order.
+func (w window) order() string {
+	if w.backward {
+		return "DESC"
+	}
+	return "ASC"
+}
+
+func (w window) contains(id int) bool {
+	return (w.afterId == 0 || id > w.afterId) && (w.beforeId == 0 || id < w.beforeId)
+}
+
+// trim cuts the extra row requested by keyset, puts rows back in id order
+// and reports whether rows continue past the window.
+func trim[T any](w window, rows []T) ([]T, bool) {
+	hasMore := len(rows) > w.limit
+	if hasMore {
+		rows = rows[:w.limit]
+	}
+	if w.backward {
+		slices.Reverse(rows)
+	}
+	return rows, hasMore
+}
+
+func (w window) pageInfo(cursors []string, hasMore bool) *model.PageInfo {
+	info := &model.PageInfo{
+		HasNextPage:     !w.backward && hasMore,
+		HasPreviousPage: w.backward && hasMore,
+	}
+	if len(cursors) > 0 {
+		info.StartCursor = &cursors[0]
+		info.EndCursor = &cursors[len(cursors)-1]
+	}
+	return info
+}
+
+func postConnection(w window, posts []*model.Post, hasMore bool, totalCount int) *model.PostConnection {
+	edges := []*model.PostEdge{}
+	cursors := []string{}
+	for _, post := range posts {
+		cursor := EncodeCursor(post.ID)
+		edges = append(edges, &model.PostEdge{Cursor: cursor, Node: post})
+		cursors = append(cursors, cursor)
+	}
+	return &model.PostConnection{
+		Edges:      edges,
+		PageInfo:   w.pageInfo(cursors, hasMore),
+		TotalCount: totalCount,
+	}
+}
+
+func commentConnection(w window, comments []*model.Comment, hasMore bool, totalCount int) *model.CommentConnection {
+	edges := []*model.CommentEdge{}
+	cursors := []string{}
+	for _, comment := range comments {
+		cursor := EncodeCursor(comment.ID)
+		edges = append(edges, &model.CommentEdge{Cursor: cursor, Node: comment})
+		cursors = append(cursors, cursor)
+	}
+	return &model.CommentConnection{
+		Edges:      edges,
+		PageInfo:   w.pageInfo(cursors, hasMore),
+		TotalCount: totalCount,
+	}
+}
+
+func emptyPostConnection() *model.PostConnection {
+	return &model.PostConnection{Edges: []*model.PostEdge{}, PageInfo: &model.PageInfo{}}
+}
+
+func emptyCommentConnection() *model.CommentConnection {
+	return &model.CommentConnection{Edges: []*model.CommentEdge{}, PageInfo: &model.PageInfo{}}
+}
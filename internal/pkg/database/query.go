@@ -0,0 +1,114 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+type Dialect string
+
+const (
+	Postgres Dialect = "postgres"
+	SQLite   Dialect = "sqlite3"
+)
+
+// Rebind turns the ? placeholders every query in this package is written with
+// into $1, $2... for Postgres. Question marks inside string literals are kept.
+func (d Dialect) Rebind(query string) string {
+	if d != Postgres {
+		return query
+	}
+	var (
+		rebound strings.Builder
+		n       int
+		quoted  bool
+	)
+	for _, r := range query {
+		switch {
+		case r == '\'':
+			quoted = !quoted
+		case r == '?' && !quoted:
+			n++
+			rebound.WriteString(fmt.Sprintf("$%d", n))
+			continue
+		}
+		rebound.WriteRune(r)
+	}
+	return rebound.String()
+}
+
+func where(conditions []string) string {
+	if len(conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conditions, " AND ")
+}
+
+// placeholders returns "(?, ?, ...)" with n placeholders for an IN clause.
+func placeholders(n int) string {
+	return "(" + strings.TrimSuffix(strings.Repeat("?, ", n), ", ") + ")"
+}
+
+// querier runs queries: the connection pool or a transaction of it.
+type querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+func (db *DB) conn() querier {
+	if db.tx != nil {
+		return db.tx.querier
+	}
+	return db.Client
+}
+
+// noted marks the transaction db runs in for another try if err calls for it.
+func (db *DB) noted(err error) error {
+	if db.tx != nil && retryable(err) {
+		db.tx.retry = true
+	}
+	return err
+}
+
+// row is the result of queryRow, its Scan error is noted like errors of query and exec.
+type row struct {
+	*sql.Row
+	db *DB
+}
+
+func (r row) Scan(dest ...any) error {
+	return r.db.noted(r.Row.Scan(dest...))
+}
+
+func (db *DB) queryRow(ctx context.Context, query string, args ...any) row {
+	return row{db.conn().QueryRowContext(ctx, db.Dialect.Rebind(query), args...), db}
+}
+
+func (db *DB) query(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	rows, err := db.conn().QueryContext(ctx, db.Dialect.Rebind(query), args...)
+	return rows, db.noted(err)
+}
+
+func (db *DB) exec(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	res, err := db.conn().ExecContext(ctx, db.Dialect.Rebind(query), args...)
+	return res, db.noted(err)
+}
+
+// insert runs an INSERT statement and returns id of the created row. Postgres gets it
+// with RETURNING, SQLite from the driver's last insert id.
+func (db *DB) insert(ctx context.Context, query string, args ...any) (int, error) {
+	if db.Dialect == Postgres {
+		var id int
+		err := db.queryRow(ctx, query+" RETURNING id", args...).Scan(&id)
+		return id, err
+	}
+	res, err := db.exec(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
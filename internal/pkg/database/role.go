@@ -0,0 +1,118 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/idkwhyureadthis/ozon-task/graph/model"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/apperr"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/auth"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/isnumber"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/policy"
+)
+
+// hiddenText replaces the text of comments hidden by moderators.
+const hiddenText = "[hidden by moderator]"
+
+// Roles are stored lower-cased: user, moderator and admin.
+func toRole(role string) model.Role {
+	return model.Role(strings.ToUpper(role))
+}
+
+func fromRole(role model.Role) string {
+	return strings.ToLower(string(role))
+}
+
+func (db *DB) HideComment(ctx context.Context, commId string, hidden bool) (*model.Comment, error) {
+	actor, err := db.authorizedUser(ctx, auth.ScopeCommentsWrite)
+	if err != nil {
+		return nil, err
+	}
+	if err := policy.RequireRole(actor, model.RoleModerator); err != nil {
+		return nil, err
+	}
+	rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().Query)
+	defer cancel()
+	commentId := isnumber.TryConvertToInt(commId)
+	err = db.transact(rqCtx, func(tx *DB) error {
+		var (
+			authorId string
+			hiddenAt sql.NullTime
+		)
+		err := tx.queryRow(rqCtx, "SELECT author_id, hidden_at FROM comments WHERE id = ? AND deleted_at IS NULL", commentId).Scan(&authorId, &hiddenAt)
+		if err == sql.ErrNoRows {
+			return apperr.NotFound("comment with such id not found")
+		}
+		if err != nil {
+			log.Println("failed to get comment:", err)
+			return apperr.ErrInternal
+		}
+		if hiddenAt.Valid == hidden {
+			if hidden {
+				return apperr.Invalid("comment is already hidden")
+			}
+			return apperr.Invalid("comment is not hidden")
+		}
+		if hidden {
+			hiddenAt = sql.NullTime{Time: timestamp(time.Now()), Valid: true}
+		} else {
+			hiddenAt = sql.NullTime{}
+		}
+		if _, err := tx.exec(rqCtx, "UPDATE comments SET hidden_at = ? WHERE id = ?", hiddenAt, commentId); err != nil {
+			log.Println("failed to hide comment:", err)
+			return apperr.ErrInternal
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return db.GetComment(ctx, commId)
+}
+
+func (db *DB) SetUserRole(ctx context.Context, id string, role model.Role) (*model.User, error) {
+	actor, err := db.authorizedUser(ctx, auth.ScopeAccount)
+	if err != nil {
+		return nil, err
+	}
+	if err := policy.RequireRole(actor, model.RoleAdmin); err != nil {
+		return nil, err
+	}
+	// otherwise the last admin could leave nobody to hand the role out
+	if actor.ID == id {
+		return nil, apperr.Forbidden("can't change own role")
+	}
+	return db.GrantRole(ctx, id, role)
+}
+
+func (db *DB) GrantRole(ctx context.Context, id string, role model.Role) (*model.User, error) {
+	if !role.IsValid() {
+		return nil, apperr.Invalid("unknown role %q", role)
+	}
+	rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().Query)
+	defer cancel()
+	var user *model.User
+	err := db.transact(rqCtx, func(tx *DB) error {
+		var err error
+		user, err = tx.GetUser(rqCtx, id)
+		if err != nil {
+			return err
+		}
+		if user.Deleted {
+			return errUserNotFound
+		}
+		if _, err := tx.exec(rqCtx, "UPDATE users SET role = ? WHERE id = ?", fromRole(role), isnumber.TryConvertToInt(id)); err != nil {
+			log.Println("failed to set role:", err)
+			return apperr.ErrInternal
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	user.Role = role
+	return user, nil
+}
@@ -0,0 +1,203 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/idkwhyureadthis/ozon-task/graph/model"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/apperr"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/auth"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/isnumber"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/policy"
+)
+
+// A session is active until it is revoked or expires.
+const (
+	sessionColumns = "id, created_at, last_seen_at, expires_at, ip, user_agent"
+	activeSession  = "revoked_at IS NULL AND expires_at > ?"
+)
+
+// touchInterval is how often TouchSession writes down that a session is still in use.
+const touchInterval = time.Minute
+
+// timestamp is how times of sessions and API keys are kept: the same way as deleted_at,
+// in whole seconds of UTC, so that SQLite compares them as text correctly.
+func timestamp(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Second)
+}
+
+// toSession fills model.Session, current tells whether the request is made within it.
+func toSession(id string, createdAt, lastSeenAt, expiresAt time.Time, client auth.Client, current bool) *model.Session {
+	return &model.Session{
+		ID:         id,
+		CreatedAt:  createdAt.UTC().Format(time.RFC3339),
+		LastSeenAt: lastSeenAt.UTC().Format(time.RFC3339),
+		ExpiresAt:  expiresAt.UTC().Format(time.RFC3339),
+		IP:         client.IP,
+		UserAgent:  client.UserAgent,
+		Current:    current,
+	}
+}
+
+func scanSession(ctx context.Context, row scanner) (*model.Session, error) {
+	var (
+		id                               string
+		createdAt, lastSeenAt, expiresAt time.Time
+		client                           auth.Client
+	)
+	err := row.Scan(&id, &createdAt, &lastSeenAt, &expiresAt, &client.IP, &client.UserAgent)
+	if err != nil {
+		return nil, err
+	}
+	principal, _ := auth.PrincipalFrom(ctx)
+	return toSession(id, createdAt, lastSeenAt, expiresAt, client, principal.SessionID == id), nil
+}
+
+func (db *DB) CreateSession(ctx context.Context, userID string, client auth.Client, expiresAt time.Time) (*model.Session, error) {
+	rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().Query)
+	defer cancel()
+	now := timestamp(time.Now())
+	expiresAt = timestamp(expiresAt)
+	lastInsertId, err := db.insert(rqCtx, "INSERT INTO sessions (user_id, created_at, last_seen_at, expires_at, ip, user_agent) VALUES (?, ?, ?, ?, ?, ?)",
+		isnumber.TryConvertToInt(userID), now, now, expiresAt, client.IP, client.UserAgent)
+	if err != nil {
+		log.Println("failed to create session:", err)
+		return nil, apperr.ErrInternal
+	}
+	return toSession(fmt.Sprint(lastInsertId), now, now, expiresAt, client, false), nil
+}
+
+// touched tells whether a session last seen at lastSeenAt from seen needs no update for a request made now from client.
+func touched(seen auth.Client, lastSeenAt time.Time, client auth.Client, now time.Time) bool {
+	return seen == client && now.Sub(lastSeenAt) < touchInterval
+}
+
+// TouchSession checks that the session is active on every request, but writes down when and
+// where from it was seen only once in touchInterval or when the client changes.
+func (db *DB) TouchSession(ctx context.Context, principal auth.Principal, client auth.Client) error {
+	rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().Query)
+	defer cancel()
+	now := timestamp(time.Now())
+	sessionId, userId := isnumber.TryConvertToInt(principal.SessionID), isnumber.TryConvertToInt(principal.UserID)
+	var (
+		lastSeenAt    time.Time
+		ip, userAgent sql.NullString
+	)
+	err := db.queryRow(rqCtx, "SELECT last_seen_at, ip, user_agent FROM sessions WHERE id = ? AND user_id = ? AND "+activeSession,
+		sessionId, userId, now).Scan(&lastSeenAt, &ip, &userAgent)
+	if err == sql.ErrNoRows {
+		return auth.ErrSessionExpired
+	}
+	if err != nil {
+		return err
+	}
+	if touched(auth.Client{IP: ip.String, UserAgent: userAgent.String}, lastSeenAt, client, now) {
+		return nil
+	}
+	_, err = db.exec(rqCtx, "UPDATE sessions SET last_seen_at = ?, ip = ?, user_agent = ? WHERE id = ?", now, client.IP, client.UserAgent, sessionId)
+	return err
+}
+
+func (db *DB) GetSessions(ctx context.Context) ([]*model.Session, error) {
+	user, err := db.authorizedUser(ctx, auth.ScopeAccount)
+	if err != nil {
+		return nil, err
+	}
+	rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().Query)
+	defer cancel()
+	rows, err := db.query(rqCtx, "SELECT "+sessionColumns+" FROM sessions WHERE user_id = ? AND "+activeSession+
+		" ORDER BY last_seen_at DESC, id DESC", user.ID, timestamp(time.Now()))
+	if err != nil {
+		log.Println("failed to get sessions:", err)
+		return nil, apperr.ErrInternal
+	}
+	defer rows.Close()
+	sessions := []*model.Session{}
+	for rows.Next() {
+		session, err := scanSession(ctx, rows)
+		if err != nil {
+			log.Println("failed to scan session:", err)
+			return nil, apperr.ErrInternal
+		}
+		sessions = append(sessions, session)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("failed to read sessions:", err)
+		return nil, apperr.ErrInternal
+	}
+	return sessions, nil
+}
+
+func (db *DB) RevokeSession(ctx context.Context, id string) (*model.Session, error) {
+	user, err := db.authorizedUser(ctx, auth.ScopeAccount)
+	if err != nil {
+		return nil, err
+	}
+	rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().Query)
+	defer cancel()
+	err = db.transact(rqCtx, func(tx *DB) error {
+		var (
+			userId  string
+			revoked bool
+		)
+		err := tx.queryRow(rqCtx, "SELECT user_id, revoked_at IS NOT NULL FROM sessions WHERE id = ?", isnumber.TryConvertToInt(id)).Scan(&userId, &revoked)
+		if err == sql.ErrNoRows {
+			return apperr.NotFound("session with such id does not exist")
+		}
+		if err != nil {
+			log.Println("failed to get session:", err)
+			return apperr.ErrInternal
+		}
+		if err := policy.Check(user, policy.RevokeSession, userId); err != nil {
+			return err
+		}
+		if revoked {
+			return apperr.Invalid("session is already revoked")
+		}
+		if _, err := tx.exec(rqCtx, "UPDATE sessions SET revoked_at = ? WHERE id = ?", timestamp(time.Now()), isnumber.TryConvertToInt(id)); err != nil {
+			log.Println("failed to revoke session:", err)
+			return apperr.ErrInternal
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	session, err := scanSession(ctx, db.queryRow(rqCtx, "SELECT "+sessionColumns+" FROM sessions WHERE id = ?", isnumber.TryConvertToInt(id)))
+	if err != nil {
+		log.Println("failed to get session:", err)
+		return nil, apperr.ErrInternal
+	}
+	return session, nil
+}
+
+func (db *DB) RevokeAllSessions(ctx context.Context, exceptCurrent bool) (int, error) {
+	user, err := db.authorizedUser(ctx, auth.ScopeAccount)
+	if err != nil {
+		return 0, err
+	}
+	rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().Query)
+	defer cancel()
+	now := timestamp(time.Now())
+	query := "UPDATE sessions SET revoked_at = ? WHERE user_id = ? AND " + activeSession
+	args := []any{now, user.ID, now}
+	if exceptCurrent {
+		principal, _ := auth.PrincipalFrom(ctx)
+		query += " AND id <> ?"
+		args = append(args, isnumber.TryConvertToInt(principal.SessionID))
+	}
+	res, err := db.exec(rqCtx, query, args...)
+	if err != nil {
+		log.Println("failed to revoke sessions:", err)
+		return 0, apperr.ErrInternal
+	}
+	revoked, err := res.RowsAffected()
+	if err != nil {
+		log.Println("failed to revoke sessions:", err)
+		return 0, apperr.ErrInternal
+	}
+	return int(revoked), nil
+}
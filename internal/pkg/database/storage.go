@@ -0,0 +1,117 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/idkwhyureadthis/ozon-task/graph/model"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/apperr"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/auth"
+)
+
+const (
+	threadDepth   = 10
+	threadSize    = 100
+	maxThreadSize = 500
+)
+
+var (
+	errUserNotFound = apperr.NotFound("user with such id does not exist")
+	errPostNotFound = apperr.NotFound("post with such id not found")
+	// errDeletedActor is returned to requests made on behalf of a deleted user.
+	errDeletedActor = apperr.Unauthenticated("user with such id does not exist")
+)
+
+// Storage is everything resolvers need from a backend. DB keeps data in Postgres or SQLite,
+// Memory keeps it in the process and is selected with STORAGE=memory.
+type Storage interface {
+	CreateUser(ctx context.Context, input *model.CreateUserInput) (*model.User, error)
+	Register(ctx context.Context, input *model.RegisterInput, passwordHash string) (*model.User, error)
+	// GetCredentials returns the user registered with name and their password hash,
+	// or auth.ErrWrongPassword if there is none so that login can't tell which part was wrong.
+	// Login still checks the password then, with auth.CheckMissingPassword, so that it takes as long.
+	GetCredentials(ctx context.Context, name string) (*model.User, string, error)
+	// CreateEmailToken stores the hash of a single-use token for the user with email and reports
+	// whether there is such a user. Only failures of the server are errors, so that requests can't tell.
+	CreateEmailToken(ctx context.Context, email string, purpose auth.TokenPurpose, tokenHash string, expiresAt time.Time) (bool, error)
+	// ResetPassword uses a password reset token, its user gets passwordHash and loses every session.
+	ResetPassword(ctx context.Context, tokenHash string, passwordHash string) (*model.User, error)
+	VerifyEmail(ctx context.Context, tokenHash string) (*model.User, error)
+	// LinkIdentity returns the user identity of an external provider belongs to. An identity
+	// seen for the first time is linked to the user with its verified e-mail or to a new user.
+	LinkIdentity(ctx context.Context, identity auth.Identity) (*model.User, error)
+	GetUser(ctx context.Context, id string) (*model.User, error)
+	UpdateUser(ctx context.Context, input *model.UpdateUserInput) (*model.User, error)
+	GetUsersByIds(ctx context.Context, ids []string) ([]*model.User, []error)
+	DeleteUser(ctx context.Context, id string) (*model.User, error)
+	RestoreUser(ctx context.Context, id string) (*model.User, error)
+	// SetUserRole is for admins, who can't change their own role.
+	SetUserRole(ctx context.Context, id string, role model.Role) (*model.User, error)
+	// GrantRole sets the role of a user without asking who wants it, the command line
+	// uses it to appoint the first admin.
+	GrantRole(ctx context.Context, id string, role model.Role) (*model.User, error)
+
+	CreatePost(ctx context.Context, input *model.CreatePostInput) (*model.Post, error)
+	GetPost(ctx context.Context, id string) (*model.Post, error)
+	GetPosts(ctx context.Context, page Page) (*model.PostConnection, error)
+	UpdatePost(ctx context.Context, id string, input *model.UpdatePostInput) (*model.Post, error)
+	GetPostsByIds(ctx context.Context, ids []string) ([]*model.Post, []error)
+	DeletePost(ctx context.Context, id string) (*model.Post, error)
+	RestorePost(ctx context.Context, id string) (*model.Post, error)
+
+	CreateComment(ctx context.Context, input *model.CreateCommentInput) (*model.Comment, error)
+	GetComment(ctx context.Context, id string) (*model.Comment, error)
+	UpdateComment(ctx context.Context, commId string, input *model.UpdateCommentInput) (*model.Comment, error)
+	GetComments(ctx context.Context, postID string, page Page) (*model.CommentConnection, error)
+	GetReplies(ctx context.Context, commentId string, page Page) (*model.CommentConnection, error)
+	// GetRepliesByIds is GetReplies for many comments at once, the same page of each.
+	GetRepliesByIds(ctx context.Context, ids []string, page Page) ([]*model.CommentConnection, []error)
+	GetCommentsByIds(ctx context.Context, ids []string) ([]*model.Comment, []error)
+	GetThread(ctx context.Context, rootId string, maxDepth *int, limit *int) (*model.CommentThread, error)
+	DeleteComment(ctx context.Context, commId string) (*model.Comment, error)
+	RestoreComment(ctx context.Context, commId string) (*model.Comment, error)
+	// HideComment hides the comment from everyone but keeps it in threads, or shows it again.
+	HideComment(ctx context.Context, commId string, hidden bool) (*model.Comment, error)
+
+	// CreateSession opens a session of the user logging in from client.
+	CreateSession(ctx context.Context, userID string, client auth.Client, expiresAt time.Time) (*model.Session, error)
+	// TouchSession returns auth.ErrSessionExpired unless the session of principal is active,
+	// and records client as the last one seen using it otherwise.
+	TouchSession(ctx context.Context, principal auth.Principal, client auth.Client) error
+	GetSessions(ctx context.Context) ([]*model.Session, error)
+	RevokeSession(ctx context.Context, id string) (*model.Session, error)
+	RevokeAllSessions(ctx context.Context, exceptCurrent bool) (int, error)
+
+	// CreateAPIKey stores the hash of a new API key of the user making the request.
+	CreateAPIKey(ctx context.Context, name string, scopes []auth.Scope, keyHash string) (*model.APIKey, error)
+	// TouchAPIKey returns the principal of the API key with keyHash, auth.ErrInvalidToken if
+	// there is no such key or it is revoked, and records it as used.
+	TouchAPIKey(ctx context.Context, keyHash string) (auth.Principal, error)
+	GetAPIKeys(ctx context.Context) ([]*model.APIKey, error)
+	RevokeAPIKey(ctx context.Context, id string) (*model.APIKey, error)
+
+	// Purge removes rows deleted before the given time, which can't be restored anymore,
+	// and sessions, API keys and e-mail tokens that were revoked, used or expired before it.
+	// Identities of purged users are unlinked.
+	Purge(ctx context.Context, before time.Time) error
+
+	CommentAdded(ctx context.Context, postId string) <-chan *model.Comment
+	ReplyAdded(ctx context.Context, commentId string) <-chan *model.Comment
+
+	Close() error
+}
+
+// byIds lines values up with ids, ids missing from found get notFound as their error.
+func byIds[T any](ids []string, found map[string]T, notFound error) ([]T, []error) {
+	values := make([]T, len(ids))
+	errs := make([]error, len(ids))
+	for i, id := range ids {
+		value, ok := found[id]
+		if !ok {
+			errs[i] = notFound
+			continue
+		}
+		values[i] = value
+	}
+	return values, errs
+}
@@ -0,0 +1,201 @@
+package database
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/apperr"
+)
+
+// exportVersion is the version of the format written in the first line of an export.
+const exportVersion = 1
+
+// record is a line of an export: its header, a user, a post or a comment, told apart by Type.
+// Values look the same whichever dialect wrote them: times are in UTC and flags are booleans.
+type record struct {
+	Type    string `json:"type"`
+	Version int    `json:"version,omitempty"`
+	ID      int    `json:"id,omitempty"`
+
+	Name            string     `json:"name,omitempty"`
+	About           string     `json:"about,omitempty"`
+	Role            string     `json:"role,omitempty"`
+	Email           *string    `json:"email,omitempty"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at,omitempty"`
+	PasswordHash    *string    `json:"password_hash,omitempty"`
+
+	AuthorID    int    `json:"author_id,omitempty"`
+	PostID      int    `json:"post_id,omitempty"`
+	ParentID    *int   `json:"parent_id,omitempty"`
+	Text        string `json:"text,omitempty"`
+	Commentable bool   `json:"commentable,omitempty"`
+
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	HiddenAt  *time.Time `json:"hidden_at,omitempty"`
+}
+
+// nullTime is how times are exported, nil if there is none.
+func nullTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	exported := timestamp(t.Time)
+	return &exported
+}
+
+// exports are the tables in the order they are written and loaded: whatever a row refers to
+// comes before it, for comments it means parents before replies.
+var exports = []struct {
+	kind  string
+	table string
+	query string
+	scan  func(scanner, *record) error
+}{
+	{"user", "users", "SELECT id, name, COALESCE(about, ''), role, email, email_verified_at, password_hash, deleted_at FROM users ORDER BY id",
+		func(row scanner, r *record) error {
+			var emailVerifiedAt, deletedAt sql.NullTime
+			err := row.Scan(&r.ID, &r.Name, &r.About, &r.Role, &r.Email, &emailVerifiedAt, &r.PasswordHash, &deletedAt)
+			r.EmailVerifiedAt, r.DeletedAt = nullTime(emailVerifiedAt), nullTime(deletedAt)
+			return err
+		}},
+	{"post", "posts", "SELECT id, author_id, data, is_commentable, deleted_at FROM posts ORDER BY id",
+		func(row scanner, r *record) error {
+			var deletedAt sql.NullTime
+			err := row.Scan(&r.ID, &r.AuthorID, &r.Text, &r.Commentable, &deletedAt)
+			r.DeletedAt = nullTime(deletedAt)
+			return err
+		}},
+	{"comment", "comments", "SELECT id, post_id, author_id, parent_id, data, deleted_at, hidden_at FROM comments ORDER BY depth, id",
+		func(row scanner, r *record) error {
+			var deletedAt, hiddenAt sql.NullTime
+			err := row.Scan(&r.ID, &r.PostID, &r.AuthorID, &r.ParentID, &r.Text, &deletedAt, &hiddenAt)
+			r.DeletedAt, r.HiddenAt = nullTime(deletedAt), nullTime(hiddenAt)
+			return err
+		}},
+}
+
+// Export writes users, posts and comments to w as JSON Lines, row by row from a single snapshot.
+// Rows keep their ids, so the same data is exported the same way from Postgres and SQLite.
+func (db *DB) Export(ctx context.Context, w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	return db.snapshot(ctx, func(tx *DB) error {
+		if err := encoder.Encode(record{Type: "export", Version: exportVersion}); err != nil {
+			return err
+		}
+		for _, export := range exports {
+			if err := tx.exportTable(ctx, encoder, export.kind, export.query, export.scan); err != nil {
+				return fmt.Errorf("failed to export %s: %w", export.table, err)
+			}
+		}
+		return nil
+	})
+}
+
+func (db *DB) exportTable(ctx context.Context, encoder *json.Encoder, kind string, query string, scan func(scanner, *record) error) error {
+	rows, err := db.query(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		r := record{Type: kind}
+		if err := scan(rows, &r); err != nil {
+			return err
+		}
+		if err := encoder.Encode(r); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Import loads what Export wrote in a single transaction. Rows keep their ids, which is why
+// the tables have to be empty, and Postgres sequences continue after the greatest of them.
+// The transaction is attempted once, another attempt couldn't read r again.
+func (db *DB) Import(ctx context.Context, r io.Reader) error {
+	_, err := db.attempt(ctx, func(tx *DB) error {
+		for _, export := range exports {
+			var taken bool
+			if err := tx.queryRow(ctx, "SELECT EXISTS (SELECT 1 FROM "+export.table+")").Scan(&taken); err != nil {
+				return err
+			}
+			if taken {
+				return apperr.Invalid("can't import into a database with %s, it should be empty", export.table)
+			}
+		}
+		lines := bufio.NewScanner(r)
+		lines.Buffer(nil, 16<<20)
+		line := 0
+		for lines.Scan() {
+			line++
+			var r record
+			if err := json.Unmarshal(lines.Bytes(), &r); err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+			if line == 1 {
+				if r.Type != "export" || r.Version != exportVersion {
+					return apperr.Invalid("line 1: expected the header of an export of version %d", exportVersion)
+				}
+				continue
+			}
+			if err := tx.importRecord(ctx, r); err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+		}
+		if err := lines.Err(); err != nil {
+			return err
+		}
+		if line == 0 {
+			return apperr.Invalid("nothing to import")
+		}
+		return tx.continueSequences(ctx)
+	})
+	return err
+}
+
+func (db *DB) importRecord(ctx context.Context, r record) error {
+	var err error
+	switch r.Type {
+	case "user":
+		_, err = db.exec(ctx, "INSERT INTO users (id, name, about, role, email, email_verified_at, password_hash, deleted_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			r.ID, r.Name, r.About, r.Role, r.Email, r.EmailVerifiedAt, r.PasswordHash, r.DeletedAt)
+	case "post":
+		commentable := 0
+		if r.Commentable {
+			commentable = 1
+		}
+		_, err = db.exec(ctx, "INSERT INTO posts (id, author_id, data, is_commentable, deleted_at) VALUES (?, ?, ?, ?, ?)",
+			r.ID, r.AuthorID, r.Text, commentable, r.DeletedAt)
+	case "comment":
+		// path and depth are filled in by the comments_set_path trigger
+		_, err = db.exec(ctx, "INSERT INTO comments (id, post_id, author_id, parent_id, data, deleted_at, hidden_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			r.ID, r.PostID, r.AuthorID, r.ParentID, r.Text, r.DeletedAt, r.HiddenAt)
+	default:
+		return apperr.Invalid("unknown record type %q", r.Type)
+	}
+	if err != nil {
+		log.Println("failed to import", r.Type, err)
+	}
+	return err
+}
+
+// continueSequences makes ids Postgres gives out next greater than the imported ones.
+// SQLite needs nothing, it picks the id after the greatest.
+func (db *DB) continueSequences(ctx context.Context) error {
+	if db.Dialect != Postgres {
+		return nil
+	}
+	for _, export := range exports {
+		_, err := db.exec(ctx, fmt.Sprintf("SELECT setval(pg_get_serial_sequence('%[1]s', 'id'), MAX(id)) FROM %[1]s", export.table))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
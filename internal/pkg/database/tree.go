@@ -0,0 +1,157 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/idkwhyureadthis/ozon-task/graph/model"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/apperr"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/isnumber"
+)
+
+// Comments are stored as a materialized path: every comment keeps the zero padded ids of
+// its thread from the root down to itself, e.g. "0000000001/0000000005/". Sorting by path
+// walks a thread depth-first and the subtree of a comment is the range of paths from its
+// own path up to that path followed by pathEnd, which sorts after digits and separators.
+const (
+	pathSegmentLength = 10
+	pathSeparator     = "/"
+	pathEnd           = "~"
+)
+
+// commentPath returns the path of comment id replying to the comment with parentPath,
+// parentPath is empty for comments on the post itself. Migrations build the same paths in SQL.
+func commentPath(parentPath string, id int) string {
+	return fmt.Sprintf("%s%0*d%s", parentPath, pathSegmentLength, id, pathSeparator)
+}
+
+// threadRoot returns id of the top-level comment a path belongs to or -1
+// when the path is a top-level comment itself.
+func threadRoot(path string) string {
+	segments := strings.Split(strings.TrimSuffix(path, pathSeparator), pathSeparator)
+	if len(segments) < 2 {
+		return "-1"
+	}
+	root, err := strconv.Atoi(segments[0])
+	if err != nil {
+		return "-1"
+	}
+	return fmt.Sprint(root)
+}
+
+// subtreeOf is the condition selecting the comment with the given id and every reply under it.
+const subtreeOf = "path >= (SELECT path FROM comments WHERE id = ?) AND path < (SELECT path FROM comments WHERE id = ?) || '" + pathEnd + "'"
+
+// subtree returns the comment with id followed by all of its replies in depth-first order.
+func (db *DB) subtree(ctx context.Context, id int) ([]*model.Comment, error) {
+	rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().LongQuery)
+	defer cancel()
+	rows, err := db.query(rqCtx, "SELECT "+commentColumns+" FROM comments WHERE "+subtreeOf+" ORDER BY path", id, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	comments := []*model.Comment{}
+	for rows.Next() {
+		comment, err := scanComment(rows)
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, comment)
+	}
+	return comments, rows.Err()
+}
+
+// descendantsCount returns how many replies are there under the comment with id, at any depth.
+func (db *DB) descendantsCount(ctx context.Context, id int) (int, error) {
+	rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().LongQuery)
+	defer cancel()
+	var count int
+	err := db.queryRow(rqCtx, "SELECT COUNT(*) FROM comments WHERE "+subtreeOf+" AND id <> ?", id, id, id).Scan(&count)
+	return count, err
+}
+
+// threadBounds checks commentThread arguments and fills in the defaults for missing ones.
+func threadBounds(maxDepth *int, limit *int) (int, int, error) {
+	depth, size := threadDepth, threadSize
+	if maxDepth != nil {
+		if *maxDepth < 0 {
+			return 0, 0, apperr.Invalid("maxDepth should not be negative")
+		}
+		depth = *maxDepth
+	}
+	if limit != nil {
+		if *limit < 1 || *limit > maxThreadSize {
+			return 0, 0, apperr.Invalid("limit should be between 1 and %d", maxThreadSize)
+		}
+		size = *limit
+	}
+	return depth, size, nil
+}
+
+// buildThread nests comments listed depth-first under the first of them. repliesCount holds
+// how many direct replies every comment has, comments with some of them cut off by depth
+// or size limits are marked with MoreReplies.
+func buildThread(comments []*model.Comment, repliesCount map[string]int) *model.CommentThread {
+	threads := map[string]*model.CommentThread{}
+	for _, comment := range comments {
+		thread := &model.CommentThread{Comment: comment, Replies: []*model.CommentThread{}}
+		threads[comment.ID] = thread
+		if parent, ok := threads[comment.AnswerTo]; ok {
+			parent.Replies = append(parent.Replies, thread)
+		}
+	}
+	for id, thread := range threads {
+		thread.MoreReplies = len(thread.Replies) < repliesCount[id]
+	}
+	return threads[comments[0].ID]
+}
+
+func emptyThread() *model.CommentThread {
+	return &model.CommentThread{Comment: &model.Comment{}, Replies: []*model.CommentThread{}}
+}
+
+// GetThread returns the comment rootId with replies down to maxDepth levels under it,
+// at most limit comments in total taken in depth-first order.
+func (db *DB) GetThread(ctx context.Context, rootId string, maxDepth *int, limit *int) (*model.CommentThread, error) {
+	depth, size, err := threadBounds(maxDepth, limit)
+	if err != nil {
+		return nil, err
+	}
+	rqCtx, cancel := context.WithTimeout(ctx, db.timeouts().LongQuery)
+	defer cancel()
+	rows, err := db.query(rqCtx, `
+	WITH RECURSIVE thread (id, level) AS (
+		SELECT id, 0 FROM comments WHERE id = ?
+		UNION ALL
+		SELECT comments.id, thread.level + 1 FROM comments JOIN thread ON comments.parent_id = thread.id
+		WHERE thread.level < ?
+	)
+	SELECT `+commentColumns+`, (SELECT COUNT(*) FROM comments replies WHERE replies.parent_id = comments.id AND `+visibleReply+`)
+	FROM comments WHERE id IN (SELECT id FROM thread) AND `+visibleComment+` ORDER BY path LIMIT ?`,
+		isnumber.TryConvertToInt(rootId), depth, size)
+	if err != nil {
+		log.Println("error getting thread", err)
+		return nil, apperr.ErrInternal
+	}
+	defer rows.Close()
+	comments := []*model.Comment{}
+	repliesCount := map[string]int{}
+	for rows.Next() {
+		var count int
+		comment, err := scanComment(rows, &count)
+		if err != nil {
+			log.Println("error decoding comment", err)
+			return nil, apperr.ErrInternal
+		}
+		comments = append(comments, comment)
+		repliesCount[comment.ID] = count
+	}
+	if len(comments) == 0 {
+		return nil, apperr.NotFound("comment with such id does not exits")
+	}
+	return buildThread(comments, repliesCount), nil
+}
@@ -0,0 +1,129 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"time"
+
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/apperr"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	// txAttempts is how many times transact runs a transaction that keeps conflicting with concurrent ones.
+	txAttempts = 10
+	// minBackoff and maxBackoff bound the ceiling of the pause before the next attempt.
+	minBackoff = 5 * time.Millisecond
+	maxBackoff = 500 * time.Millisecond
+)
+
+// tx is the transaction a DB given to transact's or snapshot's fn runs its queries in.
+type tx struct {
+	querier
+	// retry is set when a query failed in a way that running the transaction again may fix.
+	// fn can't be asked for that: it logs driver errors and returns apperr.ErrInternal instead.
+	retry bool
+}
+
+// transact runs fn in a transaction, which is committed if fn returns nil and rolled back
+// otherwise. Queries of the DB fn gets run in the transaction. When the transaction fails to
+// serialize with concurrent ones in Postgres or finds SQLite locked, it is run again from the
+// start, so fn shouldn't do anything besides queries; events are published after transact returns.
+// Calls made within fn join its transaction.
+func (db *DB) transact(ctx context.Context, fn func(tx *DB) error) error {
+	if db.tx != nil {
+		return fn(db)
+	}
+	var err error
+	for attempt := 1; attempt <= txAttempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(backoff(attempt)):
+			}
+		}
+		var retry bool
+		if retry, err = db.attempt(ctx, fn); !retry {
+			return err
+		}
+	}
+	return err
+}
+
+// backoff returns the pause before the attempt: between a half and the whole of a ceiling
+// that doubles with every attempt, random so that transactions that conflicted with each
+// other don't meet again on the next one.
+func backoff(attempt int) time.Duration {
+	ceiling := minBackoff
+	for i := 2; i < attempt && ceiling < maxBackoff; i++ {
+		ceiling *= 2
+	}
+	ceiling = min(ceiling, maxBackoff)
+	return ceiling/2 + rand.N(ceiling/2+1)
+}
+
+// attempt runs fn in a transaction once and tells whether it is worth another try.
+func (db *DB) attempt(ctx context.Context, fn func(tx *DB) error) (bool, error) {
+	sqlTx, err := db.Client.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		log.Println("failed to begin transaction:", err)
+		return retryable(err), apperr.ErrInternal
+	}
+	txDB := *db
+	txDB.tx = &tx{querier: sqlTx}
+	if err := fn(&txDB); err != nil {
+		sqlTx.Rollback()
+		return txDB.tx.retry, err
+	}
+	if err := sqlTx.Commit(); err != nil {
+		log.Println("failed to commit transaction:", err)
+		return retryable(err), apperr.ErrInternal
+	}
+	return false, nil
+}
+
+// retryable tells whether err comes from a conflict with concurrent transactions:
+// a serialization failure or deadlock in Postgres, a busy or locked database in SQLite.
+func retryable(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "40001" || pqErr.Code == "40P01"
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+	return false
+}
+
+// snapshot runs fn reading from a single snapshot of the database: a read-only repeatable
+// read transaction in Postgres and a deferred one in SQLite, where transactions begun the
+// usual way would take the write lock. It is never retried, so fn may write out what it reads.
+func (db *DB) snapshot(ctx context.Context, fn func(tx *DB) error) error {
+	txDB := *db
+	if db.Dialect == Postgres {
+		sqlTx, err := db.Client.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+		if err != nil {
+			return err
+		}
+		defer sqlTx.Rollback()
+		txDB.tx = &tx{querier: sqlTx}
+		return fn(&txDB)
+	}
+	conn, err := db.Client.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "BEGIN DEFERRED"); err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), "ROLLBACK")
+	txDB.tx = &tx{querier: conn}
+	return fn(&txDB)
+}
@@ -0,0 +1,117 @@
+package loaders
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/graph-gophers/dataloader/v7"
+	"github.com/idkwhyureadthis/ozon-task/graph/model"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/database"
+)
+
+type loadersKey struct{}
+
+// Loaders batch lookups by id made while resolving one request into a single query per type.
+type Loaders struct {
+	UserById    *dataloader.Loader[string, *model.User]
+	PostById    *dataloader.Loader[string, *model.Post]
+	CommentById *dataloader.Loader[string, *model.Comment]
+	// RepliesByKey loads pages of replies, a query per distinct page rather than per comment.
+	RepliesByKey *dataloader.Loader[RepliesKey, *model.CommentConnection]
+}
+
+func New(storage database.Storage) *Loaders {
+	return &Loaders{
+		UserById:     dataloader.NewBatchedLoader(batch(storage.GetUsersByIds)),
+		PostById:     dataloader.NewBatchedLoader(batch(storage.GetPostsByIds)),
+		CommentById:  dataloader.NewBatchedLoader(batch(storage.GetCommentsByIds)),
+		RepliesByKey: dataloader.NewBatchedLoader(batchReplies(storage)),
+	}
+}
+
+// RepliesKey asks for the page of replies to the comment with CommentID. The arguments of
+// Comment.replies are kept by value, so that the same pages compare equal.
+type RepliesKey struct {
+	CommentID string
+	First     int
+	After     string
+	// HasFirst and HasAfter tell whether First and After were given.
+	HasFirst, HasAfter bool
+}
+
+func NewRepliesKey(commentID string, first *int, after *string) RepliesKey {
+	key := RepliesKey{CommentID: commentID}
+	if first != nil {
+		key.First, key.HasFirst = *first, true
+	}
+	if after != nil {
+		key.After, key.HasAfter = *after, true
+	}
+	return key
+}
+
+func (k RepliesKey) page() database.Page {
+	var page database.Page
+	if k.HasFirst {
+		page.First = &k.First
+	}
+	if k.HasAfter {
+		page.After = &k.After
+	}
+	return page
+}
+
+// batchReplies groups keys by page and asks storage for the replies of each group at once.
+func batchReplies(storage database.Storage) dataloader.BatchFunc[RepliesKey, *model.CommentConnection] {
+	return func(ctx context.Context, keys []RepliesKey) []*dataloader.Result[*model.CommentConnection] {
+		results := make([]*dataloader.Result[*model.CommentConnection], len(keys))
+		groups := map[RepliesKey][]int{}
+		for i, key := range keys {
+			page := key
+			page.CommentID = ""
+			groups[page] = append(groups[page], i)
+		}
+		for page, indexes := range groups {
+			ids := make([]string, len(indexes))
+			for j, i := range indexes {
+				ids[j] = keys[i].CommentID
+			}
+			connections, errs := storage.GetRepliesByIds(ctx, ids, page.page())
+			for j, i := range indexes {
+				results[i] = &dataloader.Result[*model.CommentConnection]{Data: connections[j], Error: errs[j]}
+			}
+		}
+		return results
+	}
+}
+
+func batch[V any](get func(context.Context, []string) ([]V, []error)) dataloader.BatchFunc[string, V] {
+	return func(ctx context.Context, ids []string) []*dataloader.Result[V] {
+		values, errs := get(ctx, ids)
+		results := make([]*dataloader.Result[V], len(ids))
+		for i := range ids {
+			results[i] = &dataloader.Result[V]{Data: values[i], Error: errs[i]}
+		}
+		return results
+	}
+}
+
+// Middleware gives every request its own Loaders, so nothing is cached between requests.
+// Websocket connections are skipped as they live too long for a cache, For returns nil for them.
+func Middleware(storage database.Storage) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Upgrade") == "websocket" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx := context.WithValue(r.Context(), loadersKey{}, New(storage))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func For(ctx context.Context) *Loaders {
+	loaders, _ := ctx.Value(loadersKey{}).(*Loaders)
+	return loaders
+}
@@ -0,0 +1,92 @@
+package loaders
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/idkwhyureadthis/ozon-task/graph/model"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/auth"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/database"
+	"github.com/stretchr/testify/require"
+)
+
+type countingStorage struct {
+	*database.Memory
+	userBatches    atomic.Int32
+	repliesBatches atomic.Int32
+}
+
+func (s *countingStorage) GetRepliesByIds(ctx context.Context, ids []string, page database.Page) ([]*model.CommentConnection, []error) {
+	s.repliesBatches.Add(1)
+	return s.Memory.GetRepliesByIds(ctx, ids, page)
+}
+
+func (s *countingStorage) GetUsersByIds(ctx context.Context, ids []string) ([]*model.User, []error) {
+	s.userBatches.Add(1)
+	return s.Memory.GetUsersByIds(ctx, ids)
+}
+
+func TestUsersAreLoadedInOneBatch(t *testing.T) {
+	storage := &countingStorage{Memory: database.NewMemory()}
+	ctx := context.Background()
+	for i := range 10 {
+		_, err := storage.CreateUser(ctx, &model.CreateUserInput{Name: fmt.Sprint("user", i)})
+		require.NoError(t, err)
+	}
+
+	loaders := New(storage)
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			user, err := loaders.UserById.Load(ctx, fmt.Sprint(i+1))()
+			require.NoError(t, err)
+			require.Equal(t, fmt.Sprint("user", i), user.Name)
+		}()
+	}
+	wg.Wait()
+
+	_, err := loaders.UserById.Load(ctx, "42")()
+	require.EqualError(t, err, "user with such id does not exist")
+	require.Equal(t, int32(2), storage.userBatches.Load())
+}
+
+func TestRepliesAreLoadedInOneBatchPerPage(t *testing.T) {
+	storage := &countingStorage{Memory: database.NewMemory()}
+	author, err := storage.CreateUser(context.Background(), &model.CreateUserInput{Name: "author"})
+	require.NoError(t, err)
+	ctx := auth.WithPrincipal(context.Background(), auth.Principal{UserID: author.ID})
+	post, err := storage.CreatePost(ctx, &model.CreatePostInput{Data: "post", Commentable: true})
+	require.NoError(t, err)
+	for i := range 10 {
+		comment, err := storage.CreateComment(ctx, &model.CreateCommentInput{Post: post.ID, Text: fmt.Sprint("comment", i), AnswerTo: "-1"})
+		require.NoError(t, err)
+		_, err = storage.CreateComment(ctx, &model.CreateCommentInput{Post: post.ID, Text: "reply", AnswerTo: comment.ID})
+		require.NoError(t, err)
+	}
+
+	loaders := New(storage)
+	one := 1
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			replies, err := loaders.RepliesByKey.Load(ctx, NewRepliesKey(fmt.Sprint(2*i+1), nil, nil))()
+			require.NoError(t, err)
+			require.Equal(t, 1, replies.TotalCount)
+		}()
+		go func() {
+			defer wg.Done()
+			replies, err := loaders.RepliesByKey.Load(ctx, NewRepliesKey(fmt.Sprint(2*i+1), &one, nil))()
+			require.NoError(t, err)
+			require.Len(t, replies.Edges, 1)
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(2), storage.repliesBatches.Load())
+}
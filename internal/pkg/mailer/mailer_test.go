@@ -0,0 +1,127 @@
+package mailer
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"log"
+	"mime"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// received is what the SMTP stand-in got from one client.
+type received struct {
+	auth string
+	from string
+	to   []string
+	data string
+}
+
+// serveSMTP accepts one connection on a local port and speaks just enough SMTP to take a message.
+func serveSMTP(t *testing.T) (string, <-chan received) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	messages := make(chan received, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		text := textproto.NewConn(conn)
+		var msg received
+		text.PrintfLine("220 localhost ESMTP")
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			command, arg, _ := strings.Cut(line, " ")
+			switch strings.ToUpper(command) {
+			case "EHLO", "HELO":
+				text.PrintfLine("250-localhost")
+				text.PrintfLine("250-8BITMIME")
+				text.PrintfLine("250 AUTH PLAIN")
+			case "AUTH":
+				credentials, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(arg, "PLAIN "))
+				msg.auth = string(credentials)
+				text.PrintfLine("235 authenticated")
+			case "MAIL":
+				msg.from = arg
+				text.PrintfLine("250 ok")
+			case "RCPT":
+				msg.to = append(msg.to, arg)
+				text.PrintfLine("250 ok")
+			case "DATA":
+				text.PrintfLine("354 go ahead")
+				data, err := text.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				msg.data = string(data)
+				text.PrintfLine("250 queued")
+			case "QUIT":
+				text.PrintfLine("221 bye")
+				messages <- msg
+				return
+			default:
+				text.PrintfLine("502 not implemented")
+			}
+		}
+	}()
+	return listener.Addr().String(), messages
+}
+
+func TestSMTP(t *testing.T) {
+	addr, messages := serveSMTP(t)
+	mailer := &SMTP{Addr: addr, From: "noreply@ozon-task.local", Username: "bot", Password: "secret"}
+
+	err := mailer.Send(context.Background(), Message{
+		To:      "srgold78@example.com",
+		Subject: "Сброс пароля",
+		Body:    "first line\n.second line starts with a dot",
+	})
+	require.NoError(t, err)
+
+	msg := <-messages
+	require.Equal(t, "\x00bot\x00secret", msg.auth)
+	require.Equal(t, "FROM:<noreply@ozon-task.local> BODY=8BITMIME", msg.from)
+	require.Equal(t, []string{"TO:<srgold78@example.com>"}, msg.to)
+
+	header, body, ok := strings.Cut(msg.data, "\n\n")
+	require.True(t, ok)
+	parsed, err := textproto.NewReader(bufio.NewReader(strings.NewReader(header + "\n\n"))).ReadMIMEHeader()
+	require.NoError(t, err)
+	require.Equal(t, "srgold78@example.com", parsed.Get("To"))
+	subject, err := new(mime.WordDecoder).DecodeHeader(parsed.Get("Subject"))
+	require.NoError(t, err)
+	require.Equal(t, "Сброс пароля", subject)
+	require.Equal(t, "first line\n.second line starts with a dot\n", body)
+}
+
+func TestSMTPFailsWithoutServer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+
+	mailer := &SMTP{Addr: addr, From: "noreply@ozon-task.local"}
+	require.Error(t, mailer.Send(context.Background(), Message{To: "srgold78@example.com"}))
+}
+
+func TestLogHidesBodies(t *testing.T) {
+	var out strings.Builder
+	msg := Message{To: "srgold78@example.com", Subject: "Reset your password", Body: "token"}
+	require.NoError(t, Log{Logger: log.New(&out, "", 0)}.Send(context.Background(), msg))
+	require.Equal(t, "mail to srgold78@example.com: Reset your password (body is not logged)\n", out.String())
+
+	out.Reset()
+	require.NoError(t, Log{Logger: log.New(&out, "", 0), Bodies: true}.Send(context.Background(), msg))
+	require.Equal(t, "mail to srgold78@example.com: Reset your password\ntoken\n", out.String())
+}
@@ -2,16 +2,135 @@ package mw
 
 import (
 	"context"
+	"errors"
+	"log"
+	"net"
 	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/99designs/gqlgen/graphql/handler/transport"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/auth"
 )
 
-func AuthMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		userHeader := r.Header.Get("user")
-		ctx := r.Context()
-		if userHeader != "" {
-			ctx = context.WithValue(ctx, "user", userHeader)
+// bearer returns the token of an "Authorization: Bearer <token>" value.
+func bearer(authorization string) (string, bool) {
+	token, ok := strings.CutPrefix(authorization, "Bearer ")
+	return strings.TrimSpace(token), ok
+}
+
+// Credentials is the part of database.Storage tokens and API keys are checked against.
+type Credentials interface {
+	TouchSession(ctx context.Context, principal auth.Principal, client auth.Client) error
+	TouchAPIKey(ctx context.Context, keyHash string) (auth.Principal, error)
+}
+
+// RealIP applies chi's RealIP middleware to requests coming from trusted proxies. Anyone
+// else could send X-Forwarded-For or X-Real-IP to pose as another address, so their
+// requests keep the address they came from.
+func RealIP(trusted []netip.Prefix) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		forwarded := middleware.RealIP(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if fromProxy(r, trusted) {
+				forwarded.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// fromProxy tells whether r was sent by one of the trusted proxies.
+func fromProxy(r *http.Request, trusted []netip.Prefix) bool {
+	addr, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	for _, prefix := range trusted {
+		if prefix.Contains(addr.Addr().Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// client describes r, RemoteAddr is expected to be the real address of the client
+// already, set by RealIP behind a trusted proxy.
+func client(r *http.Request) auth.Client {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return auth.Client{IP: ip, UserAgent: r.UserAgent()}
+}
+
+// authenticate looks up an API key or verifies an access token and checks that its session is still active.
+func authenticate(ctx context.Context, tokens *auth.Tokens, credentials Credentials, token string) (auth.Principal, error) {
+	if auth.IsAPIKey(token) {
+		return credentials.TouchAPIKey(ctx, auth.HashAPIKey(token))
+	}
+	principal, err := tokens.Verify(token)
+	if err != nil {
+		return auth.Principal{}, err
+	}
+	if err := credentials.TouchSession(ctx, principal, auth.ClientFrom(ctx)); err != nil {
+		return auth.Principal{}, err
+	}
+	return principal, nil
+}
+
+// AuthMiddleware verifies the access token or API key sent in the Authorization header
+// and puts its principal into the request context. Requests without a token go on anonymously,
+// requests with a token that can't be verified or whose session is over and with unknown
+// or revoked API keys are rejected.
+func AuthMiddleware(tokens *auth.Tokens, credentials Credentials) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := auth.WithClient(r.Context(), client(r))
+			authorization := r.Header.Get("Authorization")
+			if authorization == "" {
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+			token, ok := bearer(authorization)
+			if !ok {
+				http.Error(w, "wrong authorization header provided", http.StatusUnauthorized)
+				return
+			}
+			principal, err := authenticate(ctx, tokens, credentials, token)
+			switch {
+			case errors.Is(err, auth.ErrInvalidToken), errors.Is(err, auth.ErrSessionExpired):
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			case err != nil:
+				log.Println("failed to check session:", err)
+				http.Error(w, "server error occurred", http.StatusInternalServerError)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(auth.WithPrincipal(ctx, principal)))
+		})
+	}
+}
+
+// WebsocketInit does the same as AuthMiddleware for subscriptions, where browsers
+// can't set headers and pass the Authorization value in the connection_init payload instead.
+// The session is checked once when the connection is opened.
+func WebsocketInit(tokens *auth.Tokens, credentials Credentials) transport.WebsocketInitFunc {
+	return func(ctx context.Context, initPayload transport.InitPayload) (context.Context, *transport.InitPayload, error) {
+		authorization := initPayload.Authorization()
+		if authorization == "" {
+			return ctx, &initPayload, nil
+		}
+		token, ok := bearer(authorization)
+		if !ok {
+			return ctx, nil, errors.New("wrong authorization provided")
+		}
+		principal, err := authenticate(ctx, tokens, credentials, token)
+		if err != nil {
+			return ctx, nil, err
 		}
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
+		return auth.WithPrincipal(ctx, principal), &initPayload, nil
+	}
 }
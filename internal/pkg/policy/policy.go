@@ -0,0 +1,101 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/idkwhyureadthis/ozon-task/graph/model"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/apperr"
+)
+
+// Action is what a mutation does to a user, a post or a comment. Actions are
+// named in @owner directives of the schema.
+type Action string
+
+const (
+	EditPost       Action = "edit post"
+	DeletePost     Action = "delete post"
+	RestorePost    Action = "restore post"
+	EditComment    Action = "edit comment"
+	DeleteComment  Action = "delete comment"
+	RestoreComment Action = "restore comment"
+	DeleteUser     Action = "delete user"
+	RestoreUser    Action = "restore user"
+	RevokeSession  Action = "revoke session"
+	RevokeAPIKey   Action = "revoke api key"
+)
+
+type rule struct {
+	// role is the lowest role that may do the action to what others own, none if empty
+	role model.Role
+	// denied is reported to those who may not
+	denied string
+}
+
+var rules = map[Action]rule{
+	EditPost:       {role: model.RoleAdmin, denied: "cant change post of other users"},
+	DeletePost:     {role: model.RoleAdmin, denied: "can't delete post of other users"},
+	RestorePost:    {role: model.RoleAdmin, denied: "can't restore post of other users"},
+	EditComment:    {role: model.RoleModerator, denied: "can't edit comment of other person"},
+	DeleteComment:  {role: model.RoleModerator, denied: "can't delete comment of other person"},
+	RestoreComment: {role: model.RoleModerator, denied: "can't restore comment of other person"},
+	DeleteUser:     {role: model.RoleAdmin, denied: "can't delete other users"},
+	RestoreUser:    {role: model.RoleAdmin, denied: "can't restore other users"},
+	RevokeSession:  {denied: "can't revoke session of other users"},
+	RevokeAPIKey:   {denied: "can't revoke api key of other users"},
+}
+
+// rank orders roles, each of them may do everything the lower ones may.
+func rank(role model.Role) int {
+	switch role {
+	case model.RoleModerator:
+		return 1
+	case model.RoleAdmin:
+		return 2
+	}
+	return 0
+}
+
+// HasRole reports whether actor has role or a higher one.
+func HasRole(actor *model.User, role model.Role) bool {
+	return rank(actor.Role) >= rank(role)
+}
+
+// RequireRole returns nil if actor has role or a higher one, or the error to report otherwise.
+func RequireRole(actor *model.User, role model.Role) error {
+	if HasRole(actor, role) {
+		return nil
+	}
+	return apperr.Forbidden("%s role is required", strings.ToLower(string(role)))
+}
+
+var ErrUnknownAction = errors.New("unknown action")
+
+// Check returns nil if actor may do action to something owned by the user with ownerID,
+// or the error to report otherwise. Everyone may do any action to what they own.
+func Check(actor *model.User, action Action, ownerID string) error {
+	rule, ok := rules[action]
+	if !ok {
+		return ErrUnknownAction
+	}
+	if actor.ID == ownerID {
+		return nil
+	}
+	if rule.role != "" && HasRole(actor, rule.role) {
+		return nil
+	}
+	return apperr.Forbidden("%s", rule.denied)
+}
+
+type actorKey struct{}
+
+// WithActor keeps the user a request is made by, so that it is looked up once per field.
+func WithActor(ctx context.Context, actor *model.User) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+func ActorFrom(ctx context.Context) (*model.User, bool) {
+	actor, ok := ctx.Value(actorKey{}).(*model.User)
+	return actor, ok
+}
@@ -0,0 +1,49 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/idkwhyureadthis/ozon-task/graph/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheck(t *testing.T) {
+	user := &model.User{ID: "1", Role: model.RoleUser}
+	moderator := &model.User{ID: "2", Role: model.RoleModerator}
+	admin := &model.User{ID: "3", Role: model.RoleAdmin}
+
+	for _, test := range []struct {
+		actor   *model.User
+		action  Action
+		owner   string
+		allowed bool
+	}{
+		{user, EditComment, "1", true},
+		{user, EditComment, "2", false},
+		{moderator, EditComment, "1", true},
+		{moderator, RestoreComment, "1", true},
+		{moderator, EditPost, "1", false},
+		{moderator, DeleteUser, "1", false},
+		{admin, DeletePost, "1", true},
+		{admin, RestoreUser, "1", true},
+		{admin, RevokeSession, "1", false},
+		{admin, RevokeSession, "3", true},
+	} {
+		err := Check(test.actor, test.action, test.owner)
+		if test.allowed {
+			require.NoError(t, err, "%s %s of %s", test.actor.Role, test.action, test.owner)
+		} else {
+			require.Error(t, err, "%s %s of %s", test.actor.Role, test.action, test.owner)
+		}
+	}
+
+	require.EqualError(t, Check(user, DeleteComment, "2"), "can't delete comment of other person")
+	require.ErrorIs(t, Check(user, Action("fly"), "1"), ErrUnknownAction)
+}
+
+func TestHasRole(t *testing.T) {
+	moderator := &model.User{ID: "2", Role: model.RoleModerator}
+	require.True(t, HasRole(moderator, model.RoleUser))
+	require.True(t, HasRole(moderator, model.RoleModerator))
+	require.False(t, HasRole(moderator, model.RoleAdmin))
+}
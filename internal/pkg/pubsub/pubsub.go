@@ -0,0 +1,90 @@
+package pubsub
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/idkwhyureadthis/ozon-task/graph/model"
+)
+
+const defaultBufferSize = 16
+
+type subscriber struct {
+	ch chan *model.Comment
+}
+
+type Broker struct {
+	mu          sync.RWMutex
+	subscribers map[string]map[*subscriber]struct{}
+	bufferSize  int
+}
+
+func New(bufferSize int) *Broker {
+	if bufferSize < 1 {
+		bufferSize = defaultBufferSize
+	}
+	return &Broker{
+		subscribers: make(map[string]map[*subscriber]struct{}),
+		bufferSize:  bufferSize,
+	}
+}
+
+func PostTopic(postId string) string {
+	return "post:" + postId
+}
+
+func CommentTopic(commentId string) string {
+	return "comment:" + commentId
+}
+
+// Subscribe returns a buffered channel receiving every comment published to topic.
+// The channel is closed and the subscriber removed as soon as ctx is done.
+func (b *Broker) Subscribe(ctx context.Context, topic string) <-chan *model.Comment {
+	sub := &subscriber{
+		ch: make(chan *model.Comment, b.bufferSize),
+	}
+
+	b.mu.Lock()
+	if b.subscribers[topic] == nil {
+		b.subscribers[topic] = make(map[*subscriber]struct{})
+	}
+	b.subscribers[topic][sub] = struct{}{}
+	b.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		b.unsubscribe(topic, sub)
+	}()
+
+	return sub.ch
+}
+
+func (b *Broker) unsubscribe(topic string, sub *subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subscribers[topic], sub)
+	if len(b.subscribers[topic]) == 0 {
+		delete(b.subscribers, topic)
+	}
+	close(sub.ch)
+}
+
+// Publish never blocks: a subscriber whose buffer is full misses the comment.
+func (b *Broker) Publish(topic string, comment *model.Comment) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for sub := range b.subscribers[topic] {
+		select {
+		case sub.ch <- comment:
+		default:
+			log.Println("subscriber buffer is full, dropping comment", comment.ID, "for", topic)
+		}
+	}
+}
+
+func (b *Broker) SubscribersCount(topic string) int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.subscribers[topic])
+}
@@ -0,0 +1,61 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/idkwhyureadthis/ozon-task/graph/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBroker(t *testing.T) {
+	t.Run("subscriber gets only comments of its topic", func(t *testing.T) {
+		broker := New(4)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		first := broker.Subscribe(ctx, PostTopic("1"))
+		second := broker.Subscribe(ctx, PostTopic("2"))
+
+		broker.Publish(PostTopic("1"), &model.Comment{ID: "1"})
+
+		require.Equal(t, "1", (<-first).ID)
+		require.Len(t, second, 0)
+	})
+
+	t.Run("full buffer does not block publisher", func(t *testing.T) {
+		broker := New(2)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		ch := broker.Subscribe(ctx, CommentTopic("3"))
+		for i := range 5 {
+			broker.Publish(CommentTopic("3"), &model.Comment{ID: fmt.Sprint(i)})
+		}
+
+		require.Len(t, ch, 2)
+		require.Equal(t, "0", (<-ch).ID)
+		require.Equal(t, "1", (<-ch).ID)
+	})
+
+	t.Run("cancelled subscriber is removed and its channel closed", func(t *testing.T) {
+		broker := New(2)
+		ctx, cancel := context.WithCancel(context.Background())
+
+		ch := broker.Subscribe(ctx, PostTopic("1"))
+		require.Equal(t, 1, broker.SubscribersCount(PostTopic("1")))
+
+		cancel()
+		select {
+		case _, ok := <-ch:
+			require.False(t, ok)
+		case <-time.After(time.Second):
+			t.Fatal("channel was not closed after unsubscribe")
+		}
+		require.Equal(t, 0, broker.SubscribersCount(PostTopic("1")))
+
+		broker.Publish(PostTopic("1"), &model.Comment{ID: "1"})
+	})
+}
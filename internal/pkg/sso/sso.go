@@ -0,0 +1,226 @@
+package sso
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/idkwhyureadthis/ozon-task/graph/model"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/apperr"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/auth"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/database"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// loginCookie keeps state, nonce and PKCE verifier of a login between Login and Callback.
+	loginCookie  = "oidc_login"
+	loginTimeout = 10 * time.Minute
+)
+
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is where the provider sends users back to, it has to lead to Callback.
+	RedirectURL string
+}
+
+// Provider logs users in with an external OpenID Connect provider using the authorization
+// code flow. Login sends the user to the provider, Callback checks what the provider sent
+// back, links or creates the user and answers with tokens the way the login mutation does.
+type Provider struct {
+	Storage database.Storage
+	Tokens  *auth.Tokens
+	Logger  *log.Logger
+	Clock   func() time.Time
+
+	oauth    oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// New discovers the endpoints and keys of the provider at config.Issuer.
+func New(ctx context.Context, config Config, storage database.Storage, tokens *auth.Tokens) (*Provider, error) {
+	provider, err := oidc.NewProvider(ctx, config.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	return &Provider{
+		Storage: storage,
+		Tokens:  tokens,
+		Logger:  log.Default(),
+		Clock:   time.Now,
+		oauth: oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  config.RedirectURL,
+			Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: config.ClientID}),
+	}, nil
+}
+
+type login struct {
+	state    string
+	nonce    string
+	verifier string
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func newLogin() (login, error) {
+	var (
+		l   login
+		err error
+	)
+	for _, value := range []*string{&l.state, &l.nonce, &l.verifier} {
+		if *value, err = randomString(); err != nil {
+			return login{}, err
+		}
+	}
+	return l, nil
+}
+
+// the parts are base64url, which has no dots
+func (l login) String() string {
+	return strings.Join([]string{l.state, l.nonce, l.verifier}, ".")
+}
+
+func parseLogin(value string) (login, bool) {
+	parts := strings.Split(value, ".")
+	if len(parts) != 3 {
+		return login{}, false
+	}
+	return login{state: parts[0], nonce: parts[1], verifier: parts[2]}, true
+}
+
+func (p *Provider) setLoginCookie(w http.ResponseWriter, r *http.Request, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCookie,
+		Value:    value,
+		Path:     "/auth/oidc",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		// the provider redirects back with a top-level GET, which Lax still sends the cookie with
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (p *Provider) Login(w http.ResponseWriter, r *http.Request) {
+	l, err := newLogin()
+	if err != nil {
+		p.Logger.Println("failed to start oidc login:", err)
+		http.Error(w, "server error occurred", http.StatusInternalServerError)
+		return
+	}
+	p.setLoginCookie(w, r, l.String(), int(loginTimeout/time.Second))
+	url := p.oauth.AuthCodeURL(l.state, oidc.Nonce(l.nonce), oauth2.S256ChallengeOption(l.verifier))
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// claims are the ID token claims a user is made from.
+type claims struct {
+	Name              string `json:"name"`
+	PreferredUsername string `json:"preferred_username"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+}
+
+var errWrongLogin = errors.New("login is expired or was started elsewhere")
+
+// identity exchanges the code the provider sent back and verifies the ID token it is exchanged for.
+func (p *Provider) identity(ctx context.Context, r *http.Request) (auth.Identity, error) {
+	cookie, err := r.Cookie(loginCookie)
+	if err != nil {
+		return auth.Identity{}, errWrongLogin
+	}
+	l, ok := parseLogin(cookie.Value)
+	if !ok || r.URL.Query().Get("state") != l.state {
+		return auth.Identity{}, errWrongLogin
+	}
+	if reason := r.URL.Query().Get("error"); reason != "" {
+		return auth.Identity{}, errors.New("provider refused to log in: " + reason)
+	}
+	token, err := p.oauth.Exchange(ctx, r.URL.Query().Get("code"), oauth2.VerifierOption(l.verifier))
+	if err != nil {
+		return auth.Identity{}, errors.New("failed to exchange code")
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return auth.Identity{}, errors.New("provider sent no id token")
+	}
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return auth.Identity{}, errors.New("invalid id token")
+	}
+	if idToken.Nonce != l.nonce {
+		return auth.Identity{}, errors.New("invalid id token")
+	}
+	var c claims
+	if err := idToken.Claims(&c); err != nil {
+		return auth.Identity{}, errors.New("invalid id token")
+	}
+	name := c.PreferredUsername
+	if name == "" {
+		name = c.Name
+	}
+	return auth.Identity{
+		Issuer:        idToken.Issuer,
+		Subject:       idToken.Subject,
+		Name:          name,
+		Email:         c.Email,
+		EmailVerified: c.EmailVerified,
+	}, nil
+}
+
+func (p *Provider) Callback(w http.ResponseWriter, r *http.Request) {
+	p.setLoginCookie(w, r, "", -1)
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	identity, err := p.identity(ctx, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	user, err := p.Storage.LinkIdentity(ctx, identity)
+	var session *model.Session
+	if err == nil {
+		session, err = p.Storage.CreateSession(ctx, user.ID, auth.ClientFrom(ctx), p.Clock().Add(p.Tokens.RefreshTTL))
+	}
+	if err != nil {
+		status := http.StatusForbidden
+		if appErr, ok := apperr.As(err); ok && appErr.Code == apperr.CodeInternal {
+			status = http.StatusInternalServerError
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	pair, err := p.Tokens.Issue(auth.Principal{UserID: user.ID, SessionID: session.ID})
+	if err != nil {
+		p.Logger.Println("failed to issue tokens:", err)
+		http.Error(w, "server error occurred", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(model.AuthPayload{
+		AccessToken:  pair.AccessToken,
+		RefreshToken: pair.RefreshToken,
+		User:         user,
+	})
+}
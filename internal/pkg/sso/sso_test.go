@@ -0,0 +1,267 @@
+package sso
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/idkwhyureadthis/ozon-task/graph/model"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/auth"
+	"github.com/idkwhyureadthis/ozon-task/internal/pkg/database"
+	"github.com/stretchr/testify/require"
+)
+
+// grant is what the mock issuer remembers about an authorization code.
+type grant struct {
+	nonce     string
+	challenge string
+}
+
+// mockIssuer is a local OpenID Connect provider that logs everyone in as user without asking.
+type mockIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu     sync.Mutex
+	user   jwt.MapClaims
+	nonce  string // overrides the nonce put into ID tokens when set
+	grants map[string]grant
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	issuer := &mockIssuer{key: key, grants: map[string]grant{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", issuer.discovery)
+	mux.HandleFunc("GET /jwks", issuer.jwks)
+	mux.HandleFunc("GET /authorize", issuer.authorize)
+	mux.HandleFunc("POST /token", issuer.token)
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+func (i *mockIssuer) logInAs(user jwt.MapClaims) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.user = user
+}
+
+func (i *mockIssuer) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]any{
+		"issuer":                                i.URL,
+		"authorization_endpoint":                i.URL + "/authorize",
+		"token_endpoint":                        i.URL + "/token",
+		"jwks_uri":                              i.URL + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (i *mockIssuer) jwks(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(i.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(i.key.E)).Bytes()),
+		}},
+	})
+}
+
+func (i *mockIssuer) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	code, _ := randomString()
+	i.mu.Lock()
+	i.grants[code] = grant{nonce: query.Get("nonce"), challenge: query.Get("code_challenge")}
+	i.mu.Unlock()
+	redirect, _ := url.Parse(query.Get("redirect_uri"))
+	redirect.RawQuery = url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (i *mockIssuer) token(w http.ResponseWriter, r *http.Request) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	g, ok := i.grants[r.FormValue("code")]
+	delete(i.grants, r.FormValue("code"))
+	challenge := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(challenge[:]) != g.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"error": "invalid_grant"}`)
+		return
+	}
+	claims := jwt.MapClaims{
+		"iss":   i.URL,
+		"aud":   "ozon-task",
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"nonce": g.nonce,
+	}
+	if i.nonce != "" {
+		claims["nonce"] = i.nonce
+	}
+	for name, value := range i.user {
+		claims[name] = value
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "test"
+	idToken, err := token.SignedString(i.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   60,
+		"id_token":     idToken,
+	})
+}
+
+var testTokens = auth.NewTokens([]byte("test secret"))
+
+// newTestApp serves Login and Callback of a provider for issuer and returns a browser for it.
+func newTestApp(t *testing.T, issuer *mockIssuer, storage database.Storage) (string, *http.Client) {
+	mux := http.NewServeMux()
+	app := httptest.NewServer(mux)
+	t.Cleanup(app.Close)
+	provider, err := New(context.Background(), Config{
+		Issuer:       issuer.URL,
+		ClientID:     "ozon-task",
+		ClientSecret: "secret",
+		RedirectURL:  app.URL + "/auth/oidc/callback",
+	}, storage, testTokens)
+	require.NoError(t, err)
+	mux.HandleFunc("GET /auth/oidc/login", provider.Login)
+	mux.HandleFunc("GET /auth/oidc/callback", provider.Callback)
+
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	return app.URL, &http.Client{Jar: jar}
+}
+
+func logIn(t *testing.T, browser *http.Client, app string) (int, model.AuthPayload) {
+	resp, err := browser.Get(app + "/auth/oidc/login")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var payload model.AuthPayload
+	if resp.StatusCode == http.StatusOK {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&payload))
+	}
+	return resp.StatusCode, payload
+}
+
+func TestLogin(t *testing.T) {
+	issuer := newMockIssuer(t)
+	storage := database.NewMemory()
+	app, browser := newTestApp(t, issuer, storage)
+
+	issuer.logInAs(jwt.MapClaims{"sub": "42", "preferred_username": "srgold78", "name": "Влад Младший"})
+	status, first := logIn(t, browser, app)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "srgold78", first.User.Name)
+	principal, err := testTokens.Verify(first.AccessToken)
+	require.NoError(t, err)
+	require.Equal(t, first.User.ID, principal.UserID)
+	ctx := graphql.WithResponseContext(context.Background(), graphql.DefaultErrorPresenter, graphql.DefaultRecover)
+	require.NoError(t, storage.TouchSession(ctx, principal, auth.Client{}))
+
+	status, second := logIn(t, browser, app)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, first.User.ID, second.User.ID)
+	require.NotEqual(t, first.RefreshToken, second.RefreshToken)
+}
+
+func TestLoginLinksVerifiedEmail(t *testing.T) {
+	issuer := newMockIssuer(t)
+	storage := database.NewMemory()
+	app, browser := newTestApp(t, issuer, storage)
+	email := "srgold78@example.com"
+	user, err := storage.Register(context.Background(), &model.RegisterInput{Name: "srgold78", Email: &email}, "hash")
+	require.NoError(t, err)
+
+	issuer.logInAs(jwt.MapClaims{"sub": "42", "email": "SrGold78@example.com", "email_verified": false})
+	status, payload := logIn(t, browser, app)
+	require.Equal(t, http.StatusOK, status)
+	require.NotEqual(t, user.ID, payload.User.ID)
+
+	// the local user never verified the address, so it isn't proof they are the same person
+	issuer.logInAs(jwt.MapClaims{"sub": "43", "email": "SrGold78@example.com", "email_verified": true})
+	status, payload = logIn(t, browser, app)
+	require.Equal(t, http.StatusOK, status)
+	require.NotEqual(t, user.ID, payload.User.ID)
+
+	owner := "srgold77@example.com"
+	verified, err := storage.Register(context.Background(), &model.RegisterInput{Name: "srgold77", Email: &owner}, "hash")
+	require.NoError(t, err)
+	_, err = storage.CreateEmailToken(context.Background(), owner, auth.PurposeVerifyEmail, "verify", time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	_, err = storage.VerifyEmail(context.Background(), "verify")
+	require.NoError(t, err)
+	issuer.logInAs(jwt.MapClaims{"sub": "44", "email": "SrGold77@example.com", "email_verified": true})
+	status, payload = logIn(t, browser, app)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, verified.ID, payload.User.ID)
+}
+
+func TestCallbackChecksState(t *testing.T) {
+	issuer := newMockIssuer(t)
+	app, browser := newTestApp(t, issuer, database.NewMemory())
+	issuer.logInAs(jwt.MapClaims{"sub": "42"})
+
+	resp, err := browser.Get(app + "/auth/oidc/callback?code=forged&state=forged")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// the login cookie is there now, but the state still has to match it
+	browser.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if req.URL.Path == "/auth/oidc/callback" {
+			return http.ErrUseLastResponse
+		}
+		return nil
+	}
+	resp, err = browser.Get(app + "/auth/oidc/login")
+	require.NoError(t, err)
+	resp.Body.Close()
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	query := callback.Query()
+	query.Set("state", "forged")
+	callback.RawQuery = query.Encode()
+	resp, err = browser.Get(callback.String())
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestCallbackChecksNonce(t *testing.T) {
+	issuer := newMockIssuer(t)
+	app, browser := newTestApp(t, issuer, database.NewMemory())
+	issuer.logInAs(jwt.MapClaims{"sub": "42"})
+	issuer.nonce = "replayed"
+
+	status, _ := logIn(t, browser, app)
+	require.Equal(t, http.StatusUnauthorized, status)
+}